@@ -29,7 +29,6 @@ import (
 
 	"github.com/AidosKuneen/aklib/arypack"
 	"github.com/AidosKuneen/aknode/imesh"
-	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/setting"
 	"github.com/AidosKuneen/consensus"
 )
@@ -43,12 +42,19 @@ type network interface {
 //Adaptor is an adaptor for consensus.
 type Adaptor struct {
 	s *setting.Setting
+	c *Consensus
 }
 
-//NewAdaptor returns a instance of Adaptor.
+//NewAdaptor returns a instance of Adaptor for the default Consensus.
 func NewAdaptor(s *setting.Setting) *Adaptor {
+	return std.NewAdaptor(s)
+}
+
+//NewAdaptor returns a instance of Adaptor for c.
+func (c *Consensus) NewAdaptor(s *setting.Setting) *Adaptor {
 	return &Adaptor{
 		s: s,
+		c: c,
 	}
 }
 
@@ -58,7 +64,7 @@ func (a *Adaptor) AcquireLedger(id consensus.LedgerID) (*consensus.Ledger, error
 	if err == nil {
 		return l, nil
 	}
-	peer.GetLedger(a.s, id)
+	a.c.peer.GetLedger(a.s, id)
 	return nil, errors.New("not found")
 }
 
@@ -81,7 +87,7 @@ func (a *Adaptor) AcquireTxSet(id consensus.TxSetID) ([]consensus.TxT, error) {
 
 // HasOpenTransactions returns whether any transactions are in the open ledger
 func (a *Adaptor) HasOpenTransactions() bool {
-	ls := leaves.GetAllUnconfirmed()
+	ls := a.c.mesh.Leaves().GetAllUnconfirmed()
 	return len(ls) > 0
 }
 
@@ -91,7 +97,7 @@ func (a *Adaptor) OnModeChange(consensus.Mode, consensus.Mode) {} //nothing
 // OnClose is called when ledger closes
 func (a *Adaptor) OnClose(prev *consensus.Ledger, now time.Time, mode consensus.Mode) consensus.TxSet {
 	//return the oldest unconfirmed leaf
-	ls := leaves.GetAllUnconfirmed()
+	ls := a.c.mesh.Leaves().GetAllUnconfirmed()
 	if len(ls) == 0 {
 		return nil
 	}
@@ -128,11 +134,11 @@ func (a *Adaptor) OnAccept(l *consensus.Ledger) {
 	if len(l.Txs) == 0 {
 		log.Println("no txs is onaccepted")
 	}
-	if err := Confirm(a.s, l); err != nil {
+	if err := a.c.Confirm(a.s, l); err != nil {
 		log.Println(err)
 		return
 	}
-	if err := PutLedger(a.s, l); err != nil {
+	if err := a.c.PutLedger(a.s, l); err != nil {
 		log.Println(err)
 	}
 }
@@ -151,12 +157,12 @@ func (a *Adaptor) Propose(prop *consensus.Proposal) {
 		return
 	}
 	prop.Signature = arypack.Marshal(sig)
-	peer.BroadcastProposal(a.s, prop)
+	a.c.peer.BroadcastProposal(a.s, prop)
 }
 
 //SharePosition  shares a received Peer proposal with other Peer's.
 func (a *Adaptor) SharePosition(prop *consensus.Proposal) {
-	peer.BroadcastProposal(a.s, prop)
+	a.c.peer.BroadcastProposal(a.s, prop)
 }
 
 // ShareTx shares a disputed transaction with Peers
@@ -179,7 +185,7 @@ func (a *Adaptor) ShareValidaton(v *consensus.Validation) {
 		return
 	}
 	v.Signature = arypack.Marshal(sig)
-	peer.BroadcastValidatoin(a.s, v)
+	a.c.peer.BroadcastValidatoin(a.s, v)
 }
 
 // ShouldAccept returns true if the result should be accepted
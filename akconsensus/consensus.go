@@ -33,22 +33,45 @@ import (
 	"github.com/AidosKuneen/aklib/arypack"
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
-	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/setting"
 	"github.com/AidosKuneen/consensus"
 	"github.com/dgraph-io/badger"
 )
 
-var (
-	notify            chan []tx.Hash
-	proposals         = make(map[consensus.ProposalID]time.Time)
-	validations       = make(map[consensus.ValidationID]time.Time)
-	latestLedger      = consensus.Genesis
-	latestSolidLedger = consensus.Genesis
+//Consensus is a state of consensus of a node, i.e. ledgers and
+//proposals/validations received.
+type Consensus struct {
+	mesh              *imesh.Mesh
+	bus               *event.Bus
+	proposals         map[consensus.ProposalID]time.Time
+	validations       map[consensus.ValidationID]time.Time
+	latestLedger      *consensus.Ledger
+	latestSolidLedger *consensus.Ledger
 	peer              network
 	mutex             sync.RWMutex
-)
+	workers           sync.WaitGroup
+}
+
+//std is the default Consensus for package functions.
+var std = newConsensus(imesh.Default(), event.Default())
+
+func newConsensus(m *imesh.Mesh, b *event.Bus) *Consensus {
+	return &Consensus{
+		mesh:              m,
+		bus:               b,
+		proposals:         make(map[consensus.ProposalID]time.Time),
+		validations:       make(map[consensus.ValidationID]time.Time),
+		latestLedger:      consensus.Genesis,
+		latestSolidLedger: consensus.Genesis,
+	}
+}
+
+//Default returns the default Consensus used by package functions.
+func Default() *Consensus {
+	return std
+}
 
 type ledger struct {
 	ParentID            consensus.LedgerID
@@ -103,36 +126,63 @@ func fromLedger(s *setting.Setting, l *ledger) (*consensus.Ledger, error) {
 
 //LatestLedger returns the last ledger.
 func LatestLedger() *consensus.Ledger {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	return latestSolidLedger
+	return std.LatestLedger()
+}
+
+//LatestLedger returns the last ledger.
+func (c *Consensus) LatestLedger() *consensus.Ledger {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.latestSolidLedger
+}
+
+//New returns a Consensus on the iMesh m, which publishes events to b.
+//It must be initialized by Init.
+func New(m *imesh.Mesh, b *event.Bus) *Consensus {
+	return newConsensus(m, b)
 }
 
-//Init initialize consensus.
+//Bus returns the event bus of the consensus.
+func (c *Consensus) Bus() *event.Bus {
+	return c.bus
+}
+
+//Init initialize the default consensus.
 func Init(ctx context.Context, s *setting.Setting, p network) error {
+	return std.Init(ctx, s, p)
+}
+
+//Init initialize consensus, which communicates with other nodes by p.
+func (c *Consensus) Init(ctx context.Context, s *setting.Setting, p network) error {
 	consensus.LedgerGranularity = 5 * time.Second
 
-	notify = nil
-	proposals = make(map[consensus.ProposalID]time.Time)
-	validations = make(map[consensus.ValidationID]time.Time)
-	latestLedger = consensus.Genesis
-	latestSolidLedger = consensus.Genesis
+	c.mutex.Lock()
+	c.proposals = make(map[consensus.ProposalID]time.Time)
+	c.validations = make(map[consensus.ValidationID]time.Time)
+	c.latestLedger = consensus.Genesis
+	c.latestSolidLedger = consensus.Genesis
 
-	peer = p
+	c.peer = p
 	err := s.DB.View(func(txn *badger.Txn) error {
-		return db.Get(txn, nil, &latestSolidLedger, db.HeaderLastLedger)
+		return db.Get(txn, nil, &c.latestSolidLedger, db.HeaderLastLedger)
 	})
-	latestLedger = latestSolidLedger
+	c.latestLedger = c.latestSolidLedger
+	c.mutex.Unlock()
 	if err == badger.ErrKeyNotFound {
 		return nil
 	}
-	goRetryLedger(ctx, s)
+	c.goRetryLedger(ctx, s)
 	return err
 }
 
+//Wait waits for routines of the consensus to be stopped after canceling the context.
+func (c *Consensus) Wait() {
+	c.workers.Wait()
+}
+
 //HandleValidation checks p was already received or not, and
 //p is from a trusted node.
-func handleValidation(s *setting.Setting, peer *consensus.Peer, p *consensus.Validation) (bool, error) {
+func (c *Consensus) handleValidation(s *setting.Setting, peer *consensus.Peer, p *consensus.Validation) (bool, error) {
 	id := p.ID()
 	var sig address.Signature
 	if err := arypack.Unmarshal(p.Signature, &sig); err != nil {
@@ -146,15 +196,15 @@ func handleValidation(s *setting.Setting, peer *consensus.Peer, p *consensus.Val
 		return false, errors.New("invalid nodeID")
 	}
 	noexist := func() bool {
-		mutex.Lock()
-		defer mutex.Unlock()
-		if _, ok := validations[p.ID()]; ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if _, ok := c.validations[p.ID()]; ok {
 			return false
 		}
-		validations[p.ID()] = time.Now()
-		for k, v := range validations {
+		c.validations[p.ID()] = time.Now()
+		for k, v := range c.validations {
 			if time.Now().After(v.Add(50 * time.Second)) {
-				delete(validations, k)
+				delete(c.validations, k)
 			}
 		}
 		return true
@@ -176,7 +226,7 @@ func handleValidation(s *setting.Setting, peer *consensus.Peer, p *consensus.Val
 
 //HandleProposal checks p was already received or not, and
 //p is from a trusted node.
-func handleProposal(s *setting.Setting, peer *consensus.Peer, p *consensus.Proposal) (bool, error) {
+func (c *Consensus) handleProposal(s *setting.Setting, peer *consensus.Peer, p *consensus.Proposal) (bool, error) {
 	id := p.ID()
 	var sig address.Signature
 	if err := arypack.Unmarshal(p.Signature, &sig); err != nil {
@@ -190,15 +240,15 @@ func handleProposal(s *setting.Setting, peer *consensus.Peer, p *consensus.Propo
 		return false, errors.New("invalid nodeID")
 	}
 	noexist := func() bool {
-		mutex.Lock()
-		defer mutex.Unlock()
-		if _, ok := proposals[p.ID()]; ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if _, ok := c.proposals[p.ID()]; ok {
 			return false
 		}
-		proposals[p.ID()] = time.Now()
-		for k, v := range proposals {
+		c.proposals[p.ID()] = time.Now()
+		for k, v := range c.proposals {
 			if time.Now().After(v.Add(time.Hour)) {
-				delete(proposals, k)
+				delete(c.proposals, k)
 			}
 		}
 		return true
@@ -220,18 +270,24 @@ func handleProposal(s *setting.Setting, peer *consensus.Peer, p *consensus.Propo
 //PutLedger puts a ledger.
 //called from consensus.Peer
 func PutLedger(s *setting.Setting, l *consensus.Ledger) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	return putLedger(s, l)
+	return std.PutLedger(s, l)
 }
 
-func putLedger(s *setting.Setting, l *consensus.Ledger) error {
+//PutLedger puts a ledger.
+//called from consensus.Peer
+func (c *Consensus) PutLedger(s *setting.Setting, l *consensus.Ledger) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.putLedger(s, l)
+}
+
+func (c *Consensus) putLedger(s *setting.Setting, l *consensus.Ledger) error {
 	return s.DB.Update(func(txn *badger.Txn) error {
 		id := l.ID()
 		if err := db.Put(txn, id[:], newLedger(l), db.HeaderLedger); err != nil {
 			return err
 		}
-		return db.Put(txn, nil, latestSolidLedger, db.HeaderLastLedger)
+		return db.Put(txn, nil, c.latestSolidLedger, db.HeaderLastLedger)
 	})
 }
 
@@ -275,27 +331,39 @@ func ReadLeadger(s *setting.Setting, peer *consensus.Peer, buf []byte) (*consens
 
 //ReadValidation parse a Validation command.
 func ReadValidation(s *setting.Setting, peer *consensus.Peer, buf []byte) (*consensus.Validation, bool, error) {
+	return std.ReadValidation(s, peer, buf)
+}
+
+//ReadValidation parse a Validation command.
+func (c *Consensus) ReadValidation(s *setting.Setting, peer *consensus.Peer, buf []byte) (*consensus.Validation, bool, error) {
 	var v consensus.Validation
 	err := arypack.Unmarshal(buf, &v)
 	if err != nil {
 		return nil, false, err
 	}
-	noexist, err := handleValidation(s, peer, &v)
+	noexist, err := c.handleValidation(s, peer, &v)
 	return &v, noexist, err
 }
 
 //ReadProposal parse a Proposal command.
 func ReadProposal(s *setting.Setting, peer *consensus.Peer, buf []byte) (*consensus.Proposal, bool, error) {
+	return std.ReadProposal(s, peer, buf)
+}
+
+//ReadProposal parse a Proposal command.
+func (c *Consensus) ReadProposal(s *setting.Setting, peer *consensus.Peer, buf []byte) (*consensus.Proposal, bool, error) {
 	var v consensus.Proposal
 	if err := arypack.Unmarshal(buf, &v); err != nil {
 		return nil, false, err
 	}
-	noexist, err := handleProposal(s, peer, &v)
+	noexist, err := c.handleProposal(s, peer, &v)
 	return &v, noexist, err
 }
 
-func goRetryLedger(ctx context.Context, s *setting.Setting) {
+func (c *Consensus) goRetryLedger(ctx context.Context, s *setting.Setting) {
+	c.workers.Add(1)
 	go func() {
+		defer c.workers.Done()
 		ctx2, cancel2 := context.WithCancel(ctx)
 		defer cancel2()
 		for {
@@ -303,10 +371,14 @@ func goRetryLedger(ctx context.Context, s *setting.Setting) {
 			case <-ctx2.Done():
 				return
 			case <-time.After(5 * time.Second):
-				if latestLedger.ID() == latestSolidLedger.ID() {
+				c.mutex.RLock()
+				l := c.latestLedger
+				solid := c.latestSolidLedger
+				c.mutex.RUnlock()
+				if l.ID() == solid.ID() {
 					continue
 				}
-				if err := Confirm(s, latestLedger); err != nil {
+				if err := c.Confirm(s, l); err != nil {
 					log.Println(err)
 				}
 			}
@@ -316,23 +388,28 @@ func goRetryLedger(ctx context.Context, s *setting.Setting) {
 
 //Confirm confirms txs and return hashes of confirmed txs.
 func Confirm(s *setting.Setting, l *consensus.Ledger) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	latestLedger = l
+	return std.Confirm(s, l)
+}
+
+//Confirm confirms txs and return hashes of confirmed txs.
+func (c *Consensus) Confirm(s *setting.Setting, l *consensus.Ledger) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.latestLedger = l
 
 	var tr []tx.Hash
 
-	if err := putLedger(s, l); err != nil {
+	if err := c.putLedger(s, l); err != nil {
 		return err
 	}
 
-	seq := consensus.NewSpan(l).Diff(latestSolidLedger)
-	last := latestSolidLedger
+	seq := consensus.NewSpan(l).Diff(c.latestSolidLedger)
+	last := c.latestSolidLedger
 	//get all ledgers
 	for i := l.Seq; i > seq; i-- {
 		if _, err := GetLedger(s, last.ParentID); err == badger.ErrKeyNotFound {
 			log.Println("no ledger while confirm", hex.EncodeToString(last.ParentID[:]))
-			peer.GetLedger(s, last.ParentID)
+			c.peer.GetLedger(s, last.ParentID)
 			time.Sleep(10 * time.Second)
 		}
 		var err error
@@ -342,7 +419,7 @@ func Confirm(s *setting.Setting, l *consensus.Ledger) error {
 		}
 	}
 	//go backward
-	last = latestSolidLedger
+	last = c.latestSolidLedger
 	for i := last.Seq; i >= seq; i-- {
 		var err error
 		if len(last.Txs) != 0 {
@@ -350,12 +427,18 @@ func Confirm(s *setting.Setting, l *consensus.Ledger) error {
 			for h := range last.Txs {
 				t = tx.Hash(h[:])
 			}
-			_, err = imesh.RevertConfirmation(s, t, imesh.StatNo(last.ID()))
-			if err != nil {
-				return err
+			hs, err2 := c.mesh.RevertConfirmation(s, t, imesh.StatNo(last.ID()))
+			if err2 != nil {
+				return err2
+			}
+			if len(hs) != 0 {
+				c.bus.Publish(&event.Event{
+					Type: event.ConfirmationReverted,
+					Txs:  hs,
+				})
 			}
 		}
-		latestSolidLedger = last
+		c.latestSolidLedger = last
 		last, err = GetLedger(s, last.ParentID)
 		if err != nil {
 			return err
@@ -378,33 +461,48 @@ func Confirm(s *setting.Setting, l *consensus.Ledger) error {
 				return err
 			}
 			if !has {
-				if err2 := imesh.AddNoexistTxHash(s, t, tx.TypeNormal); err2 != nil {
+				if err2 := c.mesh.AddNoexistTxHash(s, t, tx.TypeNormal); err2 != nil {
 					return err2
 				}
 				return errors.New("no tx:" + t.String())
 			}
-			hs, err2 := imesh.Confirm(s, t, l.ID())
+			hs, err2 := c.mesh.Confirm(s, t, l.ID())
 			if err2 != nil {
 				return err2
 			}
 			tr = append(tr, hs...)
 		}
-		latestSolidLedger = ll
+		c.latestSolidLedger = ll
 	}
 
-	if notify != nil {
-		txs := make([]tx.Hash, 0, len(tr))
-		for _, t := range tr {
-			ti, err := imesh.GetTxInfo(s.DB, t)
-			if err != nil {
-				return err
-			}
-			if ti.IsAccepted() {
-				txs = append(txs, t)
-			}
+	var acc, rej []tx.Hash
+	for _, t := range tr {
+		ti, err := imesh.GetTxInfo(s.DB, t)
+		if err != nil {
+			return err
+		}
+		if ti.IsAccepted() {
+			acc = append(acc, t)
+		} else {
+			rej = append(rej, t)
 		}
-		notify <- txs
 	}
+	if len(acc) != 0 {
+		c.bus.Publish(&event.Event{
+			Type: event.TxConfirmed,
+			Txs:  acc,
+		})
+	}
+	if len(rej) != 0 {
+		c.bus.Publish(&event.Event{
+			Type: event.TxRejected,
+			Txs:  rej,
+		})
+	}
+	c.bus.Publish(&event.Event{
+		Type:   event.LedgerAccepted,
+		Ledger: l,
+	})
 	if len(l.Txs) == 0 {
 		return nil
 	}
@@ -412,18 +510,22 @@ func Confirm(s *setting.Setting, l *consensus.Ledger) error {
 	for h := range l.Txs {
 		ctx = tx.Hash(h[:])
 	}
-	return leaves.SetConfirmed(s, ctx)
+	return c.mesh.Leaves().SetConfirmed(s, ctx)
 }
 
-//RegisterTxNotifier registers a notifier for resolved txs.
-func RegisterTxNotifier(n chan []tx.Hash) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	notify = n
+//SetLatest is only for test. Don't use it.
+func SetLatest(l *consensus.Ledger) {
+	std.SetLatest(l)
 }
 
 //SetLatest is only for test. Don't use it.
-func SetLatest(l *consensus.Ledger) {
-	latestLedger = l
-	latestSolidLedger = l
+func (c *Consensus) SetLatest(l *consensus.Ledger) {
+	c.mutex.Lock()
+	c.latestLedger = l
+	c.latestSolidLedger = l
+	c.mutex.Unlock()
+	c.bus.Publish(&event.Event{
+		Type:   event.LedgerAccepted,
+		Ledger: l,
+	})
 }
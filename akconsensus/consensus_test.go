@@ -31,6 +31,7 @@ import (
 	"github.com/AidosKuneen/aklib/address"
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/setting"
@@ -95,8 +96,8 @@ func teardown(t *testing.T) {
 func TestConsensus(t *testing.T) {
 	setup(t)
 	defer teardown(t)
-	ch := make(chan []tx.Hash)
-	RegisterTxNotifier(ch)
+	sub := std.Bus().Subscribe(0, event.Block, event.TxConfirmed)
+	defer sub.Unsubscribe()
 
 	var trs [8]*tx.Transaction
 
@@ -236,7 +237,8 @@ func TestConsensus(t *testing.T) {
 	go func() {
 		var tr []tx.Hash
 		select {
-		case tr = <-ch: //l3
+		case e := <-sub.C: //l3
+			tr = e.Txs
 		case <-time.Tick(10 * time.Second):
 			t.Error("failed to notify")
 		}
@@ -255,7 +257,8 @@ func TestConsensus(t *testing.T) {
 			}
 		}
 		select {
-		case tr = <-ch: //l7
+		case e := <-sub.C: //l7
+			tr = e.Txs
 		case <-time.Tick(10 * time.Second):
 			t.Error("failed to notify")
 		}
@@ -274,7 +277,8 @@ func TestConsensus(t *testing.T) {
 			}
 		}
 		select {
-		case tr = <-ch: //l6
+		case e := <-sub.C: //l6
+			tr = e.Txs
 		case <-time.Tick(10 * time.Second):
 			t.Error("failed to notify")
 		}
@@ -39,7 +39,7 @@ import (
 	"github.com/AidosKuneen/aklib/address"
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/updater"
-	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/explorer"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
@@ -52,6 +52,9 @@ import (
 	"github.com/natefinch/lumberjack"
 )
 
+//shutdownTimeout is the timeout for each step of shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func onSigs(se *setting.Setting) {
 	sig := make(chan os.Signal)
 	signal.Notify(sig,
@@ -96,12 +99,14 @@ func main() {
 	}
 	defaultpath := filepath.Join(usr.HomeDir, ".aknode", "aknode.json")
 	var verbose, update, genkey, genaddress bool
-	var fname string
+	var fname, exportpeers, importpeers string
 	flag.BoolVar(&verbose, "verbose", false, "outputs logs to stdout.")
 	flag.BoolVar(&update, "update", false, "check for update")
 	flag.BoolVar(&genkey, "genkey", false, "generate a validator key")
 	flag.BoolVar(&genaddress, "genaddress", false, "generate a random address")
 	flag.StringVar(&fname, "config", defaultpath, "setting file path")
+	flag.StringVar(&exportpeers, "exportpeers", "", "export known node addresses to the file and exit")
+	flag.StringVar(&importpeers, "importpeers", "", "import node addresses from the file and exit")
 	flag.Parse()
 
 	if update {
@@ -168,6 +173,28 @@ func main() {
 		fmt.Println(err2, "in setting file")
 		os.Exit(1)
 	}
+	if exportpeers != "" {
+		err := node.ExportPeers(setting, exportpeers)
+		if err2 := setting.DB.Close(); err2 != nil {
+			log.Println(err2)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if importpeers != "" {
+		err := node.ImportPeers(setting, importpeers)
+		if err2 := setting.DB.Close(); err2 != nil {
+			log.Println(err2)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	if !verbose {
 		l := &lumberjack.Logger{
 			Filename:   filepath.Join(setting.BaseDir(), "aknode.log"),
@@ -188,13 +215,36 @@ func main() {
 
 	<-setting.Stop
 	fmt.Println("stopping aknode...")
-	time.Sleep(3 * time.Second)
+	shutdown(setting, cancel)
+	log.Println("aknode was stopped")
+}
+
+//shutdown stops RPC and explorer servers, the node and its miners,
+//and wallet notification in order, and closes the DB after all of them stopped.
+//The DB is left open if some routines of the node didn't stop,
+//because they may still write it.
+func shutdown(s *setting.Setting, cancel context.CancelFunc) {
+	ctx, cancel2 := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel2()
+	if err := rpc.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	if err := explorer.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	err := node.Stop(s, shutdownTimeout)
 	cancel()
-	time.Sleep(3 * time.Second)
-	if err := setting.DB.Close(); err != nil {
+	if err == nil {
+		err = rpc.WaitNotify(shutdownTimeout)
+	}
+	if err != nil {
+		log.Println(err)
+		fmt.Println(err)
+		return
+	}
+	if err := s.DB.Close(); err != nil {
 		log.Println(err)
 	}
-	log.Println("aknode was stopped")
 }
 
 func checkWalletSeed(s *setting.Setting) error {
@@ -244,7 +294,7 @@ func initialize(ctx context.Context, setting *setting.Setting) error {
 		return err
 	}
 
-	rpc.GoNotify(ctx, setting, node.RegisterTxNotifier, akconsensus.RegisterTxNotifier)
+	rpc.GoNotify(ctx, setting, event.Default())
 
 	if setting.RPCUser != "" {
 		if err := checkWalletSeed(setting); err != nil {
@@ -0,0 +1,352 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//akreplay reads capture files recorded by aknode with "capture":true.
+//
+//It prints messages in captures as JSON lines:
+//
+//	akreplay [-peer address] capture.dat...
+//
+//or replays inbound messages in captures against a fresh node
+//in an empty data directory to reproduce bugs:
+//
+//	akreplay -replay -config aknode.json -dir /tmp/replay [-peer address] capture.dat...
+//
+//Capture files must be specified in the order they were recorded.
+//Consensus messages are not replayed.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AidosKuneen/aklib/arypack"
+	"github.com/AidosKuneen/aklib/rand"
+	"github.com/AidosKuneen/aknode/imesh"
+	"github.com/AidosKuneen/aknode/imesh/leaves"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/node"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//replayPort is the first port number reported by replaying peers.
+const replayPort = 30000
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	var doReplay bool
+	var fname, dir, peer string
+	var wait time.Duration
+	flag.BoolVar(&doReplay, "replay", false, "replay inbound messages against a fresh node")
+	flag.StringVar(&fname, "config", "", "setting file path for replaying")
+	flag.StringVar(&dir, "dir", "", "empty data directory for replaying")
+	flag.StringVar(&peer, "peer", "", "only messages with the peer address")
+	flag.DurationVar(&wait, "wait", 10*time.Second, "time to wait for the node after replaying")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var err error
+	if doReplay {
+		err = replay(fname, dir, peer, wait, flag.Args())
+	} else {
+		err = dump(os.Stdout, peer, flag.Args())
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func readCaptures(fnames []string, peer string, f func(*msg.Record) error) error {
+	for _, fn := range fnames {
+		fi, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		r := msg.NewCaptureReader(bufio.NewReader(fi))
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil && (peer == "" || rec.Peer == peer) {
+				err = f(rec)
+			}
+			if err != nil {
+				if err2 := fi.Close(); err2 != nil {
+					log.Println(err2)
+				}
+				return err
+			}
+		}
+		if err := fi.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type record struct {
+	Time      string      `json:"time"`
+	Peer      string      `json:"peer"`
+	Direction string      `json:"direction"`
+	Command   string      `json:"command"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+type inventory struct {
+	Type msg.InvType `json:"type"`
+	Hash string      `json:"hash"`
+}
+
+func dump(w io.Writer, peer string, fnames []string) error {
+	enc := json.NewEncoder(w)
+	return readCaptures(fnames, peer, func(r *msg.Record) error {
+		dir := "out"
+		if r.Inbound {
+			dir = "in"
+		}
+		return enc.Encode(&record{
+			Time:      time.Unix(0, r.Time).Format(time.RFC3339Nano),
+			Peer:      r.Peer,
+			Direction: dir,
+			Command:   msg.CmdName(r.Command),
+			Payload:   decode(r.Command, r.Payload),
+		})
+	})
+}
+
+//decode returns a readable form of the payload dat of cmd.
+func decode(cmd byte, dat []byte) interface{} {
+	if len(dat) == 0 {
+		return nil
+	}
+	var v interface{}
+	switch cmd {
+	case msg.CmdVersion:
+		v = &msg.Version{}
+	case msg.CmdAddr:
+		v = &msg.Addrs{}
+	case msg.CmdTxs:
+		v = &msg.Txs{}
+	case msg.CmdPing, msg.CmdPong:
+		v = &msg.Nonce{}
+	case msg.CmdGetLeaves:
+		v = &msg.LeavesFrom{}
+	case msg.CmdInv, msg.CmdGetData, msg.CmdLeaves, msg.CmdNotFound:
+		v = &msg.Inventories{}
+	default:
+		return hex.EncodeToString(dat)
+	}
+	if err := arypack.Unmarshal(dat, v); err != nil {
+		return map[string]string{
+			"error": err.Error(),
+			"raw":   hex.EncodeToString(dat),
+		}
+	}
+	switch vv := v.(type) {
+	case *msg.Nonce:
+		return hex.EncodeToString(vv[:])
+	case *msg.LeavesFrom:
+		return hex.EncodeToString(vv[:])
+	case *msg.Inventories:
+		invs := make([]inventory, len(*vv))
+		for i, inv := range *vv {
+			invs[i] = inventory{
+				Type: inv.Type,
+				Hash: hex.EncodeToString(inv.Hash[:]),
+			}
+		}
+		return invs
+	}
+	return v
+}
+
+//load loads the setting file fname for a node in dir
+//which listens on localhost and doesn't run any services.
+func load(fname, dir string) (*setting.Setting, error) {
+	if fname == "" || dir == "" {
+		return nil, errors.New("-config and -dir are required for replaying")
+	}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(fs) != 0 {
+		return nil, errors.New(dir + " is not empty")
+	}
+	f, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal(f, &conf); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	if err := l.Close(); err != nil {
+		return nil, err
+	}
+	conf["root_dir"] = dir
+	conf["bind"] = "127.0.0.1"
+	conf["port"] = port
+	conf["my_host_port"] = ":" + strconv.Itoa(port)
+	conf["max_connections"] = 1000
+	conf["default_nodes"] = []string{}
+	conf["capture"] = false
+	//replaying peers on localhost send unsolicited messages, e.g. leaves and pongs,
+	//which must not get them banned.
+	wl, _ := conf["whitelists"].([]interface{})
+	conf["whitelists"] = append(wl, map[string]interface{}{
+		"net":         "127.0.0.1",
+		"permissions": []string{"noban"},
+	})
+	for _, k := range []string{"use_public_rpc", "run_validator", "run_explorer",
+		"run_fee_miner", "run_ticket_miner", "run_ticket_issuer"} {
+		conf[k] = false
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	return setting.Load(b, false)
+}
+
+//replayer is a connection to the node on behalf of a captured peer.
+type replayer struct {
+	conn net.Conn
+	s    setting.Setting
+}
+
+func newReplayer(ctx context.Context, s *setting.Setting, no int) (*replayer, error) {
+	to := "127.0.0.1:" + strconv.Itoa(int(s.Port))
+	conn, err := net.Dial("tcp", to)
+	if err != nil {
+		return nil, err
+	}
+	r := &replayer{
+		conn: conn,
+		s:    *s,
+	}
+	r.s.MyHostPort = ":" + strconv.Itoa(replayPort+no)
+	v := msg.NewVersion(&r.s, *msg.NewAddr(to, msg.ServiceFull), rand.R.Uint64())
+	if err := msg.Write(&r.s, v, msg.CmdVersion, conn); err != nil {
+		return nil, err
+	}
+	rd := msg.NewReader(conn)
+	if cmd, _, err := rd.ReadHeader(&r.s); err != nil || cmd != msg.CmdVerack {
+		return nil, fmt.Errorf("failed to handshake: %v %v", msg.CmdName(cmd), err)
+	}
+	if cmd, _, err := rd.ReadHeader(&r.s); err != nil || cmd != msg.CmdVersion {
+		return nil, fmt.Errorf("failed to handshake: %v %v", msg.CmdName(cmd), err)
+	}
+	if err := msg.Write(&r.s, nil, msg.CmdVerack, conn); err != nil {
+		return nil, err
+	}
+	//discard replies from the node.
+	go func() {
+		for {
+			cmd, _, err := rd.ReadHeader(&r.s)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			log.Println("node replied", msg.CmdName(cmd), "to", r.s.MyHostPort)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return r, nil
+}
+
+func replay(fname, dir, peer string, wait time.Duration, fnames []string) error {
+	s, err := load(fname, dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.DB.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := imesh.Init(s); err != nil {
+		return err
+	}
+	if err := leaves.Init(s); err != nil {
+		return err
+	}
+	if _, err := node.Start(ctx, s, true); err != nil {
+		return err
+	}
+	rs := make(map[string]*replayer)
+	n := 0
+	err = readCaptures(fnames, peer, func(rec *msg.Record) error {
+		if !rec.Inbound {
+			return nil
+		}
+		switch rec.Command {
+		case msg.CmdVersion, msg.CmdVerack:
+			return nil
+		case msg.CmdGetLedger, msg.CmdLedger, msg.CmdValidation, msg.CmdProposal:
+			log.Println("skipped consensus message", msg.CmdName(rec.Command))
+			return nil
+		}
+		r, ok := rs[rec.Peer]
+		if !ok {
+			var err error
+			if r, err = newReplayer(ctx, s, len(rs)); err != nil {
+				return err
+			}
+			rs[rec.Peer] = r
+		}
+		n++
+		return msg.WriteRaw(&r.s, rec.Payload, rec.Command, r.conn)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("replayed", n, "messages from", len(rs), "peers, waiting", wait)
+	time.Sleep(wait)
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AidosKuneen/aklib/arypack"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+func TestDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	fname := filepath.Join(dir, "capture.dat")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := msg.NewCapture(f)
+	nonce := msg.Nonce{1, 2, 3}
+	adrs := msg.Addrs{*msg.NewAddr("10.0.0.1:14270", msg.ServiceFull)}
+	for _, r := range []struct {
+		peer    string
+		inbound bool
+		cmd     byte
+		payload []byte
+	}{
+		{"10.0.0.2:14270", true, msg.CmdPing, arypack.Marshal(&nonce)},
+		{"10.0.0.2:14270", false, msg.CmdPong, arypack.Marshal(&nonce)},
+		{"10.0.0.3:14270", true, msg.CmdAddr, arypack.Marshal(&adrs)},
+	} {
+		if err := c.Write(r.peer, r.inbound, r.cmd, r.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := dump(&buf, "10.0.0.2:14270", []string{fname}); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	for _, d := range []string{"in", "out"} {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Peer != "10.0.0.2:14270" || rec.Direction != d || rec.Payload != hex.EncodeToString(nonce[:]) {
+			t.Error("invalid record", rec)
+		}
+	}
+	if dec.More() {
+		t.Error("should be filtered by the peer")
+	}
+
+	n := 0
+	err = readCaptures([]string{fname, fname}, "", func(rec *msg.Record) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 6 {
+		t.Error("invalid number of records", n)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	fname := filepath.Join(dir, "aknode.json")
+	conf := `{
+		"trusted_nodes":["AKNODET37nrsiTKPv7v7xBS6WBveuYz9HfEJ7MiVXtnn3eSqLgm7vQLxk"],
+		"testnet":1,
+		"run_validator":true,
+		"whitelists":[{"net":"10.0.0.0/8","permissions":["relay"]}]
+	}`
+	if err := ioutil.WriteFile(fname, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(fname, dir); err == nil {
+		t.Error("should be error for a non-empty directory")
+	}
+	s, err := load(fname, filepath.Join(dir, "replay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DB.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if s.RunValidator || s.Bind != "127.0.0.1" || len(s.DefaultNodes) != 0 {
+		t.Error("node for replaying should only listen on localhost", s)
+	}
+	if p, ok := s.Whitelisted("127.0.0.1:30000"); !ok || p&setting.PermNoBan == 0 {
+		t.Error("replaying peers should not be banned", p, ok)
+	}
+	if p, ok := s.Whitelisted("10.0.0.1:14270"); !ok || p != setting.PermRelay {
+		t.Error("whitelists in the setting should be kept", p, ok)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/consensus"
+)
+
+//Type is a type of events.
+type Type byte
+
+//Types of events.
+const (
+	//TxResolved is for txs which were resolved and added to the iMesh, in Txs.
+	TxResolved Type = iota
+	//TxConfirmed is for txs which were confirmed and accepted by a ledger, in Txs.
+	TxConfirmed
+	//TxRejected is for txs which were confirmed and rejected by a ledger, in Txs.
+	TxRejected
+	//ConfirmationReverted is for txs whose confirmations were reverted, in Txs.
+	ConfirmationReverted
+	//LedgerAccepted is for a ledger which was accepted as solid, in Ledger.
+	LedgerAccepted
+	//PeerConnected is for a peer which was connected, in Peer.
+	PeerConnected
+	//PeerDisconnected is for a peer which was disconnected, in Peer.
+	PeerDisconnected
+)
+
+//Event is an event published to subscribers.
+type Event struct {
+	Type   Type
+	Txs    []tx.Hash
+	Ledger *consensus.Ledger
+	Peer   string //address of the peer
+}
+
+//Policy is a policy when the buffer of a subscriber is full.
+type Policy byte
+
+//Policies for slow subscribers.
+const (
+	//DropNewest drops the new event.
+	DropNewest Policy = iota
+	//DropOldest drops the oldest event in the buffer for the new one.
+	DropOldest
+	//Block blocks the publisher until the subscriber receives the event.
+	Block
+)
+
+//Bus is an event bus with any number of subscribers.
+type Bus struct {
+	subs map[*Subscription]struct{}
+	sync.RWMutex
+}
+
+//Subscription is a subscription of events. Events are received from C.
+type Subscription struct {
+	dropped uint64 //must be first for atomic operations
+	C       <-chan *Event
+	ch      chan *Event
+	done    chan struct{}
+	types   map[Type]struct{} //all types if empty
+	policy  Policy
+	bus     *Bus
+	once    sync.Once
+	mutex   sync.Mutex
+}
+
+//std is the default Bus.
+var std = New()
+
+//New returns a new Bus.
+func New() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+//Default returns the default Bus.
+func Default() *Bus {
+	return std
+}
+
+//Subscribe subscribes events of types (all types if empty) with
+//a buffer whose size is size, which is handled by policy when full.
+func (b *Bus) Subscribe(size int, policy Policy, types ...Type) *Subscription {
+	ch := make(chan *Event, size)
+	sub := &Subscription{
+		C:      ch,
+		ch:     ch,
+		done:   make(chan struct{}),
+		types:  make(map[Type]struct{}),
+		policy: policy,
+		bus:    b,
+	}
+	for _, t := range types {
+		sub.types[t] = struct{}{}
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+//Publish publishes the event e to subscribers of its type.
+func (b *Bus) Publish(e *Event) {
+	b.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.RUnlock()
+	for _, sub := range subs {
+		if _, ok := sub.types[e.Type]; ok || len(sub.types) == 0 {
+			sub.send(e)
+		}
+	}
+}
+
+func (sub *Subscription) send(e *Event) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+	select {
+	case sub.ch <- e:
+		return
+	default:
+	}
+	switch sub.policy {
+	case DropNewest:
+		atomic.AddUint64(&sub.dropped, 1)
+	case DropOldest:
+		select {
+		case <-sub.ch:
+			atomic.AddUint64(&sub.dropped, 1)
+		default:
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	case Block:
+		select {
+		case sub.ch <- e:
+		case <-sub.done:
+		}
+	}
+}
+
+//Dropped returns the number of dropped events.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+//Unsubscribe stops the subscription and closes C.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		sub.bus.Lock()
+		delete(sub.bus.subs, sub)
+		sub.bus.Unlock()
+		close(sub.done)
+		sub.mutex.Lock()
+		close(sub.ch)
+		sub.mutex.Unlock()
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	b := New()
+	all := b.Subscribe(10, DropNewest)
+	txs := b.Subscribe(1, DropNewest, TxResolved)
+	old := b.Subscribe(1, DropOldest, TxResolved)
+	block := b.Subscribe(0, Block, LedgerAccepted)
+
+	b.Publish(&Event{Type: TxResolved, Peer: "1"})
+	b.Publish(&Event{Type: TxResolved, Peer: "2"})
+	b.Publish(&Event{Type: PeerConnected, Peer: "3"})
+	if len(all.C) != 3 {
+		t.Error("should receive all events", len(all.C))
+	}
+	if e := <-txs.C; e.Peer != "1" || txs.Dropped() != 1 || len(txs.C) != 0 {
+		t.Error("newest event should be dropped", e)
+	}
+	if e := <-old.C; e.Peer != "2" || old.Dropped() != 1 {
+		t.Error("oldest event should be dropped", e)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.Publish(&Event{Type: LedgerAccepted})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("should be blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-block.C
+	<-done
+
+	done = make(chan struct{})
+	go func() {
+		b.Publish(&Event{Type: LedgerAccepted})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	block.Unsubscribe()
+	<-done
+	block.Unsubscribe()
+	if _, ok := <-block.C; ok {
+		t.Error("should be closed")
+	}
+	b.Publish(&Event{Type: LedgerAccepted})
+}
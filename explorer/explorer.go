@@ -29,6 +29,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/AidosKuneen/aklib"
@@ -36,6 +37,7 @@ import (
 	"github.com/AidosKuneen/aklib/rpc"
 	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/node"
@@ -56,6 +58,29 @@ const (
 
 var tmpl = template.New("")
 
+//latest is the latest ledger, which is updated by events.
+var latest struct {
+	ledger *consensus.Ledger
+	sync.RWMutex
+}
+
+//server is the running server, which is stopped by Shutdown.
+var server struct {
+	*http.Server
+	sync.Mutex
+}
+
+//Shutdown stops accepting requests and waits for running requests until ctx is done.
+func Shutdown(ctx context.Context) error {
+	server.Lock()
+	s := server.Server
+	server.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Shutdown(ctx)
+}
+
 //Run runs explorer server.
 func Run(ctx context.Context, setting *setting.Setting) {
 	funcMap := template.FuncMap{
@@ -112,6 +137,10 @@ func Run(ctx context.Context, setting *setting.Setting) {
 		ReadHeaderTimeout: time.Minute,
 		MaxHeaderBytes:    1 << 20,
 	}
+	server.Lock()
+	server.Server = s
+	server.Unlock()
+	goLatest(ctx)
 	fmt.Println("Starting Explorer Server on", ipport)
 	go func() {
 		log.Println(s.ListenAndServe())
@@ -126,6 +155,35 @@ func Run(ctx context.Context, setting *setting.Setting) {
 	}()
 }
 
+//goLatest keeps the latest ledger up to date by LedgerAccepted events.
+func goLatest(ctx context.Context) {
+	sub := event.Default().Subscribe(1, event.DropOldest, event.LedgerAccepted)
+	latest.Lock()
+	latest.ledger = akconsensus.LatestLedger()
+	latest.Unlock()
+	go func() {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case <-ctx2.Done():
+				return
+			case e := <-sub.C:
+				latest.Lock()
+				latest.ledger = e.Ledger
+				latest.Unlock()
+			}
+		}
+	}()
+}
+
+func latestLedger() *consensus.Ledger {
+	latest.RLock()
+	defer latest.RUnlock()
+	return latest.ledger
+}
+
 func setupHandler(setting *setting.Setting, ipport string, mux *http.ServeMux) {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		indexHandle(setting, w, r)
@@ -220,7 +278,7 @@ func indexHandle(s *setting.Setting, w http.ResponseWriter, r *http.Request) {
 			Time: tr.Received,
 		})
 	}
-	for i, l := 0, akconsensus.LatestLedger(); i < 5; i++ {
+	for i, l := 0, latestLedger(); i < 5; i++ {
 		id := l.ID()
 		var h consensus.TxID
 		for h = range l.Txs {
@@ -62,7 +62,8 @@ func setup(t *testing.T) context.CancelFunc {
 	}
 
 	s.Config = aklib.DebugConfig
-	s.MaxConnections = 1
+	s.MaxInbound = 2
+	s.MaxOutbound = 1
 	s.Bind = "127.0.0.1"
 	s.Port = 9624
 	s.MyHostPort = ":9624"
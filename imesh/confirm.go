@@ -247,8 +247,13 @@ func confirm(s *setting.Setting, txn *badger.Txn, rejectTxs map[[32]byte]struct{
 
 //Confirm txs from h.
 func Confirm(s *setting.Setting, h tx.Hash, no [32]byte) ([]tx.Hash, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	return std.Confirm(s, h, no)
+}
+
+//Confirm txs from h.
+func (m *Mesh) Confirm(s *setting.Setting, h tx.Hash, no [32]byte) ([]tx.Hash, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	var hs []tx.Hash
 	visited := make(map[[32]byte]struct{})
 	_, conflicts, err := checkConflict(s, h, visited)
@@ -265,8 +270,13 @@ func Confirm(s *setting.Setting, h tx.Hash, no [32]byte) ([]tx.Hash, error) {
 
 //RevertConfirmation reverts confirmation from h.
 func RevertConfirmation(s *setting.Setting, h tx.Hash, no StatNo) ([]tx.Hash, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	return std.RevertConfirmation(s, h, no)
+}
+
+//RevertConfirmation reverts confirmation from h.
+func (m *Mesh) RevertConfirmation(s *setting.Setting, h tx.Hash, no StatNo) ([]tx.Hash, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	var hs []tx.Hash
 	err := s.DB.Update(func(txn *badger.Txn) error {
 		var err2 error
@@ -31,23 +31,43 @@ import (
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/rand"
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
 	"github.com/dgraph-io/badger"
 )
 
-var mutex sync.RWMutex
+//Mesh is an iMesh of a node, i.e. its txs in DB with the unresolved txs
+//and leaves in memory.
+type Mesh struct {
+	s      *setting.Setting
+	leaves *leaves.Leaves
+	mutex  sync.RWMutex
+	//should be locked my mutex above
+	txno struct {
+		TxNo uint64
+	}
+	latestTxs struct {
+		txs []*TxInfo
+		sync.RWMutex
+	}
+	unresolved unresolvedInfo
+}
+
+//std is the default Mesh for package functions.
+var std = newMesh(leaves.Default())
 
-//should be locked my mutex above
-var txno = struct {
-	TxNo uint64
-}{}
+func newMesh(l *leaves.Leaves) *Mesh {
+	m := &Mesh{
+		leaves: l,
+	}
+	m.latestTxs.txs = make([]*TxInfo, 0, 5)
+	return m
+}
 
-var latestTxs = struct {
-	txs []*TxInfo
-	sync.RWMutex
-}{
-	txs: make([]*TxInfo, 0, 5),
+//Default returns the default Mesh used by package functions.
+func Default() *Mesh {
+	return std
 }
 
 //StatNo is a stutus for each tx(confirmed or not)
@@ -97,11 +117,11 @@ func (ti *TxInfo) sigKey() []byte {
 	return key[:5]
 }
 
-func (ti *TxInfo) nextTxNo(txn *badger.Txn) error {
-	if err := updateTxNo(txn); err != nil {
+func (m *Mesh) nextTxNo(txn *badger.Txn, ti *TxInfo) error {
+	if err := m.updateTxNo(txn); err != nil {
 		return err
 	}
-	ti.TxNo = txno.TxNo
+	ti.TxNo = m.txno.TxNo
 	return nil
 }
 
@@ -148,8 +168,8 @@ func (ti *TxInfo) put(akdb *badger.DB) error {
 
 //Put put the tx into db. It should be used only by akwallet.
 func (ti *TxInfo) Put(akdb *badger.DB) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
 	return ti.put(akdb)
 }
 
@@ -203,8 +223,14 @@ func GetTx(akdb *badger.DB, hash []byte) (*tx.Transaction, error) {
 //PutRawTxDirect puts a transaction  into db without checking tx relation..
 //It should be used only from wallet
 func PutRawTxDirect(s *aklib.DBConfig, tr *tx.Transaction) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	return std.PutRawTxDirect(s, tr)
+}
+
+//PutRawTxDirect puts a transaction  into db without checking tx relation..
+//It should be used only from wallet
+func (m *Mesh) PutRawTxDirect(s *aklib.DBConfig, tr *tx.Transaction) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	ti := TxInfo{
 		Hash:     tr.Hash(),
 		Body:     tr.Body,
@@ -216,7 +242,7 @@ func PutRawTxDirect(s *aklib.DBConfig, tr *tx.Transaction) error {
 		ti.OutputStatus[tx.TypeTicketin] = make([]OutputStatus, 1)
 	}
 	return s.DB.Update(func(txn *badger.Txn) error {
-		if err := ti.nextTxNo(txn); err != nil {
+		if err := m.nextTxNo(txn, &ti); err != nil {
 			return err
 		}
 		if err2 := db.Put(txn, tr.Hash(), &ti, db.HeaderTxInfo); err2 != nil {
@@ -230,7 +256,7 @@ func PutRawTxDirect(s *aklib.DBConfig, tr *tx.Transaction) error {
 }
 
 //called synchonously from resolve
-func putTxSub(s *setting.Setting, tr *tx.Transaction) error {
+func (m *Mesh) putTxSub(s *setting.Setting, tr *tx.Transaction) error {
 
 	ti := TxInfo{
 		Hash:     tr.Hash(),
@@ -244,7 +270,7 @@ func putTxSub(s *setting.Setting, tr *tx.Transaction) error {
 	}
 
 	return s.DB.Update(func(txn *badger.Txn) error {
-		if err := ti.nextTxNo(txn); err != nil {
+		if err := m.nextTxNo(txn, &ti); err != nil {
 			return err
 		}
 		if err2 := db.Put(txn, tr.Hash(), &ti, db.HeaderTxInfo); err2 != nil {
@@ -273,24 +299,24 @@ func putTxSub(s *setting.Setting, tr *tx.Transaction) error {
 		if err := updateMulsigAddress(s.Config, txn, tr); err != nil {
 			return err
 		}
-		latestTxs.Lock()
-		if len(latestTxs.txs) >= 5 {
-			copy(latestTxs.txs, latestTxs.txs[1:])
-			latestTxs.txs[len(latestTxs.txs)-1] = nil
-			latestTxs.txs = latestTxs.txs[:len(latestTxs.txs)-1]
+		m.latestTxs.Lock()
+		if len(m.latestTxs.txs) >= 5 {
+			copy(m.latestTxs.txs, m.latestTxs.txs[1:])
+			m.latestTxs.txs[len(m.latestTxs.txs)-1] = nil
+			m.latestTxs.txs = m.latestTxs.txs[:len(m.latestTxs.txs)-1]
 		}
-		latestTxs.txs = append(latestTxs.txs, &ti)
-		latestTxs.Unlock()
+		m.latestTxs.txs = append(m.latestTxs.txs, &ti)
+		m.latestTxs.Unlock()
 		return db.Put(txn, ti.sigKey(), tr.Signatures, db.HeaderTxSig)
 	})
 }
 
 //PutTx puts a transaction  into db.
-func putTx(s *setting.Setting, tr *tx.Transaction) error {
+func (m *Mesh) putTx(s *setting.Setting, tr *tx.Transaction) error {
 	if err := tr.Check(s.Config, tx.TypeNormal); err != nil {
 		return err
 	}
-	return putTxSub(s, tr)
+	return m.putTxSub(s, tr)
 }
 
 //locked by mutex(unresolved)
@@ -496,27 +522,37 @@ func isBrokenTx(s *setting.Setting, h []byte) (bool, error) {
 }
 
 //locked by mutex
-func updateTxNo(txn *badger.Txn) error {
-	txno.TxNo++
-	return db.Put(txn, nil, &txno.TxNo, db.HeaderTxNo)
+func (m *Mesh) updateTxNo(txn *badger.Txn) error {
+	m.txno.TxNo++
+	return db.Put(txn, nil, &m.txno.TxNo, db.HeaderTxNo)
 }
 
-func getTxNo(s *setting.Setting) error {
+func (m *Mesh) getTxNo(s *setting.Setting) error {
 	return s.DB.View(func(txn *badger.Txn) error {
-		return db.Get(txn, nil, &txno.TxNo, db.HeaderTxNo)
+		return db.Get(txn, nil, &m.txno.TxNo, db.HeaderTxNo)
 	})
 }
 
 //GetTxNo returns a total number of txs in imesh.
 func GetTxNo() uint64 {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	return txno.TxNo
+	return std.GetTxNo()
+}
+
+//GetTxNo returns a total number of txs in imesh.
+func (m *Mesh) GetTxNo() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.txno.TxNo
 }
 
 //LatestTxs returns 5 latest transactions received.
 func LatestTxs() []*TxInfo {
-	latestTxs.RLock()
-	defer latestTxs.RUnlock()
-	return latestTxs.txs
+	return std.LatestTxs()
+}
+
+//LatestTxs returns 5 latest transactions received.
+func (m *Mesh) LatestTxs() []*TxInfo {
+	m.latestTxs.RLock()
+	defer m.latestTxs.RUnlock()
+	return m.latestTxs.txs
 }
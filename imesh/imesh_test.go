@@ -442,11 +442,11 @@ func TestImesh3(t *testing.T) {
 	if !bytes.Equal(ne[0].Hash, one[:]) {
 		t.Error("invalid searching tx")
 	}
-	if unresolved.Noexists[one].Count != 1 {
+	if std.unresolved.Noexists[one].Count != 1 {
 		t.Error("invalid count")
 	}
 	for i := 0; i < 10; i++ {
-		unresolved.Noexists[one].Searched = time.Now().Add(-24 * time.Hour)
+		std.unresolved.Noexists[one].Searched = time.Now().Add(-24 * time.Hour)
 		ne, err2 = GetSearchingTx(&s)
 		if err2 != nil {
 			t.Error(err2)
@@ -455,7 +455,7 @@ func TestImesh3(t *testing.T) {
 			t.Error("invalid searching tx", len(ne), i)
 		}
 	}
-	if _, e := unresolved.Noexists[one]; e {
+	if _, e := std.unresolved.Noexists[one]; e {
 		t.Error("should be removed")
 	}
 	broken, err2 := isBrokenTx(&s, one[:])
@@ -576,3 +576,158 @@ func TestImesh4(t *testing.T) {
 		t.Error("should be equal")
 	}
 }
+
+func TestPool(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+	mn, mt, mb := maxNoexists, maxUnresolvedTxs, maxUnresolvedBytes
+	defer func() {
+		maxNoexists, maxUnresolvedTxs, maxUnresolvedBytes = mn, mt, mb
+	}()
+	maxNoexists = 16
+	maxUnresolvedTxs = 16
+	maxUnresolvedBytes = 1 << 20
+
+	m := newMesh(leaves.Default())
+	m.unresolved.Txs = make(map[[32]byte]*unresolvedTx)
+	m.unresolved.Noexists = make(map[[32]byte]*Noexist)
+	m.unresolved.failed = make(map[string]int)
+	hash := func(i int) tx.Hash {
+		var h [32]byte
+		h[0], h[1] = byte(i), byte(i>>8)
+		return h[:]
+	}
+	for i := 0; i < 4; i++ {
+		if err := m.AddNoexistTxHashFrom(&s, hash(i), tx.TypeNormal, ""); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 4; i < 6; i++ {
+		if err := m.AddNoexistTxHashFrom(&s, hash(i), tx.TypeNormal, "honest"); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 6; i < 100; i++ {
+		if err := m.AddNoexistTxHashFrom(&s, hash(i), tx.TypeNormal, "flooder"); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(m.unresolved.Noexists) > maxNoexists {
+		t.Error("pool should be bounded", len(m.unresolved.Noexists))
+	}
+	for i := 0; i < 6; i++ {
+		if _, ok := m.unresolved.Noexists[hash(i).Array()]; !ok {
+			t.Error("local and honest entries should not be evicted", i)
+		}
+	}
+	for i := 100; i < 106; i++ {
+		if err := m.AddNoexistTxHashFrom(&s, hash(i), tx.TypeNormal, ""); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := m.AddNoexistTxHashFrom(&s, hash(200), tx.TypeNormal, "honest"); err != nil {
+		t.Error(err)
+	}
+	for _, i := range []int{4, 5, 200} {
+		if _, ok := m.unresolved.Noexists[hash(i).Array()]; !ok {
+			t.Error("entries of the flooder should be evicted first", i)
+		}
+	}
+	if len(m.unresolved.Noexists) > maxNoexists {
+		t.Error("pool should be bounded", len(m.unresolved.Noexists))
+	}
+	if f := m.Unresolvable(); f["flooder"] == 0 || len(f) != 1 {
+		t.Error("evicted entries of the flooder should be failures", f)
+	}
+
+	n := &Noexist{
+		HashWithType: &tx.HashWithType{Hash: hash(300), Type: tx.TypeNormal},
+		Count:        10,
+		Searched:     time.Now().Add(-24 * time.Hour),
+		Peer:         "liar",
+	}
+	m.unresolved.Noexists[hash(300).Array()] = n
+	if _, err := m.GetSearchingTx(&s); err != nil {
+		t.Error(err)
+	}
+	if f := m.Unresolvable(); f["liar"] != 1 || len(f) != 1 {
+		t.Error("invalid unresolvable peers", f)
+	}
+	if f := m.Unresolvable(); len(f) != 0 {
+		t.Error("should be reset", f)
+	}
+
+	for i := 0; i < maxUnresolvedTxs; i++ {
+		m.unresolved.Txs[hash(i).Array()] = &unresolvedTx{
+			Peer:  "flooder",
+			Added: time.Now(),
+			size:  10,
+		}
+		m.unresolved.size += 10
+	}
+	if err := m.makeRoomTx(&s, 10, "honest"); err != nil {
+		t.Error(err)
+	}
+	if len(m.unresolved.Txs) >= maxUnresolvedTxs || m.unresolved.size != 10*len(m.unresolved.Txs) {
+		t.Error("txs from peers should be evicted", len(m.unresolved.Txs), m.unresolved.size)
+	}
+	if f := m.Unresolvable(); f["flooder"] == 0 || len(f) != 1 {
+		t.Error("evicted txs of the flooder should be failures", f)
+	}
+	for h, u := range m.unresolved.Txs {
+		u.Peer = ""
+		m.unresolved.Txs[h] = u
+	}
+	if err := m.makeRoomTx(&s, maxUnresolvedBytes, "honest"); err != ErrPoolFull {
+		t.Error("should be full", err)
+	}
+	if err := m.makeRoomTx(&s, maxUnresolvedBytes, ""); err != nil {
+		t.Error("local txs should be added", err)
+	}
+
+	m.unresolved.Txs = make(map[[32]byte]*unresolvedTx)
+	m.unresolved.Noexists = make(map[[32]byte]*Noexist)
+	m.unresolved.size = 0
+	for i := 0; i < maxNoexists; i++ {
+		if err := m.AddNoexistTxHashFrom(&s, hash(i), tx.TypeNormal, ""); err != nil {
+			t.Error(err)
+		}
+	}
+	m.unresolved.Txs[hash(500).Array()] = &unresolvedTx{
+		prevs: []tx.Hash{hash(501)},
+		Type:  tx.TypeNormal,
+		Peer:  "honest",
+		Added: time.Now(),
+		size:  10,
+	}
+	m.unresolved.Txs[hash(502).Array()] = &unresolvedTx{
+		prevs: []tx.Hash{hash(503)},
+		Type:  tx.TypeNormal,
+		Peer:  "stale",
+		Added: time.Now().Add(-unresolvedExpiry - time.Minute),
+		size:  10,
+	}
+	m.unresolved.size = 20
+	if _, err := m.Resolve(&s); err != nil {
+		t.Error(err)
+	}
+	if _, ok := m.unresolved.Noexists[hash(501).Array()]; ok {
+		t.Error("parent should not be added to the full pool")
+	}
+	if _, ok := m.unresolved.Txs[hash(500).Array()]; !ok {
+		t.Error("tx should stay unresolved while the pool is full")
+	}
+	if _, ok := m.unresolved.Txs[hash(502).Array()]; ok {
+		t.Error("expired tx should be dropped")
+	}
+	if f := m.Unresolvable(); f["stale"] != 1 || len(f) != 1 {
+		t.Error("expired tx should be a failure", f)
+	}
+	delete(m.unresolved.Noexists, hash(0).Array())
+	if _, err := m.Resolve(&s); err != nil {
+		t.Error(err)
+	}
+	if _, ok := m.unresolved.Noexists[hash(501).Array()]; !ok {
+		t.Error("parent should be searched after room is made")
+	}
+}
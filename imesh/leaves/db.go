@@ -38,17 +38,35 @@ type leaf struct {
 	Confirmed bool
 }
 
-//leaves represents leaves in iMesh.
-var leaves = struct {
+//Leaves represents leaves in iMesh of a node.
+type Leaves struct {
 	leaves []*leaf
 	sync.RWMutex
-}{}
+}
 
-//Init loads leaves from DB.
-func Init(s *setting.Setting) error {
-	leaves.leaves = nil
+//leaves is the default Leaves for package functions.
+var leaves = &Leaves{}
+
+//New loads leaves from DB of s.
+func New(s *setting.Setting) (*Leaves, error) {
+	l := &Leaves{}
+	if err := l.load(s); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//Default returns the default Leaves used by package functions.
+func Default() *Leaves {
+	return leaves
+}
+
+func (l *Leaves) load(s *setting.Setting) error {
+	l.Lock()
+	defer l.Unlock()
+	l.leaves = nil
 	err := s.DB.View(func(txn *badger.Txn) error {
-		return db.Get(txn, nil, &leaves.leaves, db.HeaderLeaves)
+		return db.Get(txn, nil, &l.leaves, db.HeaderLeaves)
 	})
 	if err != nil && err != badger.ErrKeyNotFound {
 		return err
@@ -56,33 +74,48 @@ func Init(s *setting.Setting) error {
 	return nil
 }
 
+//Init loads leaves from DB into the default Leaves.
+func Init(s *setting.Setting) error {
+	return leaves.load(s)
+}
+
 //Size return # of leave
 func Size() int {
-	leaves.RLock()
-	defer leaves.RUnlock()
-	return len(leaves.leaves)
+	return leaves.Size()
+}
+
+//Size return # of leave
+func (l *Leaves) Size() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.leaves)
 }
 
 //SetConfirmed set leaves whose hash is h to be confirmed.
 func SetConfirmed(s *setting.Setting, h tx.Hash) error {
-	leaves.Lock()
-	defer leaves.Unlock()
-	for _, l := range leaves.leaves {
-		if bytes.Equal(l.Hash, h) {
-			l.Confirmed = true
+	return leaves.SetConfirmed(s, h)
+}
+
+//SetConfirmed set leaves whose hash is h to be confirmed.
+func (l *Leaves) SetConfirmed(s *setting.Setting, h tx.Hash) error {
+	l.Lock()
+	defer l.Unlock()
+	for _, lf := range l.leaves {
+		if bytes.Equal(lf.Hash, h) {
+			lf.Confirmed = true
 		}
 	}
-	return put(s)
+	return l.put(s)
 }
 
-func gethash() ([]tx.Hash, []tx.Hash) {
-	ncs := make([]tx.Hash, 0, len(leaves.leaves))
-	cs := make([]tx.Hash, 0, len(leaves.leaves))
-	for _, l := range leaves.leaves {
-		if !l.Confirmed {
-			ncs = append(ncs, l.Hash)
+func (l *Leaves) gethash() ([]tx.Hash, []tx.Hash) {
+	ncs := make([]tx.Hash, 0, len(l.leaves))
+	cs := make([]tx.Hash, 0, len(l.leaves))
+	for _, lf := range l.leaves {
+		if !lf.Confirmed {
+			ncs = append(ncs, lf.Hash)
 		} else {
-			cs = append(cs, l.Hash)
+			cs = append(cs, lf.Hash)
 		}
 	}
 	return ncs, cs
@@ -91,9 +124,15 @@ func gethash() ([]tx.Hash, []tx.Hash) {
 //Get gets n random leaves. if <=0, it returns all leaves.
 //Unconfirmed txs are prior to confirmed ones.
 func Get(n int) []tx.Hash {
-	leaves.RLock()
-	defer leaves.RUnlock()
-	ncs, cs := gethash()
+	return leaves.Get(n)
+}
+
+//Get gets n random leaves. if <=0, it returns all leaves.
+//Unconfirmed txs are prior to confirmed ones.
+func (l *Leaves) Get(n int) []tx.Hash {
+	l.RLock()
+	defer l.RUnlock()
+	ncs, cs := l.gethash()
 
 	for i := len(ncs) - 1; i >= 0; i-- {
 		j := rand.R.Intn(i + 1)
@@ -114,9 +153,14 @@ func Get(n int) []tx.Hash {
 
 //GetAllUnconfirmed gets all unconfirmed leaves after sorting.
 func GetAllUnconfirmed() []tx.Hash {
-	leaves.RLock()
-	defer leaves.RUnlock()
-	ncs, _ := gethash()
+	return leaves.GetAllUnconfirmed()
+}
+
+//GetAllUnconfirmed gets all unconfirmed leaves after sorting.
+func (l *Leaves) GetAllUnconfirmed() []tx.Hash {
+	l.RLock()
+	defer l.RUnlock()
+	ncs, _ := l.gethash()
 	sort.Slice(ncs, func(i, j int) bool {
 		return bytes.Compare(ncs[i], ncs[j]) < 0
 	})
@@ -125,9 +169,14 @@ func GetAllUnconfirmed() []tx.Hash {
 
 //GetAll gets all leaves after sorting.
 func GetAll() []tx.Hash {
-	leaves.RLock()
-	defer leaves.RUnlock()
-	ncs, cs := gethash()
+	return leaves.GetAll()
+}
+
+//GetAll gets all leaves after sorting.
+func (l *Leaves) GetAll() []tx.Hash {
+	l.RLock()
+	defer l.RUnlock()
+	ncs, cs := l.gethash()
 	ncs = append(ncs, cs...)
 	sort.Slice(ncs, func(i, j int) bool {
 		return bytes.Compare(ncs[i], ncs[j]) < 0
@@ -142,21 +191,26 @@ type txsearch struct {
 
 //CheckAdd checks trs and leaves if these are leaves and add them.
 func CheckAdd(s *setting.Setting, f func() error, trs ...*tx.Transaction) error {
-	leaves.Lock()
-	defer leaves.Unlock()
-	txs := isVisited(trs)
-	leaves.leaves = leaves.leaves[:0]
+	return leaves.CheckAdd(s, f, trs...)
+}
+
+//CheckAdd checks trs and leaves if these are leaves and add them.
+func (l *Leaves) CheckAdd(s *setting.Setting, f func() error, trs ...*tx.Transaction) error {
+	l.Lock()
+	defer l.Unlock()
+	txs := l.isVisited(trs)
+	l.leaves = l.leaves[:0]
 	//h is reused (i.e. always same object) in for loop, so need to clone it.
 	for h, tr := range txs {
 		if !tr.visited {
 			hh := make(tx.Hash, 32)
 			copy(hh, h[:])
-			leaves.leaves = append(leaves.leaves, &leaf{
+			l.leaves = append(l.leaves, &leaf{
 				Hash: hh,
 			})
 		}
 	}
-	if err := put(s); err != nil {
+	if err := l.put(s); err != nil {
 		return err
 	}
 	if f != nil {
@@ -165,21 +219,33 @@ func CheckAdd(s *setting.Setting, f func() error, trs ...*tx.Transaction) error
 	return nil
 }
 
-func put(s *setting.Setting) error {
+//Save saves leaves to DB.
+func Save(s *setting.Setting) error {
+	return leaves.Save(s)
+}
+
+//Save saves leaves to DB.
+func (l *Leaves) Save(s *setting.Setting) error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.put(s)
+}
+
+func (l *Leaves) put(s *setting.Setting) error {
 	return s.DB.Update(func(txn *badger.Txn) error {
-		return db.Put(txn, nil, leaves.leaves, db.HeaderLeaves)
+		return db.Put(txn, nil, l.leaves, db.HeaderLeaves)
 	})
 }
 
-func isVisited(trs []*tx.Transaction) map[[32]byte]*txsearch {
+func (l *Leaves) isVisited(trs []*tx.Transaction) map[[32]byte]*txsearch {
 	txs := make(map[[32]byte]*txsearch)
 	for _, tr := range trs {
 		txs[tr.Hash().Array()] = &txsearch{
 			Transaction: tr,
 		}
 	}
-	for _, l := range leaves.leaves {
-		txs[l.Hash.Array()] = &txsearch{}
+	for _, lf := range l.leaves {
+		txs[lf.Hash.Array()] = &txsearch{}
 	}
 	for _, tr := range trs {
 		for _, prev := range tr.Parent {
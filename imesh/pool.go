@@ -0,0 +1,186 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package imesh
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//Limits of the unresolved pool. Variables for tests.
+var (
+	maxNoexists        = 100000
+	maxUnresolvedTxs   = 50000
+	maxUnresolvedBytes = 128 * 1024 * 1024
+	//maxPeerShare is the max share of the pool for a peer, 1/maxPeerShare.
+	maxPeerShare = 8
+	//evictRatio is the ratio of entries evicted at once when the pool is full, 1/evictRatio.
+	evictRatio = 10
+	//unresolvedExpiry is the duration after which unresolved txs from peers are dropped.
+	unresolvedExpiry = 6 * time.Hour
+)
+
+//ErrPoolFull represents an error that the unresolved pool is full
+//with entries which are not evictable.
+var ErrPoolFull = errors.New("unresolved pool is full")
+
+//poolEntry is an entry from a peer in the unresolved pool for eviction.
+type poolEntry struct {
+	hash  [32]byte
+	peer  string
+	added time.Time
+	size  int
+}
+
+//evictionOrder sorts es in order of eviction; entries of peers which have more than
+//their share of the pool come first, then older ones.
+//It returns numbers of entries by peers.
+func evictionOrder(es []*poolEntry, share int) map[string]int {
+	count := make(map[string]int)
+	for _, e := range es {
+		count[e.peer]++
+	}
+	sort.Slice(es, func(i, j int) bool {
+		oi, oj := count[es[i].peer] > share, count[es[j].peer] > share
+		if oi != oj {
+			return oi
+		}
+		return es[i].added.Before(es[j].added)
+	})
+	return count
+}
+
+//addNoexist adds h announced by peer to Noexists, evicting announcements
+//from peers if full.
+//locked by mutex(unresolved)
+func (m *Mesh) addNoexist(h tx.Hash, typ tx.Type, peer string) error {
+	if len(m.unresolved.Noexists) >= maxNoexists {
+		m.evictNoexists()
+		if len(m.unresolved.Noexists) >= maxNoexists && peer != "" {
+			return ErrPoolFull
+		}
+	}
+	m.unresolved.Noexists[h.Array()] = &Noexist{
+		HashWithType: &tx.HashWithType{
+			Hash: h,
+			Type: typ,
+		},
+		Peer:  peer,
+		Added: time.Now(),
+	}
+	return nil
+}
+
+//evictNoexists removes 1/evictRatio of Noexists from peers.
+//Evicted ones from peers over their share are counted as failures of the peers.
+//locked by mutex(unresolved)
+func (m *Mesh) evictNoexists() {
+	es := make([]*poolEntry, 0, len(m.unresolved.Noexists))
+	for h, n := range m.unresolved.Noexists {
+		if n.Peer == "" {
+			continue
+		}
+		es = append(es, &poolEntry{
+			hash:  h,
+			peer:  n.Peer,
+			added: n.Added,
+		})
+	}
+	share := maxNoexists / maxPeerShare
+	count := evictionOrder(es, share)
+	for i := 0; i < len(es) && i < maxNoexists/evictRatio+1; i++ {
+		delete(m.unresolved.Noexists, es[i].hash)
+		if count[es[i].peer] > share {
+			m.unresolved.failed[es[i].peer]++
+		}
+	}
+}
+
+//makeRoomTx evicts unresolved txs from peers so that a tx whose size is size
+//can be added. It returns ErrPoolFull if no room is made for a tx from peer.
+//Evicted ones from peers over their share are counted as failures of the peers.
+//locked by mutex(unresolved)
+func (m *Mesh) makeRoomTx(s *setting.Setting, size int, peer string) error {
+	full := func() bool {
+		return len(m.unresolved.Txs)+1 > maxUnresolvedTxs ||
+			m.unresolved.size+size > maxUnresolvedBytes
+	}
+	if !full() {
+		return nil
+	}
+	es := make([]*poolEntry, 0, len(m.unresolved.Txs))
+	for h, u := range m.unresolved.Txs {
+		if u.Peer == "" {
+			continue
+		}
+		es = append(es, &poolEntry{
+			hash:  h,
+			peer:  u.Peer,
+			added: u.Added,
+			size:  u.size,
+		})
+	}
+	share := maxUnresolvedTxs / maxPeerShare
+	count := evictionOrder(es, share)
+	for i := 0; i < len(es) && (full() || i < maxUnresolvedTxs/evictRatio); i++ {
+		if err := m.dropTx(s, es[i].hash); err != nil {
+			return err
+		}
+		if count[es[i].peer] > share {
+			m.unresolved.failed[es[i].peer]++
+		}
+	}
+	if full() && peer != "" {
+		return ErrPoolFull
+	}
+	return nil
+}
+
+//dropTx removes the unresolved tx h from the pool.
+//locked by mutex(unresolved)
+func (m *Mesh) dropTx(s *setting.Setting, h [32]byte) error {
+	if err := deleteUnresolvedTx(s, h[:]); err != nil {
+		return err
+	}
+	m.unresolved.size -= m.unresolved.Txs[h].size
+	delete(m.unresolved.Txs, h)
+	return nil
+}
+
+//Unresolvable returns numbers of announcements which never resolved by peers
+//since the last call.
+func Unresolvable() map[string]int {
+	return std.Unresolvable()
+}
+
+//Unresolvable returns numbers of announcements and txs which were expired
+//or evicted without being resolved, by peers since the last call.
+func (m *Mesh) Unresolvable() map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r := m.unresolved.failed
+	m.unresolved.failed = make(map[string]int)
+	return r
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/AidosKuneen/aklib"
 
+	"github.com/AidosKuneen/aklib/arypack"
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
@@ -38,6 +39,9 @@ import (
 type unresolvedTx struct {
 	prevs      []tx.Hash
 	Type       tx.Type
+	Peer       string //peer which sent the tx, empty if local
+	Added      time.Time
+	size       int
 	unresolved bool
 	visited    bool
 	broken     bool
@@ -48,21 +52,48 @@ type Noexist struct {
 	*tx.HashWithType
 	Count    byte
 	Searched time.Time
+	Peer     string //peer which announced the tx, empty if local
+	Added    time.Time
 }
 
-var unresolved = struct {
+type unresolvedInfo struct {
 	Txs      map[[32]byte]*unresolvedTx
 	Noexists map[[32]byte]*Noexist
-}{
-	Txs:      make(map[[32]byte]*unresolvedTx),
-	Noexists: make(map[[32]byte]*Noexist),
+	size     int            //bytes of Txs
+	failed   map[string]int //numbers of never resolved announcements and txs by peers
 }
 
-//Init initialize imesh db and unresolved txs.
+//New initialize imesh db of s and returns a Mesh with unresolved txs
+//and leaves in s.
+func New(s *setting.Setting) (*Mesh, error) {
+	l, err := leaves.New(s)
+	if err != nil {
+		return nil, err
+	}
+	m := newMesh(l)
+	if err := m.init(s); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//Init initialize imesh db, unresolved txs and leaves of the default Mesh.
 func Init(s *setting.Setting) error {
-	txno.TxNo = 0
-	unresolved.Txs = make(map[[32]byte]*unresolvedTx)
-	unresolved.Noexists = make(map[[32]byte]*Noexist)
+	if err := leaves.Init(s); err != nil {
+		return err
+	}
+	return std.init(s)
+}
+
+func (m *Mesh) init(s *setting.Setting) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.s = s
+	m.txno.TxNo = 0
+	m.unresolved.Txs = make(map[[32]byte]*unresolvedTx)
+	m.unresolved.Noexists = make(map[[32]byte]*Noexist)
+	m.unresolved.failed = make(map[string]int)
+	m.unresolved.size = 0
 
 	var total uint64
 	tr := tx.New(s.Config)
@@ -82,7 +113,7 @@ func Init(s *setting.Setting) error {
 		return err2
 	}
 	if !has {
-		if err := putTxSub(s, tr); err != nil {
+		if err := m.putTxSub(s, tr); err != nil {
 			return err
 		}
 		t, err := GetTxInfo(s.DB, tr.Hash())
@@ -93,20 +124,20 @@ func Init(s *setting.Setting) error {
 		if err := t.put(s.DB); err != nil {
 			return err
 		}
-		if err := leaves.CheckAdd(s, nil, tr); err != nil {
+		if err := m.leaves.CheckAdd(s, nil, tr); err != nil {
 			return err
 		}
-		if err := leaves.SetConfirmed(s, tr.Hash()); err != nil {
+		if err := m.leaves.SetConfirmed(s, tr.Hash()); err != nil {
 			return err
 		}
 	}
 	err2 = s.DB.View(func(txn *badger.Txn) error {
-		return db.Get(txn, nil, &unresolved, db.HeaderUnresolvedInfo)
+		return db.Get(txn, nil, &m.unresolved, db.HeaderUnresolvedInfo)
 	})
 	if err2 != nil && err2 != badger.ErrKeyNotFound {
 		return err2
 	}
-	for h, ut := range unresolved.Txs {
+	for h, ut := range m.unresolved.Txs {
 		t, err := getUnresolvedTx(s, h[:])
 		if err != nil {
 			return nil
@@ -114,26 +145,63 @@ func Init(s *setting.Setting) error {
 		tr := &unresolvedTx{
 			prevs: prevs(t),
 			Type:  ut.Type,
+			Peer:  ut.Peer,
+			Added: ut.Added,
+			size:  len(arypack.Marshal(t)),
 		}
 		if err := t.Check(s.Config, tr.Type); err != nil {
 			return err
 		}
-		unresolved.Txs[h] = tr
+		m.unresolved.Txs[h] = tr
+		m.unresolved.size += tr.size
 	}
-	return getTxNo(s)
+	return m.getTxNo(s)
+}
+
+//Leaves returns leaves of the Mesh.
+func (m *Mesh) Leaves() *leaves.Leaves {
+	return m.leaves
+}
+
+//Save saves unresolved txs and leaves of the default Mesh to DB.
+func Save(s *setting.Setting) error {
+	return std.Save(s)
+}
+
+//Save saves unresolved txs and leaves to DB.
+func (m *Mesh) Save(s *setting.Setting) error {
+	m.mutex.Lock()
+	err := m.put(s)
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.leaves.Save(s)
 }
 
 //locked by mutex (unresolved)
-func put(s *setting.Setting) error {
+func (m *Mesh) put(s *setting.Setting) error {
 	return s.DB.Update(func(txn *badger.Txn) error {
-		return db.Put(txn, nil, &unresolved, db.HeaderUnresolvedInfo)
+		return db.Put(txn, nil, &m.unresolved, db.HeaderUnresolvedInfo)
 	})
 }
 
 //AddNoexistTxHash adds a h as unresolved tx hash.
 func AddNoexistTxHash(s *setting.Setting, h tx.Hash, typ tx.Type) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	return std.AddNoexistTxHash(s, h, typ)
+}
+
+//AddNoexistTxHash adds a h as unresolved tx hash.
+func (m *Mesh) AddNoexistTxHash(s *setting.Setting, h tx.Hash, typ tx.Type) error {
+	return m.AddNoexistTxHashFrom(s, h, typ, "")
+}
+
+//AddNoexistTxHashFrom adds a h announced by peer as unresolved tx hash.
+//When the pool is full, announcements of peers are evicted, and
+//it returns ErrPoolFull if no room is made for one from a peer.
+func (m *Mesh) AddNoexistTxHashFrom(s *setting.Setting, h tx.Hash, typ tx.Type, peer string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	has, err := Has(s.DB, h)
 	if err != nil {
 		return err
@@ -141,28 +209,35 @@ func AddNoexistTxHash(s *setting.Setting, h tx.Hash, typ tx.Type) error {
 	if has {
 		return nil
 	}
-	if _, exist := unresolved.Noexists[h.Array()]; exist {
+	if _, exist := m.unresolved.Noexists[h.Array()]; exist {
 		return nil
 	}
-	unresolved.Noexists[h.Array()] = &Noexist{
-		HashWithType: &tx.HashWithType{
-			Hash: h,
-			Type: typ,
-		},
-	}
-	return nil
+	return m.addNoexist(h, typ, peer)
 }
 
 //CheckAddTx adds trs into imeash if they are already resolved.
 //If not adds to search cron.
 func CheckAddTx(s *setting.Setting, tr *tx.Transaction, typ tx.Type) error {
+	return std.CheckAddTx(s, tr, typ)
+}
+
+//CheckAddTx adds trs into imeash if they are already resolved.
+//If not adds to search cron.
+func (m *Mesh) CheckAddTx(s *setting.Setting, tr *tx.Transaction, typ tx.Type) error {
+	return m.CheckAddTxFrom(s, tr, typ, "")
+}
+
+//CheckAddTxFrom adds trs sent by peer into imeash if they are already resolved.
+//If not adds to search cron. When the pool is full, txs from peers are evicted,
+//and it returns ErrPoolFull if no room is made for one from a peer.
+func (m *Mesh) CheckAddTxFrom(s *setting.Setting, tr *tx.Transaction, typ tx.Type, peer string) error {
 	switch typ {
 	case tx.TypeNormal, tx.TypeRewardFee, tx.TypeRewardTicket:
 	default:
 		return errors.New("unknows type")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	has, err := Has(s.DB, tr.Hash())
 	if err != nil {
 		return err
@@ -184,23 +259,38 @@ func CheckAddTx(s *setting.Setting, tr *tx.Transaction, typ tx.Type) error {
 		}
 		return err
 	}
-	if err := putUnresolvedTx(s, tr); err != nil {
-		return err
+	if _, exist := m.unresolved.Txs[tr.Hash().Array()]; exist {
+		return nil
 	}
 	u := &unresolvedTx{
 		prevs: prevs(tr),
 		Type:  typ,
+		Peer:  peer,
+		Added: time.Now(),
+		size:  len(arypack.Marshal(tr)),
 	}
-	unresolved.Txs[tr.Hash().Array()] = u
-	return put(s)
+	if err := m.makeRoomTx(s, u.size, peer); err != nil {
+		return err
+	}
+	if err := putUnresolvedTx(s, tr); err != nil {
+		return err
+	}
+	m.unresolved.Txs[tr.Hash().Array()] = u
+	m.unresolved.size += u.size
+	return m.put(s)
 }
 
 //GetSearchingTx returns txs which are need to be searched.
 func GetSearchingTx(s *setting.Setting) ([]Noexist, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	r := make([]Noexist, 0, len(unresolved.Noexists))
-	for h, n := range unresolved.Noexists {
+	return std.GetSearchingTx(s)
+}
+
+//GetSearchingTx returns txs which are need to be searched.
+func (m *Mesh) GetSearchingTx(s *setting.Setting) ([]Noexist, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r := make([]Noexist, 0, len(m.unresolved.Noexists))
+	for h, n := range m.unresolved.Noexists {
 		sleep := (1 << (n.Count - 1)) * time.Minute
 		if !n.Searched.IsZero() && !n.Searched.Add(sleep).Before(time.Now()) {
 			continue
@@ -211,28 +301,63 @@ func GetSearchingTx(s *setting.Setting) ([]Noexist, error) {
 			if err := putBrokenTx(s, n.Hash); err != nil {
 				return nil, err
 			}
-			delete(unresolved.Noexists, h)
+			delete(m.unresolved.Noexists, h)
+			if n.Peer != "" {
+				m.unresolved.failed[n.Peer]++
+			}
 		}
 	}
-	return r, put(s)
+	return r, m.put(s)
+}
+
+//Missing returns txs which are referred but not found yet,
+//and a number of received txs which are waiting for them.
+func Missing() ([]*tx.HashWithType, int) {
+	return std.Missing()
+}
+
+//Missing returns txs which are referred but not found yet,
+//and a number of received txs which are waiting for them.
+func (m *Mesh) Missing() ([]*tx.HashWithType, int) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	r := make([]*tx.HashWithType, 0, len(m.unresolved.Noexists))
+	for _, n := range m.unresolved.Noexists {
+		r = append(r, n.HashWithType)
+	}
+	return r, len(m.unresolved.Txs)
 }
 
 //Resolve checks all reference of unresolvev txs
 //and add to imesh if all are resolved.
 func Resolve(s *setting.Setting) ([]*tx.HashWithType, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	if err := isResolved(s); err != nil {
+	return std.Resolve(s)
+}
+
+//Resolve checks all reference of unresolvev txs
+//and add to imesh if all are resolved.
+func (m *Mesh) Resolve(s *setting.Setting) ([]*tx.HashWithType, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.isResolved(s); err != nil {
 		return nil, err
 	}
 	var trs []*tx.HashWithType
-	for hs, tr := range unresolved.Txs {
+	for hs, tr := range m.unresolved.Txs {
+		if !tr.broken && tr.unresolved && tr.Peer != "" && time.Since(tr.Added) > unresolvedExpiry {
+			if err := m.dropTx(s, hs); err != nil {
+				return nil, err
+			}
+			m.unresolved.failed[tr.Peer]++
+			continue
+		}
 		if !tr.broken && tr.unresolved {
 			tr.visited = false
 			tr.unresolved = false
 			continue
 		}
-		delete(unresolved.Txs, hs)
+		delete(m.unresolved.Txs, hs)
+		m.unresolved.size -= tr.size
 		if tr.broken {
 			continue
 		}
@@ -243,18 +368,18 @@ func Resolve(s *setting.Setting) ([]*tx.HashWithType, error) {
 			Type: tr.Type,
 		})
 	}
-	return trs, put(s)
+	return trs, m.put(s)
 }
 
-func isResolved(s *setting.Setting) error {
-	for h, tr := range unresolved.Txs {
-		if err := tr.dfs(s, h); err != nil {
+func (m *Mesh) isResolved(s *setting.Setting) error {
+	for h, tr := range m.unresolved.Txs {
+		if err := m.dfs(s, tr, h); err != nil {
 			return err
 		}
 	}
 	return nil
 }
-func (tr *unresolvedTx) dfs(s *setting.Setting, h [32]byte) error {
+func (m *Mesh) dfs(s *setting.Setting, tr *unresolvedTx, h [32]byte) error {
 	if tr.visited {
 		return nil
 	}
@@ -275,18 +400,18 @@ func (tr *unresolvedTx) dfs(s *setting.Setting, h [32]byte) error {
 			tr.broken = true
 			return nil
 		}
-		if ptr, ok := unresolved.Txs[prev.Array()]; !ok || ptr.Type != tx.TypeNormal {
+		if ptr, ok := m.unresolved.Txs[prev.Array()]; !ok || ptr.Type != tx.TypeNormal {
 			tr.unresolved = true
-			if _, ok1 := unresolved.Noexists[prev.Array()]; !ok1 {
-				unresolved.Noexists[prev.Array()] = &Noexist{
-					HashWithType: &tx.HashWithType{
-						Hash: prev,
-						Type: tx.TypeNormal,
-					},
+			if _, ok1 := m.unresolved.Noexists[prev.Array()]; !ok1 {
+				//the sender of tr is responsible for its parents.
+				//if the pool is full, tr stays unresolved and the parent is added
+				//again in the next Resolve.
+				if err := m.addNoexist(prev, tx.TypeNormal, tr.Peer); err != nil && err != ErrPoolFull {
+					return err
 				}
 			}
 		} else {
-			if err := ptr.dfs(s, prev.Array()); err != nil {
+			if err := m.dfs(s, ptr, prev.Array()); err != nil {
 				return err
 			}
 			if ptr.broken {
@@ -298,14 +423,14 @@ func (tr *unresolvedTx) dfs(s *setting.Setting, h [32]byte) error {
 		}
 	}
 	if tr.broken || !tr.unresolved {
-		if err := resolved(s, tr, h[:]); err != nil {
+		if err := m.resolved(s, tr, h[:]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func resolved(s *setting.Setting, tr *unresolvedTx, hs tx.Hash) error {
+func (m *Mesh) resolved(s *setting.Setting, tr *unresolvedTx, hs tx.Hash) error {
 	tra, err := getUnresolvedTx(s, hs)
 	if err != nil {
 		return err
@@ -326,8 +451,8 @@ func resolved(s *setting.Setting, tr *unresolvedTx, hs tx.Hash) error {
 		//If an user stops aknode afeter adding tx to imesh but not adding to leaves,
 		//the tx wont never be in leaves.
 		//If add to leaves first, then cannot be seen tx in db.
-		return leaves.CheckAdd(s, func() error {
-			return putTx(s, tra)
+		return m.leaves.CheckAdd(s, func() error {
+			return m.putTx(s, tra)
 		}, tra)
 	}
 	return putMinableTx(s, tra, tr.Type)
@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package msg
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aklib/arypack"
+	"github.com/vmihailenco/msgpack"
+)
+
+//Record is a message recorded in a capture.
+type Record struct {
+	Time    int64 //unix time in nanoseconds
+	Peer    string
+	Inbound bool
+	Command byte
+	Payload []byte //uncompressed payload
+}
+
+//Capture records messages into w.
+type Capture struct {
+	w io.WriteCloser
+	sync.Mutex
+}
+
+//NewCapture returns a Capture which writes records into w.
+func NewCapture(w io.WriteCloser) *Capture {
+	return &Capture{
+		w: w,
+	}
+}
+
+//Write records a message to/from the peer.
+func (c *Capture) Write(peer string, inbound bool, cmd byte, payload []byte) error {
+	dat := arypack.Marshal(&Record{
+		Time:    time.Now().UnixNano(),
+		Peer:    peer,
+		Inbound: inbound,
+		Command: cmd,
+		Payload: payload,
+	})
+	c.Lock()
+	defer c.Unlock()
+	//one write per record so that a record is not split by file rotation.
+	_, err := c.w.Write(dat)
+	return err
+}
+
+//Close closes the underlying writer.
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.w.Close()
+}
+
+//CaptureReader reads records from a capture.
+type CaptureReader struct {
+	dec *msgpack.Decoder
+}
+
+//NewCaptureReader returns a CaptureReader which reads records from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{
+		dec: msgpack.NewDecoder(r),
+	}
+}
+
+//Next returns the next record. It returns io.EOF at the end of the capture.
+func (c *CaptureReader) Next() (*Record, error) {
+	var r Record
+	if err := c.dec.Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package msg
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+//Compression algorithms of payloads.
+//In Version they are bits of algorithms the sender can decode,
+//and in Header it is the algorithm the payload is compressed with.
+const (
+	CompressDeflate byte = 1 << iota //compress/flate
+)
+
+//CompressAll is all compression algorithms we can decode.
+const CompressAll = CompressDeflate
+
+//compressMin is the minimum length of a payload to be compressed.
+const compressMin = 1024
+
+//compressible is commands whose payloads are worth compressing.
+var compressible = map[byte]bool{
+	CmdTxs:    true,
+	CmdLeaves: true,
+}
+
+//flateWriters is a pool of flate writers, which are expensive to allocate.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.DefaultCompression)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return w
+	},
+}
+
+//ErrTooBig is returned when a decompressed payload exceeds MaxLength.
+var ErrTooBig = errors.New("decompressed payload is too big")
+
+//Compression returns a compression algorithm which is available to
+//send to the sender of v, or 0 if none.
+func (v *Version) Compression() byte {
+	if v.Compressions&CompressDeflate != 0 {
+		return CompressDeflate
+	}
+	return 0
+}
+
+//compress compresses dat for cmd with an algorithm in algs if it makes dat smaller.
+//It returns dat itself and 0 if not compressed.
+func compress(dat []byte, cmd, algs byte) ([]byte, byte) {
+	if algs&CompressDeflate == 0 || !compressible[cmd] || len(dat) < compressMin {
+		return dat, 0
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(dat); err != nil {
+		return dat, 0
+	}
+	if err := w.Close(); err != nil {
+		return dat, 0
+	}
+	if buf.Len() >= len(dat) {
+		return dat, 0
+	}
+	return buf.Bytes(), CompressDeflate
+}
+
+//decompress decompresses dat with algorithm alg up to MaxLength bytes.
+func decompress(dat []byte, alg byte) ([]byte, error) {
+	switch alg {
+	case 0:
+		return dat, nil
+	case CompressDeflate:
+	default:
+		return nil, errors.New("unknown compression")
+	}
+	r := flate.NewReader(bytes.NewReader(dat))
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	d, err := ioutil.ReadAll(io.LimitReader(r, MaxLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > MaxLength {
+		return nil, ErrTooBig
+	}
+	return d, nil
+}
@@ -21,10 +21,14 @@
 package msg
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync"
 
 	"github.com/AidosKuneen/aklib/arypack"
 	"github.com/AidosKuneen/aklib/db"
@@ -53,13 +57,83 @@ const (
 	CmdLedger     //14
 	CmdValidation //15
 	CmdProposal   //16
+	CmdNotFound   //Header + Inventories,p2p 17
+	CmdStemTx     //Header + Txs, stem phase of private relay, p2p 18
 )
 
-//Services in Version mesasge.
+//Service bits in Version mesasge.
 const (
-	ServiceFull byte = iota
+	ServiceFull      byte = 1 << iota //stores the whole iMesh and serves all txs
+	ServicePruned                     //serves only recent txs and leaves
+	ServiceLight                      //doesn't store the iMesh, doesn't serve any data
+	ServiceValidator                  //runs a validator
+	ServiceExplorer                   //also runs an explorer
 )
 
+//ServiceAll is all service bits known in this version.
+const ServiceAll = ServiceFull | ServicePruned | ServiceLight | ServiceValidator | ServiceExplorer
+
+//Services returns service bits of our node.
+func Services(s *setting.Setting) byte {
+	svc := ServiceFull
+	if s.RunValidator {
+		svc |= ServiceValidator
+	}
+	if s.RunExplorer {
+		svc |= ServiceExplorer
+	}
+	return svc
+}
+
+//command is requirements for a remote to receive a command.
+type command struct {
+	name     string
+	version  uint16 //min protocol version
+	services byte   //remote must have one of these services, 0 means any
+}
+
+var commands = map[byte]command{
+	CmdVersion:    {"version", 1, 0},
+	CmdVerack:     {"verack", 1, 0},
+	CmdPing:       {"ping", 1, 0},
+	CmdPong:       {"pong", 1, 0},
+	CmdGetAddr:    {"getaddr", 1, 0},
+	CmdAddr:       {"addr", 1, 0},
+	CmdInv:        {"inv", 1, ServiceFull | ServicePruned | ServiceValidator},
+	CmdGetData:    {"getdata", 1, ServiceFull | ServicePruned},
+	CmdTxs:        {"txs", 1, 0},
+	CmdGetLeaves:  {"getleaves", 1, ServiceFull | ServicePruned},
+	CmdLeaves:     {"leaves", 1, 0},
+	CmdClose:      {"close", 1, 0},
+	CmdGetLedger:  {"getledger", 1, ServiceFull | ServicePruned | ServiceValidator},
+	CmdLedger:     {"ledger", 1, 0},
+	CmdValidation: {"validation", 1, ServiceFull | ServicePruned | ServiceValidator},
+	CmdProposal:   {"proposal", 1, ServiceFull | ServicePruned | ServiceValidator},
+	CmdNotFound:   {"notfound", 2, 0},
+	CmdStemTx:     {"stemtx", 3, ServiceFull | ServicePruned},
+}
+
+//CmdName returns the name of the command cmd.
+func CmdName(cmd byte) string {
+	if c, ok := commands[cmd]; ok {
+		return c.name
+	}
+	return fmt.Sprintf("unknown(%d)", cmd)
+}
+
+//Supports returns true if a remote which talks protocol version ver
+//and has services svc can handle the command cmd.
+func Supports(cmd byte, ver uint16, svc byte) bool {
+	c, ok := commands[cmd]
+	if !ok {
+		return false
+	}
+	if ver < c.version {
+		return false
+	}
+	return c.services == 0 || svc&c.services != 0
+}
+
 //InvType is a tx type of Inv.
 type InvType byte
 
@@ -123,29 +197,92 @@ const (
 
 const userAgent = "AKnode Versin 0.01"
 
-//MessageVersion is a version of the message.
-const MessageVersion = 1
+//MessageVersion is the newest version of the message we can talk.
+const MessageVersion = 4
+
+//ChecksumVersion is the oldest version whose headers have a checksum and compression.
+//Version and Verack are always written without them so that older nodes can read them.
+const ChecksumVersion = 4
+
+//MinMessageVersion is the oldest version of the message we can talk.
+const MinMessageVersion = 1
 
 //Header  is a header of wire protocol.
 type Header struct {
+	Magic       uint32
+	Length      uint32
+	Command     byte
+	Checksum    uint32
+	Compression byte //algorithm the payload is compressed with, 0 if not compressed
+}
+
+//legacyHeader is a header before ChecksumVersion.
+type legacyHeader struct {
 	Magic   uint32
 	Length  uint32
 	Command byte
 }
 
+//ChecksumError is returned when a payload doesn't match the checksum in the header,
+//i.e. the payload is corrupted or truncated.
+type ChecksumError struct {
+	Command  byte
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for cmd %d, expected %x but %x", e.Command, e.Expected, e.Actual)
+}
+
+//ErrTooLong is returned when a message has too many entries.
+var ErrTooLong = errors.New("message has too many entries")
+
+//checksum returns a checksum of a payload dat.
+func checksum(dat []byte) uint32 {
+	h := sha256.Sum256(dat)
+	return binary.LittleEndian.Uint32(h[:4])
+}
+
 //Version is a message when a node creates an outgoing connection.
+//Version and MinVersion are the range of protocol versions the sender can talk.
 type Version struct {
-	Version   uint16
-	Nonce     uint64
-	AddrFrom  Addr
-	AddrTo    Addr
-	UserAgent string
+	Version      uint16
+	Nonce        uint64
+	AddrFrom     Addr
+	AddrTo       Addr
+	UserAgent    string
+	MinVersion   uint16
+	Compressions byte //compression algorithms the sender can decode
+	Services     byte //service bits of the sender
+}
+
+//Negotiate returns the newest protocol version which both we and
+//the sender of v can talk.
+func (v *Version) Negotiate() (uint16, error) {
+	min, max := v.MinVersion, v.Version
+	if min == 0 {
+		//sent by a node which doesn't know version range.
+		min = max
+	}
+	if max > MessageVersion {
+		max = MessageVersion
+	}
+	if min < MinMessageVersion {
+		min = MinMessageVersion
+	}
+	if max < min {
+		return 0, fmt.Errorf("no common version, remote:%d-%d, ours:%d-%d",
+			v.MinVersion, v.Version, MinMessageVersion, MessageVersion)
+	}
+	return max, nil
 }
 
 //Addr is an IP address and port.
 type Addr struct {
 	Address string `json:"address"`
 	Service byte   `json:"service"`
+	Time    int64  `json:"time,omitempty"` //unix time when the address was seen alive, 0 if unknown
 }
 
 //NewAddr returns a Addr struct.
@@ -183,24 +320,57 @@ type Nonce [32]byte
 //LeavesFrom is for getting leaves from from.
 type LeavesFrom [32]byte
 
-//Write write a message to con.
+//Write write a message to con in MessageVersion.
 func Write(s *setting.Setting, m interface{}, cmd byte, conn io.Writer) error {
+	return WriteCompressed(s, m, cmd, MessageVersion, 0, conn)
+}
+
+//WriteCompressed write a message to con in protocol version ver, compressing the payload
+//with one of algorithms algs if it is worth it and ver supports it.
+func WriteCompressed(s *setting.Setting, m interface{}, cmd byte, ver uint16, algs byte, conn io.Writer) error {
 	var dat []byte
 	if m != nil {
 		dat = arypack.Marshal(m)
-		if len(dat) > MaxLength {
-			return errors.New("packet is too big")
-		}
 	}
-	h := &Header{
-		Magic:   s.Config.MessageMagic,
-		Length:  uint32(len(dat)),
-		Command: cmd,
+	return writePayload(s, dat, cmd, ver, algs, conn)
+}
+
+//WriteRaw write a message whose payload is already marshalled to con in MessageVersion.
+func WriteRaw(s *setting.Setting, dat []byte, cmd byte, conn io.Writer) error {
+	return writePayload(s, dat, cmd, MessageVersion, 0, conn)
+}
+
+//isHandshake returns true if cmd is written with legacyHeader in any version.
+func isHandshake(cmd byte) bool {
+	return cmd == CmdVersion || cmd == CmdVerack
+}
+
+func writePayload(s *setting.Setting, dat []byte, cmd byte, ver uint16, algs byte, conn io.Writer) error {
+	if len(dat) > MaxLength {
+		return errors.New("packet is too big")
+	}
+	var h interface{}
+	if ver < ChecksumVersion || isHandshake(cmd) {
+		h = &legacyHeader{
+			Magic:   s.Config.MessageMagic,
+			Length:  uint32(len(dat)),
+			Command: cmd,
+		}
+	} else {
+		var alg byte
+		dat, alg = compress(dat, cmd, algs)
+		h = &Header{
+			Magic:       s.Config.MessageMagic,
+			Length:      uint32(len(dat)),
+			Command:     cmd,
+			Checksum:    checksum(dat),
+			Compression: alg,
+		}
 	}
 	if _, err := conn.Write(arypack.Marshal(h)); err != nil {
 		return err
 	}
-	if m == nil {
+	if len(dat) == 0 {
 		return nil
 	}
 	_, err := conn.Write(dat)
@@ -209,19 +379,17 @@ func Write(s *setting.Setting, m interface{}, cmd byte, conn io.Writer) error {
 
 type unbuf struct {
 	reader io.Reader
-	last   byte
+	b      [1]byte
 	unread bool
 }
 
 func (bs *unbuf) ReadByte() (byte, error) {
 	if bs.unread {
 		bs.unread = false
-		return bs.last, nil
+		return bs.b[0], nil
 	}
-	b := make([]byte, 1)
-	_, err := bs.reader.Read(b)
-	bs.last = b[0]
-	return b[0], err
+	_, err := io.ReadFull(bs.reader, bs.b[:])
+	return bs.b[0], err
 }
 func (bs *unbuf) UnreadByte() error {
 	if bs.unread {
@@ -231,34 +399,182 @@ func (bs *unbuf) UnreadByte() error {
 	return nil
 }
 func (bs *unbuf) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if bs.unread {
+		bs.unread = false
+		p[0] = bs.b[0]
+		return 1, nil
+	}
 	return bs.reader.Read(p)
 }
 
 //ReadHeader read a message from con and returns msg type.
+//It reads conn without buffering, so it can be mixed with other reads on conn.
+//Use Reader for reading many messages from a connection.
 func ReadHeader(s *setting.Setting, conn io.Reader) (byte, []byte, error) {
-	var h Header
-	var err2 error
 	bs := &unbuf{
 		reader: conn,
 	}
-	dec := msgpack.NewDecoder(bs)
-	if err := dec.Decode(&h); err != nil {
+	return readMessage(s, msgpack.NewDecoder(bs), bs, 0, func(n uint32) []byte {
+		return make([]byte, n)
+	})
+}
+
+//minPayload is the minimum capacity of a pooled payload buffer.
+const minPayload = 4 * 1024
+
+//payloadPool is a pool of buffers for payloads.
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, minPayload)
+		return &b
+	},
+}
+
+//counter counts bytes read from reader.
+type counter struct {
+	reader io.Reader
+	n      uint64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+//Reader reads messages from a connection through a buffer.
+//Payload buffers are taken from a pool and reused.
+type Reader struct {
+	r        *bufio.Reader
+	dec      *msgpack.Decoder
+	buf      *[]byte
+	cnt      *counter
+	consumed uint64
+	size     int
+	version  uint16
+}
+
+//NewReader returns a Reader which reads messages from conn.
+//All reads from conn must be done via the Reader after this.
+func NewReader(conn io.Reader) *Reader {
+	c := &counter{
+		reader: conn,
+	}
+	r := bufio.NewReader(c)
+	return &Reader{
+		r:   r,
+		dec: msgpack.NewDecoder(r),
+		cnt: c,
+	}
+}
+
+//ReadHeader read a message and returns msg type and its payload.
+//The payload is valid only until the next call of ReadHeader or Release.
+func (r *Reader) ReadHeader(s *setting.Setting) (byte, []byte, error) {
+	r.Release()
+	cmd, buf, err := readMessage(s, r.dec, r.r, r.version, func(n uint32) []byte {
+		b := payloadPool.Get().(*[]byte)
+		if uint32(cap(*b)) < n {
+			*b = make([]byte, n)
+		}
+		r.buf = b
+		return (*b)[:n]
+	})
+	consumed := r.cnt.n - uint64(r.r.Buffered())
+	r.size = int(consumed - r.consumed)
+	r.consumed = consumed
+	return cmd, buf, err
+}
+
+//SetVersion sets the negotiated protocol version ver. Messages except handshake
+//must have a checksum after this if ver is ChecksumVersion or newer.
+func (r *Reader) SetVersion(ver uint16) {
+	r.version = ver
+}
+
+//Size returns the size on the wire of the last message read by ReadHeader.
+func (r *Reader) Size() int {
+	return r.size
+}
+
+//Release returns the payload buffer of the last message to the pool.
+func (r *Reader) Release() {
+	if r.buf == nil {
+		return
+	}
+	payloadPool.Put(r.buf)
+	r.buf = nil
+}
+
+//readHeader reads a Header or a legacyHeader, and returns true if it is a Header.
+func readHeader(dec *msgpack.Decoder) (*Header, bool, error) {
+	var h Header
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, false, err
+	}
+	if n != 3 && n != 5 {
+		return nil, false, fmt.Errorf("invalid header length %d", n)
+	}
+	if h.Magic, err = dec.DecodeUint32(); err != nil {
+		return nil, false, err
+	}
+	if h.Length, err = dec.DecodeUint32(); err != nil {
+		return nil, false, err
+	}
+	if h.Command, err = dec.DecodeUint8(); err != nil {
+		return nil, false, err
+	}
+	if n == 3 {
+		return &h, false, nil
+	}
+	if h.Checksum, err = dec.DecodeUint32(); err != nil {
+		return nil, false, err
+	}
+	if h.Compression, err = dec.DecodeUint8(); err != nil {
+		return nil, false, err
+	}
+	return &h, true, nil
+}
+
+//readMessage reads a message from a peer which talks protocol version ver,
+//or 0 if not negotiated yet.
+func readMessage(s *setting.Setting, dec *msgpack.Decoder, conn io.Reader, ver uint16, alloc func(uint32) []byte) (byte, []byte, error) {
+	h, full, err := readHeader(dec)
+	if err != nil {
 		log.Println(err)
 		return 0, nil, err
 	}
+	if !full && ver >= ChecksumVersion && !isHandshake(h.Command) {
+		return 0, nil, fmt.Errorf("no checksum in header for cmd %d", h.Command)
+	}
 	if h.Length > MaxLength {
 		return 0, nil, errors.New("message is too big")
 	}
 	if s.Config.MessageMagic != h.Magic {
 		return 0, nil, errors.New("invalid magic")
 	}
-	buf := make([]byte, h.Length)
-	n := 0
-	for l := uint32(0); l < h.Length; l += uint32(n) {
-		if n, err2 = conn.Read(buf[l:]); err2 != nil {
-			return 0, nil, err2
+	buf := alloc(h.Length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, nil, err
+	}
+	if !full {
+		return h.Command, buf, nil
+	}
+	if c := checksum(buf); c != h.Checksum {
+		return 0, nil, &ChecksumError{
+			Command:  h.Command,
+			Expected: h.Checksum,
+			Actual:   c,
 		}
 	}
+	buf, err = decompress(buf, h.Compression)
+	if err != nil {
+		return 0, nil, err
+	}
 	return h.Command, buf, nil
 }
 
@@ -268,13 +584,18 @@ func ReadVersion(s *setting.Setting, buf []byte, verNonce uint64) (*Version, err
 	if err := arypack.Unmarshal(buf, &v); err != nil {
 		return nil, err
 	}
-	if v.Version != MessageVersion {
-		return nil, errors.New("invalid version")
+	if _, err := v.Negotiate(); err != nil {
+		return nil, err
 	}
-	if v.AddrFrom.Service != ServiceFull {
-		return nil, errors.New("unknown service")
+	//Service in Addr must be 0 for older versions, so service bits
+	//are in Services. Nodes before service bits are full nodes.
+	v.AddrFrom.Service = v.Services
+	if v.AddrFrom.Service == 0 {
+		v.AddrFrom.Service = ServiceFull
 	}
-	if v.AddrTo.Service != ServiceFull {
+	//ignore services we don't know, they are for newer versions.
+	v.AddrFrom.Service &= ServiceAll
+	if v.AddrFrom.Service == 0 {
 		return nil, errors.New("unknown service")
 	}
 	if err := s.CheckAddress(v.AddrFrom.Address, true, true); err != nil {
@@ -296,7 +617,7 @@ func ReadAddrs(s *setting.Setting, buf []byte) (*Addrs, error) {
 		return nil, err
 	}
 	if len(v) > MaxAddrs {
-		return nil, errors.New("addrs is too long")
+		return nil, ErrTooLong
 	}
 	for i := len(v) - 1; i >= 0; i-- {
 		adr := v[i]
@@ -317,7 +638,7 @@ func ReadInventories(buf []byte) (Inventories, error) {
 		return nil, err
 	}
 	if len(v) > MaxInv {
-		return nil, errors.New("Inventories is too long")
+		return nil, ErrTooLong
 	}
 	return v, nil
 }
@@ -329,7 +650,7 @@ func ReadTxs(buf []byte) (Txs, error) {
 		return nil, err
 	}
 	if len(v) > MaxTx {
-		return nil, errors.New("Txs is too long")
+		return nil, ErrTooLong
 	}
 	return v, nil
 }
@@ -354,11 +675,16 @@ func ReadLeavesFrom(buf []byte) (*LeavesFrom, error) {
 
 //NewVersion returns Verstion struct.
 func NewVersion(s *setting.Setting, to Addr, nonce uint64) *Version {
+	//older versions reject Service in Addr other than 0.
+	to.Service = 0
 	return &Version{
-		Version:   MessageVersion,
-		UserAgent: userAgent,
-		AddrTo:    to,
-		AddrFrom:  *NewAddr(s.MyHostPort, ServiceFull),
-		Nonce:     nonce,
+		Version:      MessageVersion,
+		MinVersion:   MinMessageVersion,
+		UserAgent:    userAgent,
+		AddrTo:       to,
+		AddrFrom:     *NewAddr(s.MyHostPort, 0),
+		Nonce:        nonce,
+		Compressions: CompressAll,
+		Services:     Services(s),
 	}
 }
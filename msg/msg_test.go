@@ -22,10 +22,15 @@ package msg
 
 import (
 	"bytes"
+	"compress/flate"
+	"io"
 	"testing"
 
 	"github.com/AidosKuneen/aklib"
+	"github.com/AidosKuneen/aklib/arypack"
+	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/setting"
+	"github.com/vmihailenco/msgpack"
 )
 
 func TestMsg(t *testing.T) {
@@ -58,6 +63,86 @@ func TestMsg(t *testing.T) {
 	}
 }
 
+func TestReader(t *testing.T) {
+	s := &setting.Setting{
+		DBConfig: aklib.DBConfig{
+			Config: aklib.TestConfig,
+		},
+	}
+	var buf bytes.Buffer
+	var nonce Nonce
+	for i := range nonce {
+		nonce[i] = byte(i)
+	}
+	invs := make(Inventories, 100)
+	for i := range invs {
+		invs[i] = &Inventory{
+			Type: InvTxNormal,
+			Hash: [32]byte{byte(i)},
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := Write(s, &nonce, CmdPing, &buf); err != nil {
+			t.Error(err)
+		}
+		if err := Write(s, &invs, CmdInv, &buf); err != nil {
+			t.Error(err)
+		}
+		if err := Write(s, nil, CmdVerack, &buf); err != nil {
+			t.Error(err)
+		}
+	}
+	total := buf.Len()
+	size := 0
+	r := NewReader(&buf)
+	for i := 0; i < 3; i++ {
+		cmd, body, err := r.ReadHeader(s)
+		if err != nil {
+			t.Error(err)
+		}
+		size += r.Size()
+		if cmd != CmdPing {
+			t.Error("invalid write/read")
+		}
+		n, err := ReadNonce(body)
+		if err != nil {
+			t.Error(err)
+		}
+		if *n != nonce {
+			t.Error("invalid readnonce")
+		}
+		cmd, body, err = r.ReadHeader(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if cmd != CmdInv {
+			t.Error("invalid write/read")
+		}
+		invs2, err := ReadInventories(body)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(invs2) != len(invs) || invs2[99].Hash != invs[99].Hash {
+			t.Error("invalid inventories")
+		}
+		size += r.Size()
+		cmd, body, err = r.ReadHeader(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if cmd != CmdVerack || len(body) != 0 {
+			t.Error("invalid write/read")
+		}
+		size += r.Size()
+	}
+	if size != total {
+		t.Error("invalid size", size, total)
+	}
+	if _, _, err := r.ReadHeader(s); err == nil {
+		t.Error("should be error")
+	}
+}
+
 func TestMsgErr(t *testing.T) {
 	s := &setting.Setting{
 		DBConfig: aklib.DBConfig{
@@ -75,4 +160,356 @@ func TestMsgErr(t *testing.T) {
 	if _, _, err := ReadHeader(s, &buf); err == nil {
 		t.Error("should be error")
 	}
+
+	buf.Reset()
+	if err := Write(s, &nonce, CmdPing, &buf); err != nil {
+		t.Error(err)
+	}
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+	_, _, err := ReadHeader(s, &buf)
+	if err == nil {
+		t.Error("should be error")
+	}
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Error("should be checksum error", err)
+	}
+}
+
+func TestLegacyHeader(t *testing.T) {
+	s := &setting.Setting{
+		DBConfig: aklib.DBConfig{
+			Config: aklib.TestConfig,
+		}}
+	var nonce Nonce
+	for i := range nonce {
+		nonce[i] = byte(i)
+	}
+	//a message from version 1 node.
+	var buf bytes.Buffer
+	dat := arypack.Marshal(&nonce)
+	buf.Write(arypack.Marshal(&legacyHeader{
+		Magic:   s.Config.MessageMagic,
+		Length:  uint32(len(dat)),
+		Command: CmdPing,
+	}))
+	buf.Write(dat)
+	legacy := buf.Bytes()
+	cmd, body, err := ReadHeader(s, bytes.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != CmdPing || !bytes.Equal(body, dat) {
+		t.Error("invalid legacy message")
+	}
+	r := NewReader(bytes.NewReader(legacy))
+	r.SetVersion(1)
+	if _, _, err = r.ReadHeader(s); err != nil {
+		t.Error(err)
+	}
+	r = NewReader(bytes.NewReader(legacy))
+	r.SetVersion(ChecksumVersion)
+	if _, _, err = r.ReadHeader(s); err == nil {
+		t.Error("should be error without checksum")
+	}
+
+	//messages to version 1 node and handshakes must be readable by old nodes.
+	for _, c := range []struct {
+		cmd byte
+		ver uint16
+	}{
+		{CmdPing, 1},
+		{CmdVersion, MessageVersion},
+		{CmdVerack, MessageVersion},
+	} {
+		buf.Reset()
+		if err = WriteCompressed(s, &nonce, c.cmd, c.ver, CompressAll, &buf); err != nil {
+			t.Fatal(err)
+		}
+		h, full, err2 := readHeader(msgpack.NewDecoder(&buf))
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		if full || h.Command != c.cmd || int(h.Length) != buf.Len() {
+			t.Error("invalid legacy header", c.cmd)
+		}
+		if !bytes.Equal(buf.Bytes(), dat) {
+			t.Error("payload must not be compressed", c.cmd)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	s := &setting.Setting{
+		DBConfig: aklib.DBConfig{
+			Config: aklib.TestConfig,
+		}}
+	invs := make(Inventories, MaxInv)
+	for i := range invs {
+		invs[i] = &Inventory{
+			Type: InvTxNormal,
+			Hash: [32]byte{byte(i)},
+		}
+	}
+	var plain, comp bytes.Buffer
+	if err := Write(s, &invs, CmdLeaves, &plain); err != nil {
+		t.Error(err)
+	}
+	if err := WriteCompressed(s, &invs, CmdLeaves, MessageVersion, CompressAll, &comp); err != nil {
+		t.Error(err)
+	}
+	if comp.Len() >= plain.Len() {
+		t.Error("should be compressed", comp.Len(), plain.Len())
+	}
+	cmd, body, err := ReadHeader(s, &comp)
+	if err != nil {
+		t.Error(err)
+	}
+	if cmd != CmdLeaves {
+		t.Error("invalid cmd")
+	}
+	invs2, err := ReadInventories(body)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(invs2) != MaxInv || invs2[MaxInv-1].Hash != invs[MaxInv-1].Hash {
+		t.Error("invalid decompression")
+	}
+
+	comp.Reset()
+	var nonce Nonce
+	if err := WriteCompressed(s, &nonce, CmdPing, MessageVersion, CompressAll, &comp); err != nil {
+		t.Error(err)
+	}
+	plain.Reset()
+	if err := Write(s, &nonce, CmdPing, &plain); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(comp.Bytes(), plain.Bytes()) {
+		t.Error("ping should not be compressed")
+	}
+
+	var bomb bytes.Buffer
+	w, err := flate.NewWriter(&bomb, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 2*MaxLength)); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	h := &Header{
+		Magic:       s.Config.MessageMagic,
+		Length:      uint32(bomb.Len()),
+		Command:     CmdTxs,
+		Checksum:    checksum(bomb.Bytes()),
+		Compression: CompressDeflate,
+	}
+	var buf bytes.Buffer
+	buf.Write(arypack.Marshal(h))
+	buf.Write(bomb.Bytes())
+	if _, _, err := ReadHeader(s, &buf); err != ErrTooBig {
+		t.Error("should be too big", err)
+	}
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestCapture(t *testing.T) {
+	var buf closeBuffer
+	c := NewCapture(&buf)
+	nonce := arypack.Marshal(&Nonce{1, 2, 3})
+	if err := c.Write("127.0.0.1:1234", true, CmdPing, nonce); err != nil {
+		t.Error(err)
+	}
+	if err := c.Write("127.0.0.1:1234", false, CmdGetAddr, nil); err != nil {
+		t.Error(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+	if !buf.closed {
+		t.Error("should be closed")
+	}
+	r := NewCaptureReader(&buf)
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Peer != "127.0.0.1:1234" || !rec.Inbound || rec.Command != CmdPing ||
+		!bytes.Equal(rec.Payload, nonce) || rec.Time == 0 {
+		t.Error("invalid record", rec)
+	}
+	rec, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Inbound || rec.Command != CmdGetAddr || len(rec.Payload) != 0 {
+		t.Error("invalid record", rec)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Error("should be EOF", err)
+	}
+	if CmdName(CmdNotFound) != "notfound" {
+		t.Error("invalid name")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v := &Version{
+		Version:    MessageVersion + 10,
+		MinVersion: MinMessageVersion,
+	}
+	ver, err := v.Negotiate()
+	if err != nil {
+		t.Error(err)
+	}
+	if ver != MessageVersion {
+		t.Error("invalid negotiated version", ver)
+	}
+	v = &Version{
+		Version: MinMessageVersion,
+	}
+	ver, err = v.Negotiate()
+	if err != nil {
+		t.Error(err)
+	}
+	if ver != MinMessageVersion {
+		t.Error("invalid negotiated version", ver)
+	}
+	v = &Version{
+		Version:    MessageVersion + 10,
+		MinVersion: MessageVersion + 1,
+	}
+	if _, err := v.Negotiate(); err == nil {
+		t.Error("should be error")
+	}
+	if v.Compression() != 0 {
+		t.Error("should not be compressed")
+	}
+	v.Compressions = CompressAll
+	if v.Compression() != CompressDeflate {
+		t.Error("should be compressed with deflate")
+	}
+
+	if !Supports(CmdGetData, MessageVersion, ServiceFull|ServiceValidator) {
+		t.Error("full node should support getdata")
+	}
+	if Supports(CmdGetData, MessageVersion, ServiceLight) {
+		t.Error("light node should not support getdata")
+	}
+	if !Supports(CmdPing, MessageVersion, ServiceLight) {
+		t.Error("light node should support ping")
+	}
+	if Supports(CmdGetData, 0, ServiceFull) {
+		t.Error("should not support old version")
+	}
+	if Supports(CmdNotFound, 1, ServiceFull) {
+		t.Error("CmdNotFound should not be sent to version 1")
+	}
+	if !Supports(CmdNotFound, 2, ServiceLight) {
+		t.Error("CmdNotFound should be supported by version 2")
+	}
+	if Supports(CmdStemTx, 2, ServiceFull) {
+		t.Error("CmdStemTx should not be sent to version 2")
+	}
+	if Supports(CmdStemTx, 3, ServiceLight) {
+		t.Error("light node should not support stemtx")
+	}
+	if !Supports(CmdStemTx, 3, ServiceFull) {
+		t.Error("CmdStemTx should be supported by version 3")
+	}
+	if Supports(0xff, MessageVersion, ServiceFull) {
+		t.Error("should not support unknown command")
+	}
+}
+
+func benchTxs(b *testing.B) (*setting.Setting, []byte) {
+	s := &setting.Setting{
+		DBConfig: aklib.DBConfig{
+			Config: aklib.TestConfig,
+		},
+	}
+	txs := make(Txs, 100)
+	for i := range txs {
+		tr := tx.New(s.Config)
+		tr.Message = make([]byte, 255)
+		txs[i] = &Tx{
+			Type: InvTxNormal,
+			Tx:   tr,
+		}
+	}
+	var buf bytes.Buffer
+	if err := Write(s, &txs, CmdTxs, &buf); err != nil {
+		b.Fatal(err)
+	}
+	return s, buf.Bytes()
+}
+
+func BenchmarkReadHeader(b *testing.B) {
+	s, dat := benchTxs(b)
+	b.SetBytes(int64(len(dat)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ReadHeader(s, bytes.NewReader(dat)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	s, dat := benchTxs(b)
+	all := bytes.Repeat(dat, b.N)
+	r := NewReader(bytes.NewReader(all))
+	b.SetBytes(int64(len(dat)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := r.ReadHeader(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	s, dat := benchTxs(b)
+	_, body, err := ReadHeader(s, bytes.NewReader(dat))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, alg := compress(body, CmdTxs, CompressAll); alg != CompressDeflate {
+			b.Fatal("should be compressed")
+		}
+	}
+}
+
+func BenchmarkReadTxs(b *testing.B) {
+	s, dat := benchTxs(b)
+	_, body, err := ReadHeader(s, bytes.NewReader(dat))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadTxs(body); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,310 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AidosKuneen/aklib/db"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	//banThreshold is a misbehaviour score to be banned.
+	banThreshold = 100
+	//scoreHalfLife is a duration in which a misbehaviour score decays by half.
+	scoreHalfLife = 10 * time.Minute
+)
+
+//offence is a kind of misbehaviour of a remote node.
+type offence struct {
+	reason string
+	weight int
+}
+
+//Offences and their penalties.
+var (
+	offInvalidTx     = &offence{"invalid tx", 100}
+	offUnsolicited   = &offence{"unsolicited reply", 20}
+	offOversize      = &offence{"oversize inventory", 50}
+	offBadSignature  = &offence{"bad signature on proposal or validation", 100}
+	offMalformed     = &offence{"malformed message", 50}
+	offUnknownCmd    = &offence{"unknown command", 50}
+	offInvalidLedger = &offence{"invalid ledger", 10}
+	offUnresolvable  = &offence{"announced tx never resolved", 5}
+)
+
+//banKey is the key for the ban list under db.HeaderNodeIP.
+var banKey = []byte("banned")
+
+//Ban is an entry of a banned address or subnet.
+type Ban struct {
+	Created time.Time
+	Until   time.Time
+	Reason  string
+}
+
+//score is a misbehaviour score which decays over time.
+type score struct {
+	value   float64
+	updated time.Time
+}
+
+func (sc *score) decayed(now time.Time) float64 {
+	return sc.value * math.Pow(0.5, float64(now.Sub(sc.updated))/float64(scoreHalfLife))
+}
+
+func (sc *score) add(w int) float64 {
+	now := time.Now()
+	sc.value = sc.decayed(now) + float64(w)
+	sc.updated = now
+	return sc.value
+}
+
+//misbehave adds a penalty for offence o to the remote, and bans it
+//if its score crosses banThreshold. It returns an error if the remote is banned.
+//Remotes with noban permission are never scored.
+func (p *peer) misbehave(s *setting.Setting, o *offence, err error) error {
+	log.Println(p.remote.Address, o.reason, ":", err)
+	if p.perm&setting.PermNoBan != 0 {
+		return nil
+	}
+	n := p.node
+	n.peers.Lock()
+	now := time.Now()
+	for h, sc := range n.peers.scores {
+		if sc.decayed(now) < 1 {
+			delete(n.peers.scores, h)
+		}
+	}
+	sc, ok := n.peers.scores[p.host]
+	if !ok {
+		sc = &score{}
+		n.peers.scores[p.host] = sc
+	}
+	if sc.add(o.weight) < banThreshold {
+		n.peers.Unlock()
+		return nil
+	}
+	delete(n.peers.scores, p.host)
+	n.peers.banned[p.host] = &Ban{
+		Created: now,
+		Until:   now.Add(BanTime),
+		Reason:  o.reason,
+	}
+	n.peers.Unlock()
+	if err2 := n.putBanned(s); err2 != nil {
+		log.Println(err2)
+	}
+	return fmt.Errorf("%v was banned for %v: %v", p.remote.Address, o.reason, err)
+}
+
+//penaliseUnresolvable penalises connected peers for each of their announcements
+//which never resolved, and disconnects them if banned.
+func (n *Node) penaliseUnresolvable(s *setting.Setting) {
+	for adr, no := range n.mesh.Unresolvable() {
+		n.peers.RLock()
+		p, ok := n.peers.Peers[adr]
+		n.peers.RUnlock()
+		if !ok {
+			continue
+		}
+		o := &offence{
+			reason: offUnresolvable.reason,
+			weight: offUnresolvable.weight * no,
+		}
+		if err := p.misbehave(s, o, fmt.Errorf("%d txs", no)); err != nil {
+			log.Println(err)
+			p.disconnect()
+		}
+	}
+}
+
+//readOffence returns an offence for an error while parsing a payload.
+func readOffence(err error) *offence {
+	if err == msg.ErrTooLong || err == msg.ErrTooBig {
+		return offOversize
+	}
+	return offMalformed
+}
+
+//isIOError returns true if err is not caused by the remote's misbehaviour.
+func isIOError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if _, ok := err.(*msg.ChecksumError); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+//parseBan returns a normalized IP address or CIDR subnet of adr.
+func parseBan(adr string) (string, error) {
+	if strings.Contains(adr, "/") {
+		_, n, err := net.ParseCIDR(adr)
+		if err != nil {
+			return "", err
+		}
+		return n.String(), nil
+	}
+	ip := net.ParseIP(adr)
+	if ip == nil {
+		return "", errors.New("invalid IP address " + adr)
+	}
+	return ip.String(), nil
+}
+
+//banMatch returns true if host is the banned address or in the banned subnet adr.
+func banMatch(adr, host string) bool {
+	if adr == host {
+		return true
+	}
+	if !strings.Contains(adr, "/") {
+		return false
+	}
+	_, n, err := net.ParseCIDR(adr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && n.Contains(ip)
+}
+
+func (n *Node) isBanned(host string) bool {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	now := time.Now()
+	for adr, b := range n.peers.banned {
+		if b.Until.After(now) && banMatch(adr, host) {
+			return true
+		}
+	}
+	return false
+}
+
+//SetBan bans an IP address or a CIDR subnet adr for d,
+//and disconnects peers in it.
+func SetBan(s *setting.Setting, adr, reason string, d time.Duration) error {
+	return std.SetBan(s, adr, reason, d)
+}
+
+//SetBan bans an IP address or a CIDR subnet adr for d,
+//and disconnects peers in it.
+func (n *Node) SetBan(s *setting.Setting, adr, reason string, d time.Duration) error {
+	if d <= 0 {
+		return errors.New("ban duration must be positive")
+	}
+	adr, err := parseBan(adr)
+	if err != nil {
+		return err
+	}
+	n.peers.Lock()
+	now := time.Now()
+	n.peers.banned[adr] = &Ban{
+		Created: now,
+		Until:   now.Add(d),
+		Reason:  reason,
+	}
+	delete(n.peers.scores, adr)
+	for _, p := range n.peers.Peers {
+		if !banMatch(adr, p.host) || p.conn == nil {
+			continue
+		}
+		p.disconnect()
+	}
+	n.peers.Unlock()
+	return n.putBanned(s)
+}
+
+//ClearBan removes an IP address or a CIDR subnet adr from the ban list.
+//All bans are removed if adr is empty.
+func ClearBan(s *setting.Setting, adr string) error {
+	return std.ClearBan(s, adr)
+}
+
+//ClearBan removes an IP address or a CIDR subnet adr from the ban list.
+//All bans are removed if adr is empty.
+func (n *Node) ClearBan(s *setting.Setting, adr string) error {
+	if adr != "" {
+		var err error
+		if adr, err = parseBan(adr); err != nil {
+			return err
+		}
+	}
+	n.peers.Lock()
+	if adr == "" {
+		n.peers.banned = make(map[string]*Ban)
+	} else {
+		if _, ok := n.peers.banned[adr]; !ok {
+			n.peers.Unlock()
+			return errors.New("not banned")
+		}
+		delete(n.peers.banned, adr)
+	}
+	n.peers.Unlock()
+	return n.putBanned(s)
+}
+
+//loadBanned loads the ban list from DB.
+func (n *Node) loadBanned(s *setting.Setting) error {
+	banned := make(map[string]*Ban)
+	err := s.DB.View(func(txn *badger.Txn) error {
+		return db.Get(txn, banKey, &banned, db.HeaderNodeIP)
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	n.peers.Lock()
+	n.peers.banned = banned
+	n.peers.Unlock()
+	return nil
+}
+
+//putBanned stores a copy of the ban list into DB, dropping expired entries.
+//DB is written without locking mutex(peers), which must not be locked by caller.
+func (n *Node) putBanned(s *setting.Setting) error {
+	n.peers.store.Lock()
+	defer n.peers.store.Unlock()
+	now := time.Now()
+	n.peers.Lock()
+	banned := make(map[string]*Ban, len(n.peers.banned))
+	for adr, b := range n.peers.banned {
+		if !b.Until.After(now) {
+			delete(n.peers.banned, adr)
+			continue
+		}
+		banned[adr] = b
+	}
+	n.peers.Unlock()
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return db.Put(txn, banKey, banned, db.HeaderNodeIP)
+	})
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//rateWindow is the number of seconds to measure current rates.
+const rateWindow = 10
+
+//rateLimiter is a token bucket of bytes, whose burst is bytes for a second.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+//reserve takes n bytes from the bucket which is filled at rate bytes/s,
+//and returns the duration to wait for them. Rate 0 means unlimited.
+func (l *rateLimiter) reserve(rate uint64, n int) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	r := float64(rate)
+	if l.last.IsZero() {
+		l.tokens = r
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * r
+	}
+	if l.tokens > r {
+		l.tokens = r
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / r * float64(time.Second))
+}
+
+//wait returns the duration until bytes taken beyond the bucket are refilled
+//at rate bytes/s, without taking any bytes.
+func (l *rateLimiter) wait(rate uint64) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.tokens >= 0 || l.last.IsZero() {
+		return 0
+	}
+	debt := -l.tokens - time.Since(l.last).Seconds()*float64(rate)
+	if debt <= 0 {
+		return 0
+	}
+	return time.Duration(debt / float64(rate) * float64(time.Second))
+}
+
+//rateMeter measures bytes per second in the last rateWindow seconds.
+type rateMeter struct {
+	bytes [rateWindow]uint64
+	sec   int64 //unix time of the latest slot
+	sync.Mutex
+}
+
+//shift clears slots which are older than now.
+//locked by caller.
+func (m *rateMeter) shift(now int64) {
+	for i := m.sec + 1; i <= now && i <= m.sec+rateWindow; i++ {
+		m.bytes[i%rateWindow] = 0
+	}
+	if now > m.sec {
+		m.sec = now
+	}
+}
+
+func (m *rateMeter) add(n int) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now().Unix()
+	m.shift(now)
+	m.bytes[now%rateWindow] += uint64(n)
+}
+
+//rate returns bytes per second in the last rateWindow seconds.
+func (m *rateMeter) rate() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	m.shift(time.Now().Unix())
+	var total uint64
+	for _, b := range m.bytes {
+		total += b
+	}
+	return total / rateWindow
+}
+
+//bandwidth is limiters and meters of the traffic of all peers or a peer.
+type bandwidth struct {
+	upLimit   rateLimiter
+	downLimit rateLimiter
+	up        rateMeter
+	down      rateMeter
+}
+
+//throttle takes n bytes of cmd from the upload (if upload is true) or download limits
+//of the node and p, and returns the duration to wait for them.
+//Consensus traffic is exempted.
+func (p *peer) throttle(s *setting.Setting, upload bool, cmd byte, n int) time.Duration {
+	if lane(cmd) == laneConsensus {
+		return 0
+	}
+	g, l, rate, prate := p.limiters(s, upload)
+	d := g.reserve(rate, n)
+	if d2 := l.reserve(prate, n); d2 > d {
+		d = d2
+	}
+	return d
+}
+
+//throttled returns the duration until bytes taken from the upload (if upload is true)
+//or download limits of the node and p are refilled.
+func (p *peer) throttled(s *setting.Setting, upload bool) time.Duration {
+	g, l, rate, prate := p.limiters(s, upload)
+	d := g.wait(rate)
+	if d2 := l.wait(prate); d2 > d {
+		d = d2
+	}
+	return d
+}
+
+//limiters returns the upload (if upload is true) or download limiters
+//of the node and p with their rates.
+func (p *peer) limiters(s *setting.Setting, upload bool) (*rateLimiter, *rateLimiter, uint64, uint64) {
+	if upload {
+		return &p.node.bandwidth.upLimit, &p.bandwidth.upLimit, s.MaxUploadRate, s.PeerMaxUploadRate
+	}
+	return &p.node.bandwidth.downLimit, &p.bandwidth.downLimit, s.MaxDownloadRate, s.PeerMaxDownloadRate
+}
+
+//BandwidthInfo is current rates and limits of traffic in bytes per second.
+//Limits of 0 mean unlimited.
+type BandwidthInfo struct {
+	UploadRate          uint64 `json:"upload_rate"`
+	DownloadRate        uint64 `json:"download_rate"`
+	MaxUploadRate       uint64 `json:"max_upload_rate"`
+	MaxDownloadRate     uint64 `json:"max_download_rate"`
+	PeerMaxUploadRate   uint64 `json:"peer_max_upload_rate"`
+	PeerMaxDownloadRate uint64 `json:"peer_max_download_rate"`
+}
+
+//GetBandwidthInfo returns current rates of the default node and limits in setting s.
+func GetBandwidthInfo(s *setting.Setting) *BandwidthInfo {
+	return std.GetBandwidthInfo(s)
+}
+
+//GetBandwidthInfo returns current rates of the node and limits in setting s.
+func (n *Node) GetBandwidthInfo(s *setting.Setting) *BandwidthInfo {
+	return &BandwidthInfo{
+		UploadRate:          n.bandwidth.up.rate(),
+		DownloadRate:        n.bandwidth.down.rate(),
+		MaxUploadRate:       s.MaxUploadRate,
+		MaxDownloadRate:     s.MaxDownloadRate,
+		PeerMaxUploadRate:   s.PeerMaxUploadRate,
+		PeerMaxDownloadRate: s.PeerMaxDownloadRate,
+	}
+}
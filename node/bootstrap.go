@@ -0,0 +1,198 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//bootstrapSource is a source of node addresses for bootstrapping.
+//src is the source of addresses for the address book, empty if it is trusted.
+type bootstrapSource struct {
+	name  string
+	addrs func(s *setting.Setting) (src string, adrs msg.Addrs, err error)
+}
+
+//initBootstrap sets sources for bootstrapping in order, which can be replaced in tests.
+func (n *Node) initBootstrap() {
+	n.lookupSRV = net.LookupSRV
+	n.sources = []*bootstrapSource{
+		{"dns", n.dnsSeeds},
+		{"static", staticSeedAddrs},
+		{"file", filePeers},
+	}
+}
+
+//bootstrap adds addresses from sources of n in order until there are enough
+//addresses to connect. Failures of sources are only logged.
+func (n *Node) bootstrap(s *setting.Setting) {
+	for _, b := range n.sources {
+		if n.addrSize() >= int(s.MaxOutbound) {
+			return
+		}
+		src, adrs, err := b.addrs(s)
+		if err != nil {
+			log.Println("bootstrap source", b.name, "failed:", err)
+		}
+		if len(adrs) == 0 {
+			continue
+		}
+		if err := n.putAddrs(s, src, adrs...); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Println("bootstrap source", b.name, "contributed", len(adrs), "addresses")
+	}
+	if n.addrSize() == 0 {
+		log.Println("no addresses from bootstrap sources")
+	}
+}
+
+//dnsSeeds returns addresses in SRV records of DNS seeds.
+//DNS seeds are not used in proxy_only mode, because SRV records cannot be
+//resolved through the proxy.
+func (n *Node) dnsSeeds(s *setting.Setting) (string, msg.Addrs, error) {
+	if s.ProxyOnly {
+		return "", nil, nil
+	}
+	var adrs msg.Addrs
+	var err error
+	src := ""
+	for _, d := range s.Config.DNS {
+		_, addrs, err2 := n.lookupSRV(d.Service, "tcp", d.Name)
+		if err2 != nil {
+			err = err2
+			continue
+		}
+		for _, a := range addrs {
+			adr := net.JoinHostPort(a.Target, strconv.Itoa(int(s.Config.DefaultPort)))
+			adrs = append(adrs, *msg.NewAddr(adr, msg.ServiceFull))
+		}
+		src = d.Name
+	}
+	return src, adrs, err
+}
+
+//staticSeedAddrs returns addresses of seed_nodes in setting, which are host:port
+//of long-running nodes used when DNS seeds are not available.
+func staticSeedAddrs(s *setting.Setting) (string, msg.Addrs, error) {
+	adrs := make(msg.Addrs, 0, len(s.SeedNodes))
+	for _, adr := range s.SeedNodes {
+		if err := s.CheckAddress(adr, true, false); err != nil {
+			log.Println(adr, err)
+			continue
+		}
+		adrs = append(adrs, *msg.NewAddr(adr, msg.ServiceFull))
+	}
+	return "", adrs, nil
+}
+
+//filePeers returns addresses in the peers file in setting.
+func filePeers(s *setting.Setting) (string, msg.Addrs, error) {
+	if s.PeersFile == "" {
+		return "", nil, nil
+	}
+	adrs, err := readPeers(s, s.PeersFile)
+	return "", adrs, err
+}
+
+//readPeers reads addresses from the peers file fname,
+//which is a JSON array of host:port.
+func readPeers(s *setting.Setting, fname string) (msg.Addrs, error) {
+	dat, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	if err := json.Unmarshal(dat, &hosts); err != nil {
+		return nil, err
+	}
+	adrs := make(msg.Addrs, 0, len(hosts))
+	for _, h := range hosts {
+		if err := s.CheckAddress(h, true, false); err != nil {
+			log.Println(h, err)
+			continue
+		}
+		adrs = append(adrs, *msg.NewAddr(h, msg.ServiceFull))
+	}
+	return adrs, nil
+}
+
+//ImportPeers loads the address book in DB to the default node,
+//and adds addresses in the peers file fname to it.
+//It must be called when the node is not running.
+func ImportPeers(s *setting.Setting, fname string) error {
+	if err := std.initDB(s); err != nil {
+		return err
+	}
+	return std.ImportPeers(s, fname)
+}
+
+//ImportPeers adds addresses in the peers file fname to the address book.
+func (n *Node) ImportPeers(s *setting.Setting, fname string) error {
+	adrs, err := readPeers(s, fname)
+	if err != nil {
+		return err
+	}
+	if len(adrs) == 0 {
+		return errors.New("no valid addresses in " + fname)
+	}
+	if err := n.putAddrs(s, "", adrs...); err != nil {
+		return err
+	}
+	return n.save(s)
+}
+
+//ExportPeers loads the address book in DB to the default node,
+//and writes addresses in it to the peers file fname.
+//It must be called when the node is not running.
+func ExportPeers(s *setting.Setting, fname string) error {
+	if err := std.initDB(s); err != nil {
+		return err
+	}
+	return std.ExportPeers(fname)
+}
+
+//ExportPeers writes addresses in the address book to the peers file fname.
+func (n *Node) ExportPeers(fname string) error {
+	n.nodesDB.RLock()
+	hosts := make([]string, 0, len(n.nodesDB.Addrs))
+	for adr := range n.nodesDB.Addrs {
+		hosts = append(hosts, adr)
+	}
+	n.nodesDB.RUnlock()
+	sort.Strings(hosts)
+	dat, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, dat, os.FileMode(0644))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+
+	"github.com/AidosKuneen/aklib/arypack"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+	"github.com/natefinch/lumberjack"
+)
+
+//startCapture starts recording messages if s.Capture is true.
+func (n *Node) startCapture(ctx context.Context, s *setting.Setting) {
+	if !s.Capture {
+		n.capture = nil
+		return
+	}
+	c := msg.NewCapture(&lumberjack.Logger{
+		Filename:   filepath.Join(s.BaseDir(), "capture", "capture.dat"),
+		MaxSize:    100, // megabytes
+		MaxBackups: 10,
+	})
+	n.capture = c
+	n.goWorker("capture", func() {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		<-ctx2.Done()
+		if err := c.Close(); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+//record records a message with the peer adr if capture is enabled.
+//m is a payload to be marshalled or raw payload bytes.
+func (n *Node) record(adr string, inbound bool, cmd byte, m interface{}) {
+	if n.capture == nil {
+		return
+	}
+	var dat []byte
+	switch v := m.(type) {
+	case nil:
+	case []byte:
+		dat = v
+	default:
+		dat = arypack.Marshal(m)
+	}
+	if err := n.capture.Write(adr, inbound, cmd, dat); err != nil {
+		log.Println(err)
+	}
+}
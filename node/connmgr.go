@@ -0,0 +1,215 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//backoffs for retrying an address after failures.
+const (
+	backoffMin          = 5 * time.Second
+	backoffMax          = time.Hour
+	permanentBackoffMax = 5 * time.Minute //for default_nodes
+	idleMax             = time.Minute     //max sleep when there are no addresses to dial
+)
+
+//ConnState is the state of an outbound address in the connection manager.
+type ConnState struct {
+	Address     string `json:"address"`
+	Permanent   bool   `json:"permanent"` //in default_nodes, never forgotten
+	Connected   bool   `json:"connected"`
+	Dialing     bool   `json:"dialing"`
+	Failures    int    `json:"failures"` //in a row
+	LastAttempt int64  `json:"last_attempt"`
+	LastSuccess int64  `json:"last_success"`
+	NextRetry   int64  `json:"next_retry"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+type connState struct {
+	permanent   bool
+	dialing     bool
+	failures    int
+	lastAttempt time.Time
+	lastSuccess time.Time
+	nextRetry   time.Time
+	lastError   string
+}
+
+//connManager tracks outbound addresses we dialed.
+type connManager struct {
+	addrs map[string]*connState
+	sync.Mutex
+}
+
+func (n *Node) initConnMgr(s *setting.Setting) {
+	n.connMgr.Lock()
+	defer n.connMgr.Unlock()
+	n.connMgr.addrs = make(map[string]*connState)
+	for _, adr := range s.DefaultNodes {
+		n.connMgr.addrs[adr] = &connState{
+			permanent: true,
+		}
+	}
+}
+
+//nextTarget returns an address to dial and marks it as dialing.
+//Addresses in backoff, connected ones and ones in the same group as outbound peers
+//are skipped, except for default_nodes which are exempt from the group check.
+//If not found, it returns how long to wait until an address is ready.
+func (n *Node) nextTarget() (msg.Addr, time.Duration, bool) {
+	connected := make(map[string]struct{})
+	groups := make(map[string]struct{})
+	n.peers.RLock()
+	for adr, p := range n.peers.Peers {
+		connected[adr] = struct{}{}
+		if !p.inbound {
+			groups[group(adr)] = struct{}{}
+		}
+	}
+	n.peers.RUnlock()
+
+	n.connMgr.Lock()
+	defer n.connMgr.Unlock()
+	now := time.Now()
+	wait := idleMax
+	waiting := make(map[string]struct{})
+	for adr, c := range n.connMgr.addrs {
+		if _, ok := connected[adr]; ok {
+			continue
+		}
+		if c.dialing {
+			groups[group(adr)] = struct{}{}
+			waiting[adr] = struct{}{}
+			continue
+		}
+		if d := c.nextRetry.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			waiting[adr] = struct{}{}
+			continue
+		}
+		if !c.permanent && now.Sub(c.nextRetry) > backoffMax {
+			//forgotten, the address book decides to retry.
+			delete(n.connMgr.addrs, adr)
+		}
+	}
+	var adr msg.Addr
+	found := false
+	for a, c := range n.connMgr.addrs {
+		_, ok1 := connected[a]
+		_, ok2 := waiting[a]
+		if c.permanent && !ok1 && !ok2 {
+			adr, found = *msg.NewAddr(a, msg.ServiceFull), true
+			break
+		}
+	}
+	if !found {
+		adr, found = n.pick(func(a string) bool {
+			_, ok1 := connected[a]
+			_, ok2 := waiting[a]
+			_, ok3 := groups[group(a)]
+			return ok1 || ok2 || ok3
+		})
+	}
+	if !found {
+		return msg.Addr{}, wait, false
+	}
+	c, ok := n.connMgr.addrs[adr.Address]
+	if !ok {
+		c = &connState{}
+		n.connMgr.addrs[adr.Address] = c
+	}
+	c.dialing = true
+	c.lastAttempt = now
+	return adr, 0, true
+}
+
+//dialed records the result of dialing adr.
+//Failures back off exponentially.
+func (n *Node) dialed(adr string, err error) {
+	n.connMgr.Lock()
+	defer n.connMgr.Unlock()
+	c, ok := n.connMgr.addrs[adr]
+	if !ok {
+		return
+	}
+	c.dialing = false
+	if err == nil {
+		c.failures = 0
+		c.lastError = ""
+		c.lastSuccess = time.Now()
+		c.nextRetry = time.Time{}
+		return
+	}
+	c.failures++
+	c.lastError = err.Error()
+	max := backoffMax
+	if c.permanent {
+		max = permanentBackoffMax
+	}
+	d := backoffMin
+	for i := 1; i < c.failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	c.nextRetry = time.Now().Add(d)
+}
+
+//GetConnState returns states of outbound addresses sorted by address.
+func GetConnState() []*ConnState {
+	return std.GetConnState()
+}
+
+//GetConnState returns states of outbound addresses sorted by address.
+func (n *Node) GetConnState() []*ConnState {
+	n.connMgr.Lock()
+	defer n.connMgr.Unlock()
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	r := make([]*ConnState, 0, len(n.connMgr.addrs))
+	for adr, c := range n.connMgr.addrs {
+		r = append(r, &ConnState{
+			Address:     adr,
+			Permanent:   c.permanent,
+			Connected:   n.isConnected(adr),
+			Dialing:     c.dialing,
+			Failures:    c.failures,
+			LastAttempt: unix(c.lastAttempt),
+			LastSuccess: unix(c.lastSuccess),
+			NextRetry:   unix(c.nextRetry),
+			LastError:   c.lastError,
+		})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Address < r[j].Address
+	})
+	return r
+}
@@ -87,12 +87,12 @@ func TestConsensus(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err2 := start(ctx, &s)
+	_, err2 := std.start(ctx, &s)
 	if err2 != nil {
 		t.Error(err2)
 	}
 
-	if err2 = startConsensus(ctx, &s); err2 != nil {
+	if err2 = std.startConsensus(ctx, &s); err2 != nil {
 		t.Error(err2)
 	}
 	//ignore propose
@@ -146,7 +146,7 @@ func TestConsensus(t *testing.T) {
 			if cmd != msg.CmdProposal {
 				t.Error("cmd must be proposal", cmd)
 			}
-			prop, noexist, err2 := akconsensus.ReadProposal(&s1, peers.cons, buf)
+			prop, noexist, err2 := akconsensus.ReadProposal(&s1, std.peers.cons, buf)
 			if err2 != nil {
 				t.Error(err2)
 			}
@@ -203,7 +203,7 @@ func TestConsensus(t *testing.T) {
 	if cmd != msg.CmdProposal {
 		t.Error("cmd must be proposal", cmd)
 	}
-	_, noexist, err2 := akconsensus.ReadProposal(&s1, peers.cons, buf)
+	_, noexist, err2 := akconsensus.ReadProposal(&s1, std.peers.cons, buf)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -226,7 +226,7 @@ func TestConsensus(t *testing.T) {
 	if cmd != msg.CmdValidation {
 		t.Error("cmd must be validation", cmd)
 	}
-	val, noexist, err2 := akconsensus.ReadValidation(&s1, peers.cons, buf)
+	val, noexist, err2 := akconsensus.ReadValidation(&s1, std.peers.cons, buf)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -312,7 +312,7 @@ func TestConsensus(t *testing.T) {
 	if cmd != msg.CmdProposal {
 		t.Error("cmd must be proposal", cmd)
 	}
-	prop, noexist, err2 := akconsensus.ReadProposal(&s1, peers.cons, buf)
+	prop, noexist, err2 := akconsensus.ReadProposal(&s1, std.peers.cons, buf)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -395,7 +395,7 @@ func TestConsensus(t *testing.T) {
 	if cmd != msg.CmdValidation {
 		t.Error("cmd must be validation", cmd)
 	}
-	val, noexist, err2 = akconsensus.ReadValidation(&s1, peers.cons, buf)
+	val, noexist, err2 = akconsensus.ReadValidation(&s1, std.peers.cons, buf)
 	if err2 != nil {
 		t.Error(err2)
 	}
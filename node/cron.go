@@ -27,32 +27,26 @@ import (
 	"time"
 
 	"github.com/AidosKuneen/aklib/tx"
-	"github.com/AidosKuneen/aknode/imesh"
-	"github.com/AidosKuneen/aknode/imesh/leaves"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
 )
 
-var (
-	ch     = make(chan struct{}, 2)
-	notify chan []tx.Hash
-)
-
 //Resolve run resolve routine.
 func Resolve() {
-	if len(ch) == 0 {
-		ch <- struct{}{}
-	}
+	std.Resolve()
 }
 
-//RegisterTxNotifier registers a notifier for resolved txs.
-func RegisterTxNotifier(n chan []tx.Hash) {
-	notify = n
+//Resolve run resolve routine.
+func (n *Node) Resolve() {
+	if len(n.ch) == 0 {
+		n.ch <- struct{}{}
+	}
 }
 
-func resolve(s *setting.Setting) error {
+func (n *Node) resolve(s *setting.Setting) error {
 	log.Println("resolving unresolved transactions...")
-	trs, err2 := imesh.Resolve(s)
+	trs, err2 := n.mesh.Resolve(s)
 	if err2 != nil {
 		return err2
 	}
@@ -63,33 +57,56 @@ func resolve(s *setting.Setting) error {
 		ntrs := make([]tx.Hash, 0, len(trs))
 		log.Println(" broadcasting resolved txs...")
 		inv := make(msg.Inventories, 0, len(trs))
+		var linv msg.Inventories
 		for _, h := range trs {
 			typ, err3 := msg.TxType2InvType(h.Type)
 			if err3 != nil {
 				log.Println(err3)
 				continue
 			}
-			inv = append(inv, &msg.Inventory{
-				Type: typ,
-				Hash: h.Hash.Array(),
-			})
+			local := n.takeLocal(h.Hash)
+			//txs in the stem phase are announced after embargo.
+			if !n.isStem(h.Hash) {
+				iv := &msg.Inventory{
+					Type: typ,
+					Hash: h.Hash.Array(),
+				}
+				if local {
+					linv = append(linv, iv)
+				} else {
+					inv = append(inv, iv)
+				}
+			}
 			if (h.Type == tx.TypeRewardFee && s.RunFeeMiner) ||
 				(h.Type == tx.TypeRewardTicket && s.RunTicketMiner) {
-				addForMine(h)
+				n.addForMine(h)
 			}
 			if h.Type == tx.TypeNormal {
 				ntrs = append(ntrs, h.Hash)
 			}
 		}
-		WriteAll(s, inv, msg.CmdInv)
-		if notify != nil {
-			notify <- ntrs
+		//don't flood peers with old txs during the initial sync,
+		//except peers with relay permission. Our own txs are always announced.
+		if n.isSynced() {
+			n.WriteAll(s, append(inv, linv...), msg.CmdInv)
+		} else {
+			n.writeRelay(s, inv, msg.CmdInv)
+			if len(linv) != 0 {
+				n.WriteAll(s, linv, msg.CmdInv)
+			}
+		}
+		if len(ntrs) != 0 {
+			n.Bus().Publish(&event.Event{
+				Type: event.TxResolved,
+				Txs:  ntrs,
+			})
 		}
 	}
-	ts, err2 := imesh.GetSearchingTx(s)
+	ts, err2 := n.mesh.GetSearchingTx(s)
 	if err2 != nil {
 		return err2
 	}
+	n.penaliseUnresolvable(s)
 	if len(ts) != 0 {
 		log.Println("querying non-existent", len(ts), "transactions...")
 		inv := make(msg.Inventories, 0, len(ts))
@@ -104,7 +121,7 @@ func resolve(s *setting.Setting) error {
 				Hash: tr.Hash.Array(),
 			})
 		}
-		writeGetData(s, inv)
+		n.writeGetData(s, inv)
 	}
 
 	//wait to collect noexsistence txs
@@ -113,36 +130,48 @@ func resolve(s *setting.Setting) error {
 }
 
 //GoCron starts cron jobs.
-func goCron(ctx context.Context, s *setting.Setting) {
-	go func() {
+func (n *Node) goCron(ctx context.Context, s *setting.Setting) {
+	n.goWorker("resolve", func() {
 		ctx2, cancel2 := context.WithCancel(ctx)
 		defer cancel2()
 		for {
 			select {
 			case <-ctx2.Done():
 				return
-			case <-ch:
-				if err := resolve(s); err != nil {
+			case <-n.ch:
+				if err := n.resolve(s); err != nil {
 					log.Println(err)
 				}
 			}
 		}
-	}()
+	})
 
-	go func() {
+	n.goWorker("cron-10m", func() {
 		ctx2, cancel2 := context.WithCancel(ctx)
 		defer cancel2()
-		cronSub(s)
+		n.cronSub(s)
 		for {
 			select {
 			case <-ctx2.Done():
 				return
 			case <-time.After(10 * time.Minute):
-				cronSub(s)
+				n.cronSub(s)
 			}
 		}
-	}()
-	go func() {
+	})
+	n.goWorker("ping", func() {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		for {
+			select {
+			case <-ctx2.Done():
+				return
+			case <-time.After(pingInterval):
+				n.pingAll(s)
+			}
+		}
+	})
+	n.goWorker("cron-5m", func() {
 		for {
 			ctx2, cancel2 := context.WithCancel(ctx)
 			defer cancel2()
@@ -151,22 +180,36 @@ func goCron(ctx context.Context, s *setting.Setting) {
 				case <-ctx2.Done():
 					return
 				case <-time.After(5 * time.Minute):
-					Resolve()
+					n.Resolve()
 				}
 			}
 		}
-	}()
+	})
+}
+
+//pingAll pings all peers for measuring their latencies.
+func (n *Node) pingAll(s *setting.Setting) {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	for _, p := range n.peers.Peers {
+		if err := p.ping(s); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
-func cronSub(s *setting.Setting) {
+func (n *Node) cronSub(s *setting.Setting) {
 	var lfrom msg.LeavesFrom
 
 	log.Println("querying latest leaves and node addressses..")
-	WriteAll(s, &lfrom, msg.CmdGetLeaves)
-	WriteAll(s, nil, msg.CmdGetAddr)
-	peers.RLock()
-	log.Println("#node", len(peers.Peers))
-	peers.RUnlock()
-	log.Println("#leaves", leaves.Size())
+	n.WriteAll(s, &lfrom, msg.CmdGetLeaves)
+	n.WriteAll(s, nil, msg.CmdGetAddr)
+	n.peers.RLock()
+	log.Println("#node", len(n.peers.Peers))
+	n.peers.RUnlock()
+	log.Println("#leaves", n.mesh.Leaves().Size())
+	if err := n.save(s); err != nil {
+		log.Println(err)
+	}
 	log.Println("done")
 }
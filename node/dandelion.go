@@ -0,0 +1,246 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aklib/rand"
+	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/imesh"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+const (
+	stemEpoch        = 10 * time.Minute //for changing the stem peer
+	fluffProbability = 10               //in percent, for fluffing instead of stemming at each hop
+	embargoMin       = 30 * time.Second //for fluffing by ourselves if the tx is not seen
+	embargoRandom    = 30               //in seconds, added to embargoMin randomly
+	stemExpiry       = 10 * time.Minute //for giving up unresolved stem txs
+)
+
+type stemTx struct {
+	embargo time.Time
+	added   time.Time
+}
+
+//stemSet is txs in the stem phase, which must not be announced until embargo.
+type stemSet struct {
+	txs    map[[32]byte]*stemTx
+	peer   *peer
+	chosen time.Time
+	sync.RWMutex
+}
+
+//SendTx adds a locally originated tx to imesh and relays it.
+//If dandelion is enabled, the tx is forwarded along a stem peer
+//before being announced to all peers.
+func SendTx(s *setting.Setting, tr *tx.Transaction, typ tx.Type) error {
+	return std.SendTx(s, tr, typ)
+}
+
+//SendTx adds a locally originated tx to imesh and relays it.
+//If dandelion is enabled, the tx is forwarded along a stem peer
+//before being announced to all peers.
+func (n *Node) SendTx(s *setting.Setting, tr *tx.Transaction, typ tx.Type) error {
+	n.addLocal(tr.Hash())
+	var err error
+	if typ != tx.TypeNormal {
+		if err = n.mesh.CheckAddTx(s, tr, typ); err == nil {
+			n.Resolve()
+		}
+	} else {
+		err = n.relay(s, nil, tr, s.Dandelion)
+	}
+	if err != nil {
+		n.takeLocal(tr.Hash())
+	}
+	return err
+}
+
+//relay adds tr received from p (nil if local) to imesh.
+//If stemming, tr is forwarded to the stem peer and is not announced until embargo.
+//If there are no peers to forward, tr is announced normally.
+func (n *Node) relay(s *setting.Setting, from *peer, tr *tx.Transaction, stemming bool) error {
+	var sp *peer
+	if stemming {
+		if sp = n.stemPeer(from); sp == nil {
+			log.Println("no stem peer, fluffing")
+		}
+	}
+	h := tr.Hash().Array()
+	if sp != nil {
+		//must be embargoed before resolving.
+		now := time.Now()
+		n.stems.Lock()
+		n.stems.txs[h] = &stemTx{
+			embargo: now.Add(embargoMin + time.Duration(rand.R.Intn(embargoRandom))*time.Second),
+			added:   now,
+		}
+		n.stems.Unlock()
+	}
+	if err := n.mesh.CheckAddTx(s, tr, tx.TypeNormal); err != nil {
+		n.fluffed(h)
+		return err
+	}
+	if sp != nil {
+		txs := msg.Txs{
+			&msg.Tx{
+				Type: msg.InvTxNormal,
+				Tx:   tr,
+			},
+		}
+		if err := sp.write(s, txs, msg.CmdStemTx); err != nil {
+			log.Println(err)
+		}
+	}
+	n.Resolve()
+	return nil
+}
+
+//stemPeer returns the stem peer for this epoch, which must not be from.
+func (n *Node) stemPeer(from *peer) *peer {
+	n.stems.Lock()
+	defer n.stems.Unlock()
+	if p := n.stems.peer; p != nil && p != from &&
+		time.Since(n.stems.chosen) < stemEpoch && n.isConnectedPeer(p) {
+		return p
+	}
+	var ps []*peer
+	n.peers.RLock()
+	for _, p := range n.peers.Peers {
+		if !p.inbound && p != from && p.supports(msg.CmdStemTx) {
+			ps = append(ps, p)
+		}
+	}
+	n.peers.RUnlock()
+	if len(ps) == 0 {
+		return nil
+	}
+	n.stems.peer = ps[rand.R.Intn(len(ps))]
+	n.stems.chosen = time.Now()
+	return n.stems.peer
+}
+
+func (n *Node) isConnectedPeer(p *peer) bool {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	return n.peers.Peers[p.remote.Address] == p
+}
+
+//readStemTx handles a stem tx from p,
+//which is forwarded to the stem peer or fluffed with fluffProbability.
+func (p *peer) readStemTx(s *setting.Setting, buf []byte) error {
+	n := p.node
+	vs, err := msg.ReadTxs(buf)
+	if err != nil {
+		return p.misbehave(s, readOffence(err), err)
+	}
+	if len(vs) != 1 || vs[0].Type != msg.InvTxNormal {
+		return p.misbehave(s, offMalformed, errors.New("stem must be a normal tx"))
+	}
+	tr := vs[0].Tx
+	if err := tr.Check(s.Config, tx.TypeNormal); err != nil {
+		return p.misbehave(s, offInvalidTx, err)
+	}
+	has, err := imesh.Has(s.DB, tr.Hash())
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if has || n.isStem(tr.Hash()) {
+		return nil
+	}
+	stemming := s.Dandelion && rand.R.Intn(100) >= fluffProbability
+	if err := n.relay(s, p, tr, stemming); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+//isStem returns true if the tx h is in the stem phase.
+func (n *Node) isStem(h tx.Hash) bool {
+	n.stems.RLock()
+	defer n.stems.RUnlock()
+	_, ok := n.stems.txs[h.Array()]
+	return ok
+}
+
+//fluffed removes h from stem txs because someone announced it or it is invalid.
+func (n *Node) fluffed(h [32]byte) {
+	n.stems.Lock()
+	defer n.stems.Unlock()
+	delete(n.stems.txs, h)
+}
+
+//goFluff announces stem txs whose embargoes are expired,
+//in case the stem was lost.
+func (n *Node) goFluff(ctx context.Context, s *setting.Setting) {
+	n.goWorker("fluff", func() {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		for {
+			select {
+			case <-ctx2.Done():
+				return
+			case <-time.After(5 * time.Second):
+				n.fluffExpired(s)
+			}
+		}
+	})
+}
+
+func (n *Node) fluffExpired(s *setting.Setting) {
+	now := time.Now()
+	var inv msg.Inventories
+	n.stems.Lock()
+	for h, st := range n.stems.txs {
+		if st.embargo.After(now) {
+			continue
+		}
+		has, err := imesh.Has(s.DB, h[:])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !has {
+			if now.Sub(st.added) > stemExpiry {
+				delete(n.stems.txs, h)
+			}
+			continue
+		}
+		log.Println("embargo expired, fluffing", h)
+		delete(n.stems.txs, h)
+		inv = append(inv, &msg.Inventory{
+			Type: msg.InvTxNormal,
+			Hash: h,
+		})
+	}
+	n.stems.Unlock()
+	if len(inv) != 0 {
+		n.WriteAll(s, inv, msg.CmdInv)
+	}
+}
@@ -21,7 +21,10 @@
 package node
 
 import (
-	"errors"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,103 +35,420 @@ import (
 	"github.com/dgraph-io/badger"
 )
 
-const maxAddrs = 1000
+//Addresses are kept in two tables, like bitcoin's addrman:
+//"new" for addresses we heard of but never connected to, and
+//"tried" for addresses we connected to successfully.
+//Each table is split into buckets chosen by a keyed hash, and addresses
+//from one source group can only fill a few new buckets,
+//so a single peer cannot flood the table with its addresses.
+const (
+	newBuckets           = 64
+	triedBuckets         = 16
+	bucketSize           = 16
+	newBucketsPerSource  = 8
+	triedBucketsPerGroup = 4
 
-type adrmap map[string]msg.Addr
+	//addresses which are not seen for addrHorizon are forgotten.
+	addrHorizon = 30 * 24 * time.Hour
+	//addresses which failed maxAttempts times in a row are forgotten.
+	maxAttempts = 10
+	//addresses which were never connected are forgotten after maxNewAttempts failures.
+	maxNewAttempts = 3
+)
+
+//addrBookKey is the key for the address book under db.HeaderNodeIP.
+var addrBookKey = []byte("addrbook")
+
+//knownAddr is an address with its history.
+type knownAddr struct {
+	Addr        msg.Addr
+	Source      string //group of the node which told us the address
+	Tried       bool   //in the tried table
+	Bucket      int
+	LastSeen    time.Time //last time the address was advertised or connected
+	LastSuccess time.Time //last time we connected to the address
+	LastAttempt time.Time
+	Attempts    int //failed attempts since the last success
+}
 
-var nodesDB = struct {
+type adrmap map[string]*knownAddr
+
+type addrBook struct {
+	Key   [32]byte //secret key for choosing buckets
 	Addrs adrmap
-	sync.RWMutex
-}{
-	Addrs: make(adrmap),
 }
 
-var verNonce uint64
+//nodeDB is the address book with its lock.
+//Changes are stored into DB by save, not at every change.
+type nodeDB struct {
+	addrBook
+	dirty bool
+	sync.RWMutex
+}
 
 //Init loads node IP addresses from DB.
-func initDB(s *setting.Setting) error {
-	nodesDB.Addrs = make(adrmap)
+func (n *Node) initDB(s *setting.Setting) error {
+	n.nodesDB.Addrs = make(adrmap)
 	//peers is a slice of connecting peers.
-	peers.Peers = make(map[string]*peer)
-	peers.banned = make(map[string]time.Time)
+	n.peers.Peers = make(map[string]*peer)
+	n.peers.scores = make(map[string]*score)
+	err := n.loadBanned(s)
+	if err != nil {
+		return err
+	}
 
-	err := s.DB.View(func(txn *badger.Txn) error {
-		return db.Get(txn, nil, &nodesDB.Addrs, db.HeaderNodeIP)
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	err = s.DB.View(func(txn *badger.Txn) error {
+		return db.Get(txn, addrBookKey, &n.nodesDB.addrBook, db.HeaderNodeIP)
 	})
-	if err != nil && err != badger.ErrKeyNotFound {
+	migrated := false
+	switch {
+	case err == badger.ErrKeyNotFound:
+		if _, err := rand.R.Read(n.nodesDB.Key[:]); err != nil {
+			return err
+		}
+		//addresses stored by older versions.
+		var old map[string]msg.Addr
+		err = s.DB.View(func(txn *badger.Txn) error {
+			return db.Get(txn, nil, &old, db.HeaderNodeIP)
+		})
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		migrated = err == nil
+		for _, adr := range old {
+			n.nodesDB.add(s, "", adr)
+		}
+	case err != nil:
 		return err
 	}
-	for _, n := range s.DefaultNodes {
-		nodesDB.Addrs[n] = *msg.NewAddr(n, msg.ServiceFull)
+	if n.nodesDB.Addrs == nil {
+		n.nodesDB.Addrs = make(adrmap)
+	}
+	for _, adr := range s.DefaultNodes {
+		n.nodesDB.add(s, "", *msg.NewAddr(adr, msg.ServiceFull))
 	}
-	for adr := range nodesDB.Addrs {
+	for adr := range n.nodesDB.Addrs {
 		if s.InBlacklist(adr) {
-			delete(nodesDB.Addrs, adr)
+			delete(n.nodesDB.Addrs, adr)
 		}
 	}
-	verNonce = rand.R.Uint64()
-	return nil
+	n.verNonce = rand.R.Uint64()
+	return s.DB.Update(func(txn *badger.Txn) error {
+		if migrated {
+			if err := db.Del(txn, nil, db.HeaderNodeIP); err != nil {
+				return err
+			}
+		}
+		n.nodesDB.dirty = false
+		return db.Put(txn, addrBookKey, &n.nodesDB.addrBook, db.HeaderNodeIP)
+	})
 }
 
-//Get returns random n numbers of nodes.
-//mutex Rlocked
-func get(n int) []msg.Addr {
-	nodesDB.RLock()
-	defer nodesDB.RUnlock()
-	r := make([]msg.Addr, len(nodesDB.Addrs))
-	i := 0
-	for _, a := range nodesDB.Addrs {
-		r[i] = a
-		i++
+//group returns the network group of adr, /16 for IPv4 and /32 for IPv6.
+func group(adr string) string {
+	h, _, err := net.SplitHostPort(adr)
+	if err == nil {
+		adr = h
+	}
+	ip := net.ParseIP(adr)
+	if ip == nil {
+		return adr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+//hash returns a keyed hash of strs.
+func (b *addrBook) hash(strs ...string) uint64 {
+	dat := append([]byte{}, b.Key[:]...)
+	for _, str := range strs {
+		dat = append(dat, str...)
+		dat = append(dat, 0)
+	}
+	h := sha256.Sum256(dat)
+	return binary.LittleEndian.Uint64(h[:])
+}
+
+//newBucket returns a bucket in the new table for adr told by src group.
+//Addresses from one source group go into at most newBucketsPerSource buckets.
+func (b *addrBook) newBucket(adr, src string) int {
+	n := b.hash(group(adr), src) % newBucketsPerSource
+	return int(b.hash(src, strconv.FormatUint(n, 10)) % newBuckets)
+}
+
+//triedBucket returns a bucket in the tried table for adr.
+//Addresses in one group go into at most triedBucketsPerGroup buckets.
+func (b *addrBook) triedBucket(adr string) int {
+	n := b.hash(adr) % triedBucketsPerGroup
+	return int(b.hash(group(adr), strconv.FormatUint(n, 10)) % triedBuckets)
+}
+
+//isTerrible returns true if k is not worth keeping.
+func (k *knownAddr) isTerrible(now time.Time) bool {
+	if now.Sub(k.LastAttempt) < time.Minute {
+		return false
+	}
+	if now.Sub(k.LastSeen) > addrHorizon {
+		return true
+	}
+	if k.LastSuccess.IsZero() && k.Attempts >= maxNewAttempts {
+		return true
+	}
+	return k.Attempts >= maxAttempts
+}
+
+//chance returns a relative chance of k to be selected.
+func (k *knownAddr) chance(now time.Time) float64 {
+	c := 1.0
+	if now.Sub(k.LastAttempt) < 10*time.Minute {
+		c *= 0.01
+	}
+	for i := 0; i < k.Attempts && i < 8; i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+//bucketed returns addresses in the bucket of the table.
+func (b *addrBook) bucketed(tried bool, bucket int) []*knownAddr {
+	var r []*knownAddr
+	for _, k := range b.Addrs {
+		if k.Tried == tried && k.Bucket == bucket {
+			r = append(r, k)
+		}
+	}
+	return r
+}
+
+//makeRoom evicts a terrible or the oldest address from the bucket if it is full.
+//An address evicted from the tried table goes back to the new table.
+func (b *addrBook) makeRoom(tried bool, bucket int, now time.Time) {
+	ks := b.bucketed(tried, bucket)
+	if len(ks) < bucketSize {
+		return
 	}
+	var oldest *knownAddr
+	for _, k := range ks {
+		if k.isTerrible(now) {
+			delete(b.Addrs, k.Addr.Address)
+			return
+		}
+		if oldest == nil || k.LastSeen.Before(oldest.LastSeen) {
+			oldest = k
+		}
+	}
+	if !tried {
+		delete(b.Addrs, oldest.Addr.Address)
+		return
+	}
+	nb := b.newBucket(oldest.Addr.Address, oldest.Source)
+	b.makeRoom(false, nb, now)
+	oldest.Tried = false
+	oldest.Bucket = nb
+}
 
-	for j := i - 1; j >= 0; j-- {
+//add adds adr told by src into the new table.
+//locked by mutex(nodesDB)
+func (b *addrBook) add(s *setting.Setting, src string, adr msg.Addr) {
+	if s.InBlacklist(adr.Address) {
+		return
+	}
+	now := time.Now()
+	seen := time.Unix(adr.Time, 0)
+	if adr.Time == 0 || seen.After(now.Add(10*time.Minute)) {
+		seen = now.Add(-5 * 24 * time.Hour)
+	}
+	if src != "" && !seen.Before(now.Add(-2*time.Hour)) {
+		//relayed addresses are less reliable.
+		seen = seen.Add(-2 * time.Hour)
+	}
+	adr.Time = 0
+	if k, ok := b.Addrs[adr.Address]; ok {
+		if seen.After(k.LastSeen) {
+			k.LastSeen = seen
+		}
+		k.Addr.Service |= adr.Service
+		return
+	}
+	if now.Sub(seen) > addrHorizon {
+		return
+	}
+	k := &knownAddr{
+		Addr:     adr,
+		Source:   group(src),
+		LastSeen: seen,
+	}
+	k.Bucket = b.newBucket(adr.Address, k.Source)
+	b.makeRoom(false, k.Bucket, now)
+	b.Addrs[adr.Address] = k
+}
+
+//Get returns random n numbers of good nodes.
+//mutex Rlocked
+func (n *Node) get(max int) []msg.Addr {
+	n.nodesDB.RLock()
+	defer n.nodesDB.RUnlock()
+	now := time.Now()
+	r := make([]msg.Addr, 0, len(n.nodesDB.Addrs))
+	for _, k := range n.nodesDB.Addrs {
+		if k.isTerrible(now) {
+			continue
+		}
+		a := k.Addr
+		a.Time = k.LastSeen.Unix()
+		r = append(r, a)
+	}
+	for j := len(r) - 1; j >= 0; j-- {
 		k := rand.R.Intn(j + 1)
 		r[j], r[k] = r[k], r[j]
 	}
-	if n >= i || n <= 0 {
+	if max >= len(r) || max <= 0 {
 		return r
 	}
-	return r[:n]
+	return r[:max]
 }
 
-//Remove removes address from list.
+//pick selects an address to connect, biased to tried and recently successful ones.
+//mutex Rlocked
+func (n *Node) pick(exclude func(string) bool) (msg.Addr, bool) {
+	n.nodesDB.RLock()
+	defer n.nodesDB.RUnlock()
+	now := time.Now()
+	var tried, fresh []*knownAddr
+	for _, k := range n.nodesDB.Addrs {
+		if now.Sub(k.LastAttempt) < time.Minute || exclude(k.Addr.Address) {
+			continue
+		}
+		if k.Tried {
+			tried = append(tried, k)
+		} else {
+			fresh = append(fresh, k)
+		}
+	}
+	table := fresh
+	if len(tried) != 0 && (len(fresh) == 0 || rand.R.Intn(2) == 0) {
+		table = tried
+	}
+	if len(table) == 0 {
+		return msg.Addr{}, false
+	}
+	for factor := 1.0; ; factor *= 1.2 {
+		k := table[rand.R.Intn(len(table))]
+		if rand.R.Float64() < factor*k.chance(now) {
+			return k.Addr, true
+		}
+	}
+}
+
+//attempt records an attempt to connect to adr.
 //mutex locked
-func remove(s *setting.Setting, addr msg.Addr) error {
-	nodesDB.Lock()
-	defer nodesDB.Unlock()
-	if _, e := nodesDB.Addrs[addr.Address]; !e {
-		return errors.New("not found")
+func (n *Node) attempt(s *setting.Setting, adr msg.Addr) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	k, ok := n.nodesDB.Addrs[adr.Address]
+	if !ok {
+		return nil
+	}
+	k.LastAttempt = time.Now()
+	k.Attempts++
+	if k.Attempts >= maxAttempts {
+		delete(n.nodesDB.Addrs, adr.Address)
 	}
-	delete(nodesDB.Addrs, addr.Address)
-	return put(s)
+	n.nodesDB.dirty = true
+	return nil
 }
 
-//Put put an address into db.
+//good moves adr into the tried table after connecting to it successfully.
 //mutex locked
-func putAddrs(s *setting.Setting, addrs ...msg.Addr) error {
-	nodesDB.Lock()
-	defer nodesDB.Unlock()
-	if len(nodesDB.Addrs) > msg.MaxAddrs {
+func (n *Node) good(s *setting.Setting, adr msg.Addr) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	now := time.Now()
+	k, ok := n.nodesDB.Addrs[adr.Address]
+	if !ok {
+		n.nodesDB.add(s, "", adr)
+		if k, ok = n.nodesDB.Addrs[adr.Address]; !ok {
+			return nil
+		}
+	}
+	k.LastSeen = now
+	k.LastSuccess = now
+	k.LastAttempt = now
+	k.Attempts = 0
+	if !k.Tried {
+		b := n.nodesDB.triedBucket(adr.Address)
+		n.nodesDB.makeRoom(true, b, now)
+		k.Tried = true
+		k.Bucket = b
+	}
+	n.nodesDB.dirty = true
+	return nil
+}
+
+//seen updates the last seen time of adr when disconnected.
+//mutex locked
+func (n *Node) seen(s *setting.Setting, adr msg.Addr) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	k, ok := n.nodesDB.Addrs[adr.Address]
+	if !ok {
+		return nil
+	}
+	k.LastSeen = time.Now()
+	n.nodesDB.dirty = true
+	return nil
+}
+
+//Remove removes address from list.
+//mutex locked
+func (n *Node) remove(s *setting.Setting, addr msg.Addr) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	if _, e := n.nodesDB.Addrs[addr.Address]; !e {
 		return nil
 	}
+	delete(n.nodesDB.Addrs, addr.Address)
+	n.nodesDB.dirty = true
+	return nil
+}
+
+//Put put addresses told by src into the address book.
+//mutex locked
+func (n *Node) putAddrs(s *setting.Setting, src string, addrs ...msg.Addr) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
 	for _, addr := range addrs {
-		if s.InBlacklist(addr.Address) {
-			continue
-		}
-		if len(nodesDB.Addrs) > maxAddrs {
-			continue
-		}
-		if _, e := nodesDB.Addrs[addr.Address]; !e {
-			nodesDB.Addrs[addr.Address] = addr
-		}
+		n.nodesDB.add(s, src, addr)
 	}
-	return put(s)
+	n.nodesDB.dirty = true
+	return nil
 }
 
-//locked by mutex(nodesDB)
-func put(s *setting.Setting) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
-		return db.Put(txn, nil, nodesDB.Addrs, db.HeaderNodeIP)
+//addrSize returns the number of known addresses.
+//mutex Rlocked
+func (n *Node) addrSize() int {
+	n.nodesDB.RLock()
+	defer n.nodesDB.RUnlock()
+	return len(n.nodesDB.Addrs)
+}
+
+//save stores the address book into DB if changed.
+//mutex locked
+func (n *Node) save(s *setting.Setting) error {
+	n.nodesDB.Lock()
+	defer n.nodesDB.Unlock()
+	if !n.nodesDB.dirty {
+		return nil
+	}
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		return db.Put(txn, addrBookKey, &n.nodesDB.addrBook, db.HeaderNodeIP)
 	})
+	if err == nil {
+		n.nodesDB.dirty = false
+	}
+	return err
 }
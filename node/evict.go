@@ -0,0 +1,115 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+//numbers of inbound peers protected from eviction by each criterion.
+const (
+	protectLatency = 4
+	protectUseful  = 4
+)
+
+//countPeers returns numbers of inbound and outbound peers.
+//peers must be locked by caller.
+func (n *Node) countPeers() (int, int) {
+	in := 0
+	for _, p := range n.peers.Peers {
+		if p.inbound {
+			in++
+		}
+	}
+	return in, len(n.peers.Peers) - in
+}
+
+func (p *peer) markUseful() {
+	p.Lock()
+	defer p.Unlock()
+	p.useful = time.Now()
+}
+
+type evictStat struct {
+	p         *peer
+	rtt       time.Duration
+	useful    time.Time
+	connected time.Time
+}
+
+//evictCandidate returns an inbound peer to be evicted for a new inbound peer,
+//or nil if all inbound peers are protected.
+//Peers with lowest latency, peers which delivered new txs or validations recently,
+//and then a half of remaining peers which connected longest are protected,
+//and the newest one of the rest is the candidate.
+//Whitelisted peers are never evicted.
+//peers must be locked by caller.
+func (n *Node) evictCandidate() *peer {
+	cands := make([]*evictStat, 0, len(n.peers.Peers))
+	for _, p := range n.peers.Peers {
+		if !p.inbound || p.whitelisted {
+			continue
+		}
+		p.RLock()
+		//peers which never answered a ping are regarded as the slowest.
+		rtt := p.minRTT
+		if rtt == 0 {
+			rtt = math.MaxInt64
+		}
+		cands = append(cands, &evictStat{
+			p:         p,
+			rtt:       rtt,
+			useful:    p.useful,
+			connected: p.connected,
+		})
+		p.RUnlock()
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].rtt < cands[j].rtt
+	})
+	cands = protect(cands, protectLatency)
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].useful.After(cands[j].useful)
+	})
+	useful := 0
+	for useful < len(cands) && useful < protectUseful && !cands[useful].useful.IsZero() {
+		useful++
+	}
+	cands = protect(cands, useful)
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].connected.Before(cands[j].connected)
+	})
+	cands = protect(cands, len(cands)/2)
+	if len(cands) == 0 {
+		return nil
+	}
+	return cands[len(cands)-1].p
+}
+
+//protect removes first n candidates.
+func protect(cands []*evictStat, n int) []*evictStat {
+	if n > len(cands) {
+		n = len(cands)
+	}
+	return cands[n:]
+}
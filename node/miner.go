@@ -30,21 +30,18 @@ import (
 	"github.com/AidosKuneen/aklib/address"
 	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/imesh"
-	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/setting"
 )
 
-var mineCh chan *tx.HashWithType
-
 //AddForMine adds a minable tx for mine.
-func addForMine(tr *tx.HashWithType) {
-	if len(mineCh) != 0 {
-		<-mineCh
+func (n *Node) addForMine(tr *tx.HashWithType) {
+	if len(n.mineCh) != 0 {
+		<-n.mineCh
 	}
-	mineCh <- tr
+	n.mineCh <- tr
 }
 
-func mine(s *setting.Setting, mtx *tx.HashWithType) error {
+func (n *Node) mine(s *setting.Setting, mtx *tx.HashWithType) error {
 	tr, err := imesh.GetMinableTx(s, mtx.Hash, mtx.Type)
 	if err != nil {
 		return err
@@ -68,41 +65,47 @@ func mine(s *setting.Setting, mtx *tx.HashWithType) error {
 	if err := tr.PoW(); err != nil {
 		return err
 	}
-	if err := imesh.CheckAddTx(s, tr, tx.TypeNormal); err != nil {
+	if err := n.mesh.CheckAddTx(s, tr, tx.TypeNormal); err != nil {
 		return err
 	}
-	Resolve()
+	n.Resolve()
 	log.Println("succeeded to mine, txid=", hex.EncodeToString(tr.Hash()))
 	return nil
 }
 
-func issueTicket(ctx context.Context, s *setting.Setting) error {
+func (n *Node) issueTicket(ctx context.Context, s *setting.Setting) error {
 	madr, _, err := address.ParseAddress58(s.Config, s.MinerAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
-	tr, err := tx.IssueTicket(ctx, s.Config, madr, leaves.Get(0)...)
+	tr, err := tx.IssueTicket(ctx, s.Config, madr, n.mesh.Leaves().Get(0)...)
 	if err != nil {
 		log.Println(err)
 	}
-	if err := imesh.CheckAddTx(s, tr, tx.TypeNormal); err != nil {
+	if err := n.mesh.CheckAddTx(s, tr, tx.TypeNormal); err != nil {
 		log.Println(err)
 	}
-	Resolve()
+	n.Resolve()
 	log.Println("ticket issued,", tr.Hash())
 	return nil
 }
 
 //RunMiner runs a miner
 func RunMiner(ctx context.Context, s *setting.Setting) {
-	mineCh = make(chan *tx.HashWithType, 1)
+	std.RunMiner(ctx, s)
+}
+
+//RunMiner runs a miner
+func (n *Node) RunMiner(ctx context.Context, s *setting.Setting) {
+	n.mineCh = make(chan *tx.HashWithType, 1)
+	ctx = n.withCancel(ctx)
 
 	if s.RunTicketIssuer {
-		go func() {
+		n.goWorker("ticket issuer", func() {
 			ctx2, cancel2 := context.WithCancel(ctx)
 			defer cancel2()
 			for {
-				if err := issueTicket(ctx, s); err != nil {
+				if err := n.issueTicket(ctx, s); err != nil {
 					log.Println(err)
 				}
 				select {
@@ -111,22 +114,22 @@ func RunMiner(ctx context.Context, s *setting.Setting) {
 				default:
 				}
 			}
-		}()
+		})
 	}
 
-	go func() {
+	n.goWorker("miner", func() {
 		ctx2, cancel2 := context.WithCancel(ctx)
 		defer cancel2()
 		for {
 			select {
 			case <-ctx2.Done():
 				return
-			case h := <-mineCh:
-				if err := mine(s, h); err != nil {
+			case h := <-n.mineCh:
+				if err := n.mine(s, h); err != nil {
 					log.Println(err)
 				}
 			}
 		}
-	}()
+	})
 
 }
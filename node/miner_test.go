@@ -48,7 +48,7 @@ func TestMiner(t *testing.T) {
 		t.Error(err)
 	}
 
-	l, err2 := start(ctx, &s)
+	l, err2 := std.start(ctx, &s)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -26,19 +26,89 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"strconv"
 	"time"
 
-	"golang.org/x/net/proxy"
-
+	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
+	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
 	"github.com/AidosKuneen/consensus"
 )
 
-func readVersion(s *setting.Setting, conn *net.TCPConn, nonce uint64) (*peer, error) {
-	cmd, buf, err := msg.ReadHeader(s, conn)
+//Node is a node of the network with its peers, known addresses
+//and routines, which runs on an iMesh and consensus.
+type Node struct {
+	totals    netTotals //must be first for atomic operations
+	s         *setting.Setting
+	mesh      *imesh.Mesh
+	cons      *akconsensus.Consensus
+	transport Transport //used instead of TCP if not nil
+	capture   *msg.Capture
+	verNonce  uint64
+	ch        chan struct{}
+	mineCh    chan *tx.HashWithType
+	peers     peerSet
+	notFound  notFoundSet
+	nodesDB   nodeDB
+	connMgr   connManager
+	stems     stemSet
+	syncer    syncStatus
+	workers   workerSet
+	bandwidth bandwidth
+	sources   []*bootstrapSource
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+//std is the default Node for package functions.
+var std = New(nil, imesh.Default(), akconsensus.Default())
+
+//New returns a Node with setting s, which runs on iMesh m and consensus c.
+func New(s *setting.Setting, m *imesh.Mesh, c *akconsensus.Consensus) *Node {
+	n := &Node{
+		s:    s,
+		mesh: m,
+		cons: c,
+		ch:   make(chan struct{}, 2),
+	}
+	n.peers.Peers = make(map[string]*peer)
+	n.peers.banned = make(map[string]*Ban)
+	n.peers.scores = make(map[string]*score)
+	n.notFound.hosts = make(map[[32]byte]map[string]time.Time)
+	n.nodesDB.Addrs = make(adrmap)
+	n.connMgr.addrs = make(map[string]*connState)
+	n.stems.txs = make(map[[32]byte]*stemTx)
+	n.syncer.state = syncSynced
+	n.syncer.requested = make(map[[32]byte]time.Time)
+	n.syncer.locals = make(map[[32]byte]struct{})
+	n.workers.running = make(map[string]int)
+	n.initBootstrap()
+	return n
+}
+
+//Default returns the default Node used by package functions.
+func Default() *Node {
+	return std
+}
+
+//Mesh returns the iMesh of the Node.
+func (n *Node) Mesh() *imesh.Mesh {
+	return n.mesh
+}
+
+//Consensus returns the consensus of the Node.
+func (n *Node) Consensus() *akconsensus.Consensus {
+	return n.cons
+}
+
+//Bus returns the event bus of the Node, which is shared with its consensus.
+func (n *Node) Bus() *event.Bus {
+	return n.cons.Bus()
+}
+
+func (n *Node) readVersion(s *setting.Setting, conn net.Conn, r *msg.Reader, nonce uint64) (*peer, error) {
+	cmd, buf, err := r.ReadHeader(s)
 	if err != nil {
 		return nil, err
 	}
@@ -49,120 +119,101 @@ func readVersion(s *setting.Setting, conn *net.TCPConn, nonce uint64) (*peer, er
 	if err != nil {
 		return nil, err
 	}
-	p, err := newPeer(v, conn, s)
+	p, err := n.newPeer(v, conn, s)
 	if err != nil {
 		return nil, err
 	}
+	p.reader = r
+	r.SetVersion(p.version)
+	n.record(p.remote.Address, true, cmd, buf)
+	n.record(p.remote.Address, false, msg.CmdVerack, nil)
 	return p, msg.Write(s, nil, msg.CmdVerack, conn)
 }
 
-func writeVersion(s *setting.Setting, to msg.Addr, conn *net.TCPConn, nonce uint64) error {
+func (n *Node) writeVersion(s *setting.Setting, to msg.Addr, conn net.Conn, r *msg.Reader, nonce uint64) error {
 	v := msg.NewVersion(s, to, nonce)
+	n.record(to.Address, false, msg.CmdVersion, v)
 	if err := msg.Write(s, v, msg.CmdVersion, conn); err != nil {
 		log.Println(err)
 		return err
 	}
 
-	cmd, _, err := msg.ReadHeader(s, conn)
+	cmd, _, err := r.ReadHeader(s)
 	if err != nil {
 		return err
 	}
+	n.record(to.Address, true, cmd, nil)
 	if cmd != msg.CmdVerack {
 		return errors.New("message must be verack after Version")
 	}
 	return nil
 }
 
-func lookup(s *setting.Setting) error {
-	if len(nodesDB.Addrs) < int(s.MaxConnections) {
-		log.Println("looking for DNS...")
-		var adrs msg.Addrs
-		log.Println("found:")
-		for _, d := range s.Config.DNS {
-			_, addrs, err := net.LookupSRV(d.Service, "tcp", d.Name)
-			if err != nil {
-				return err
-			}
-			for _, n := range addrs {
-				adr := net.JoinHostPort(n.Target, strconv.Itoa(int(s.Config.DefaultPort)))
-				log.Println(adr)
-				adrs = append(adrs, *msg.NewAddr(adr, msg.ServiceFull))
-			}
-		}
-		if err := putAddrs(s, adrs...); err != nil {
-			return err
+func (n *Node) connectSub(ctx context.Context, s *setting.Setting, tr Transport) error {
+	p, wait, found := n.nextTarget()
+	if !found {
+		log.Println("no addresses to connect, sleeping", wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
 		}
+		return nil
 	}
-	log.Println("from DNS")
-	return nil
-}
-
-func connectSub(ctx context.Context, s *setting.Setting, dialer func(string, string) (net.Conn, error)) error {
-	var p msg.Addr
-	found := false
-	for _, p = range get(0) {
-		if !isConnected(p.Address) {
-			found = true
-			break
-		}
+	if err := n.attempt(s, p); err != nil {
+		log.Println(err)
 	}
-	if !found {
-		log.Println("no other peers found from peer, sleeping")
-		time.Sleep(time.Minute)
-		return nil
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	pr, err := n.dial(ctx2, s, tr, p)
+	n.dialed(p.Address, err)
+	if err != nil {
+		return err
 	}
-	if err := remove(s, p); err != nil {
+	if err := n.good(s, p); err != nil {
 		log.Println(err)
 	}
+	log.Println("connected to", p.Address)
+	pr.run(s)
+	return nil
+}
 
-	conn, err3 := dialer("tcp", p.Address)
+//dial connects to p and handshakes. The connection is closed when ctx is done.
+func (n *Node) dial(ctx context.Context, s *setting.Setting, tr Transport, p msg.Addr) (*peer, error) {
+	conn, err3 := tr.Dial(p.Address)
 	if err3 != nil {
-		return err3
-	}
-	tcpconn, ok := conn.(*net.TCPConn)
-	if !ok {
-		log.Fatal("invalid connection")
+		return nil, err3
 	}
-	ctx2, cancel2 := context.WithCancel(ctx)
-	defer cancel2()
 	go func() {
-		<-ctx2.Done()
-		if err := tcpconn.Close(); err != nil {
+		<-ctx.Done()
+		if err := conn.Close(); err != nil {
 			log.Println(err)
 		}
 	}()
-	if err := tcpconn.SetDeadline(time.Now().Add(rwTimeout)); err != nil {
-		return err
+	if err := conn.SetDeadline(time.Now().Add(rwTimeout)); err != nil {
+		return nil, err
 	}
-	if err := writeVersion(s, p, tcpconn, verNonce); err != nil {
-		return err
+	r := msg.NewReader(conn)
+	if err := n.writeVersion(s, p, conn, r, n.verNonce); err != nil {
+		return nil, err
 	}
-	pr, err3 := readVersion(s, tcpconn, verNonce)
+	pr, err3 := n.readVersion(s, conn, r, n.verNonce)
 	if err3 != nil {
-		return err3
+		return nil, err3
 	}
 	if err := pr.add(s); err != nil {
-		return err
-	}
-	if err := putAddrs(s, p); err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	log.Println("connected to", p.Address)
-	pr.run(s)
-	return nil
+	return pr, nil
 }
 
-func connect(ctx context.Context, s *setting.Setting) {
-	dialer := net.Dial
-	if s.Proxy != "" {
-		p, err2 := proxy.SOCKS5("tcp", s.Proxy, nil, proxy.Direct)
-		if err2 != nil {
-			log.Fatal(err2)
-		}
-		dialer = p.Dial
+func (n *Node) connect(ctx context.Context, s *setting.Setting) error {
+	tr, err := n.getTransport(s)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < int(s.MaxConnections); i++ {
-		go func(i int) {
+	n.initConnMgr(s)
+	for i := 0; i < int(s.MaxOutbound); i++ {
+		n.goWorker("connect", func() {
 			ctx2, cancel2 := context.WithCancel(ctx)
 			defer cancel2()
 			for {
@@ -170,22 +221,32 @@ func connect(ctx context.Context, s *setting.Setting) {
 				case <-ctx2.Done():
 					return
 				default:
-					if err := connectSub(ctx, s, dialer); err != nil {
+					if err := n.connectSub(ctx, s, tr); err != nil {
 						log.Println(err)
 					}
 				}
 			}
-		}(i)
+		})
+	}
+	return nil
+}
+
+//getTransport returns the transport set by SetTransport,
+//or TCP through the proxy in setting.
+func (n *Node) getTransport(s *setting.Setting) (Transport, error) {
+	if n.transport != nil {
+		return n.transport, nil
 	}
+	return NewTransport("tcp", s.Proxy)
 }
 
-func start(ctx context.Context, setting *setting.Setting) (*net.TCPListener, error) {
+func (n *Node) start(ctx context.Context, setting *setting.Setting) (net.Listener, error) {
 	ipport := fmt.Sprintf("%s:%d", setting.Bind, setting.Port)
-	tcpAddr, err2 := net.ResolveTCPAddr("tcp", ipport)
+	tr, err2 := n.getTransport(setting)
 	if err2 != nil {
 		return nil, err2
 	}
-	l, err2 := net.ListenTCP("tcp", tcpAddr)
+	l, err2 := tr.Listen(ipport)
 	if err2 != nil {
 		return nil, err2
 	}
@@ -198,14 +259,14 @@ func start(ctx context.Context, setting *setting.Setting) (*net.TCPListener, err
 		}
 	}()
 	log.Printf("Starting node Server on " + ipport + "\n")
-	go func() {
+	n.goWorker("listener", func() {
 		defer func() {
 			if err := l.Close(); err != nil {
 				log.Println(err)
 			}
 		}()
 		for {
-			conn, err3 := l.AcceptTCP()
+			conn, err3 := l.Accept()
 			if err3 != nil {
 				if ne, ok := err3.(net.Error); ok {
 					if ne.Temporary() {
@@ -224,66 +285,79 @@ func start(ctx context.Context, setting *setting.Setting) (*net.TCPListener, err
 					log.Println(err)
 				}
 			}()
-			go func() {
+			n.goWorker("inbound", func() {
 				defer cancel2()
 				log.Println("connected from", conn.RemoteAddr())
-				if err := handle(setting, conn); err != nil {
+				if err := n.handle(setting, conn); err != nil {
 					log.Println(conn.RemoteAddr(), ":", err)
 				}
-			}()
+			})
 		}
-	}()
+	})
 
-	goCron(ctx, setting)
+	n.goCron(ctx, setting)
+	n.goFluff(ctx, setting)
 	return l, nil
 }
 
-//Handle handles messages in tcp.
-func handle(s *setting.Setting, conn *net.TCPConn) error {
+//Handle handles messages from conn.
+func (n *Node) handle(s *setting.Setting, conn net.Conn) error {
 	var err2 error
 	if err := conn.SetDeadline(time.Now().Add(rwTimeout)); err != nil {
 		return err
 	}
-	p, err2 := readVersion(s, conn, verNonce)
+	r := msg.NewReader(conn)
+	p, err2 := n.readVersion(s, conn, r, n.verNonce)
 	if err2 != nil {
 		log.Println(err2)
 		return err2
 	}
+	p.inbound = true
 
-	if err := writeVersion(s, p.remote, conn, verNonce); err != nil {
+	if err := n.writeVersion(s, p.remote, conn, r, n.verNonce); err != nil {
 		return err
 	}
 
 	if err := p.add(s); err != nil {
 		return err
 	}
-	if err := putAddrs(s, p.remote); err != nil {
+	if err := n.putAddrs(s, p.host, p.remote); err != nil {
 		return err
 	}
 	p.run(s)
 	return nil
 }
 
-//Start starts a node server.
+//Start starts the default node server with setting.
 func Start(ctx context.Context, setting *setting.Setting, debug bool) (net.Listener, error) {
-	if err := initDB(setting); err != nil {
+	std.s = setting
+	return std.Start(ctx, debug)
+}
+
+//Start starts a node server.
+func (n *Node) Start(ctx context.Context, debug bool) (net.Listener, error) {
+	setting := n.s
+	ctx = n.withCancel(ctx)
+	if err := n.initDB(setting); err != nil {
 		return nil, err
 	}
+	n.startCapture(ctx, setting)
 	if !debug {
-		if err := lookup(setting); err != nil {
+		n.bootstrap(setting)
+		if err := n.connect(ctx, setting); err != nil {
 			return nil, err
 		}
-		connect(ctx, setting)
-		if err := startConsensus(ctx, setting); err != nil {
+		n.startSync(ctx, setting)
+		if err := n.startConsensus(ctx, setting); err != nil {
 			return nil, err
 		}
 	}
-	l, err := start(ctx, setting)
+	l, err := n.start(ctx, setting)
 	return l, err
 }
 
-func startConsensus(ctx context.Context, setting *setting.Setting) error {
-	if err := akconsensus.Init(ctx, setting, &ConsensusPeer{}); err != nil {
+func (n *Node) startConsensus(ctx context.Context, setting *setting.Setting) error {
+	if err := n.cons.Init(ctx, setting, &ConsensusPeer{n: n}); err != nil {
 		return err
 	}
 	var id consensus.NodeID
@@ -298,8 +372,12 @@ func startConsensus(ctx context.Context, setting *setting.Setting) error {
 	if err != nil {
 		return err
 	}
-	peers.cons = consensus.NewPeer(akconsensus.NewAdaptor(setting), id,
+	n.peers.cons = consensus.NewPeer(n.cons.NewAdaptor(setting), id,
 		unl, setting.RunValidator)
-	peers.cons.Start(ctx)
+	n.peers.cons.Start(ctx)
+	n.goWorker("consensus", func() {
+		<-ctx.Done()
+		n.cons.Wait()
+	})
 	return nil
 }
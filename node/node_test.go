@@ -21,23 +21,33 @@
 package node
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AidosKuneen/aklib"
 	"github.com/AidosKuneen/aklib/address"
+	"github.com/AidosKuneen/aklib/arypack"
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
 )
 
 var s, s1 setting.Setting
@@ -58,7 +68,8 @@ func setup(ctx context.Context, t *testing.T) {
 	}
 
 	s.Config = aklib.DebugConfig
-	s.MaxConnections = 1
+	s.MaxInbound = 2
+	s.MaxOutbound = 1
 	s.Bind = "127.0.0.1"
 	s.Port = uint16(rand.Int31n(10000)) + 1025
 	s.MyHostPort = ":" + strconv.Itoa(int(s.Port))
@@ -84,14 +95,21 @@ func setup(ctx context.Context, t *testing.T) {
 	t.Log("genesis tx", genesis)
 
 	s1.Config = aklib.DebugConfig
-	s1.MaxConnections = 1
+	s1.MaxInbound = 2
+	s1.MaxOutbound = 1
 	s1.Port = uint16(rand.Int31n(10000)) + 1025
 	s1.MyHostPort = ":" + strconv.Itoa(int(s1.Port))
 
-	nodesDB.Addrs = make(adrmap)
-	peers.Peers = make(map[string]*peer)
-	peers.banned = make(map[string]time.Time)
-	if err := initDB(&s); err != nil {
+	std.nodesDB.Addrs = make(adrmap)
+	//stop writers of peers left by previous tests.
+	for _, p := range std.peers.Peers {
+		p.disconnect()
+	}
+	std.peers.Peers = make(map[string]*peer)
+	std.peers.banned = make(map[string]*Ban)
+	std.peers.scores = make(map[string]*score)
+	std.notFound.hosts = make(map[[32]byte]map[string]time.Time)
+	if err := std.initDB(&s); err != nil {
 		t.Error(err)
 	}
 
@@ -113,17 +131,18 @@ func TestNode(t *testing.T) {
 			Service: "seeds",
 			Name:    "aidoskuneen.com",
 		}}
-	if err := lookup(&s); err != nil {
-		t.Error(err)
-	}
-	if len(nodesDB.Addrs) != 4 {
+	std.bootstrap(&s)
+	if len(std.nodesDB.Addrs) != 4 {
 		t.Error("len should be 4")
 	}
-	nodesDB.Addrs = nil
-	if err := initDB(&s); err != nil {
+	if err := std.save(&s); err != nil {
+		t.Error(err)
+	}
+	std.nodesDB.Addrs = nil
+	if err := std.initDB(&s); err != nil {
 		t.Error(err)
 	}
-	if len(nodesDB.Addrs) != 4 {
+	if len(std.nodesDB.Addrs) != 4 {
 		t.Error("len should be 4")
 	}
 }
@@ -168,7 +187,7 @@ func TestNode2(t *testing.T) {
 		t.Error(err)
 	}
 
-	l, err2 := start(ctx, &s)
+	l, err2 := std.start(ctx, &s)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -212,6 +231,17 @@ func TestNode2(t *testing.T) {
 	if err := msg.Write(&s1, nil, msg.CmdVerack, conn); err != nil {
 		t.Error(err)
 	}
+	//pinged just after the handshake for measuring the latency.
+	cmd, buf, err2 = msg.ReadHeader(&s1, conn)
+	if err2 != nil {
+		t.Error(err2)
+	}
+	if cmd != msg.CmdPing {
+		t.Error("cmd must be ping")
+	}
+	if err := msg.WriteRaw(&s1, buf, msg.CmdPong, conn); err != nil {
+		t.Error(err)
+	}
 
 	var nonce msg.Nonce
 	nonce[30] = 1
@@ -338,6 +368,30 @@ func TestNode2(t *testing.T) {
 		t.Error("invalid type")
 	}
 
+	unknown := msg.Inventories{
+		&msg.Inventory{
+			Type: msg.InvTxNormal,
+			Hash: [32]byte{1, 2, 3},
+		},
+	}
+	if err := msg.Write(&s1, &unknown, msg.CmdGetData, conn); err != nil {
+		t.Error(err)
+	}
+	cmd, buf, err2 = msg.ReadHeader(&s1, conn)
+	if err2 != nil {
+		t.Error(err2)
+	}
+	if cmd != msg.CmdNotFound {
+		t.Error("cmd must be notfound")
+	}
+	nf, err2 := msg.ReadInventories(buf)
+	if err2 != nil {
+		t.Error(err2)
+	}
+	if len(nf) != 1 || nf[0].Hash != unknown[0].Hash {
+		t.Error("invalid notfound")
+	}
+
 	var lfrom msg.LeavesFrom
 	if err := msg.Write(&s1, &lfrom, msg.CmdGetLeaves, conn); err != nil {
 		t.Error(err)
@@ -427,10 +481,10 @@ func TestNode2(t *testing.T) {
 		t.Error(err)
 	}
 	time.Sleep(3 * time.Second)
-	if len(nodesDB.Addrs) != 2 {
-		t.Error("invalid adr cmd", len(nodesDB.Addrs))
+	if len(std.nodesDB.Addrs) != 2 {
+		t.Error("invalid adr cmd", len(std.nodesDB.Addrs))
 	}
-	if _, e := nodesDB.Addrs[addrs[0].Address]; !e {
+	if _, e := std.nodesDB.Addrs[addrs[0].Address]; !e {
 		t.Error("didnt add adr")
 	}
 
@@ -445,7 +499,7 @@ func TestNode2(t *testing.T) {
 		t.Error(err)
 	}
 	time.Sleep(3 * time.Second)
-	if _, e := peers.banned["127.0.0.1"]; !e {
+	if _, e := std.peers.banned["127.0.0.1"]; !e {
 		t.Error("should be banned")
 	}
 	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
@@ -500,18 +554,19 @@ func TestNode3(t *testing.T) {
 		if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
 			t.Error(err)
 		}
-		p, err3 := readVersion(&s1, conn, 0)
+		r := msg.NewReader(conn)
+		p, err3 := std.readVersion(&s1, conn, r, 0)
 		if err3 != nil {
 			t.Error(err3)
 		}
-		if err := writeVersion(&s1, p.remote, conn, 0); err != nil {
+		if err := std.writeVersion(&s1, p.remote, conn, r, 0); err != nil {
 			t.Error(err)
 		}
 	}()
-	if err := putAddrs(&s, *msg.NewAddr("127.0.0.1"+s1.MyHostPort, msg.ServiceFull)); err != nil {
+	if err := std.putAddrs(&s, "", *msg.NewAddr("127.0.0.1"+s1.MyHostPort, msg.ServiceFull)); err != nil {
 		t.Error(err)
 	}
-	connect(ctx, &s)
+	std.connect(ctx, &s)
 	<-ch
 }
 func TestNode4(t *testing.T) {
@@ -523,7 +578,7 @@ func TestNode4(t *testing.T) {
 		return p.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
 	}
 
-	l, err2 := start(ctx, &s)
+	l, err2 := std.start(ctx, &s)
 	if err2 != nil {
 		t.Error(err2)
 	}
@@ -568,7 +623,7 @@ func TestNode4(t *testing.T) {
 	if err := msg.Write(&s1, nil, msg.CmdVerack, conn); err != nil {
 		t.Error(err)
 	}
-	time.Sleep(4 * time.Second)
+	//pinged just after the handshake for measuring the latency.
 	cmd, buf, err2 = msg.ReadHeader(&s1, conn)
 	if err2 != nil {
 		t.Error(err2)
@@ -580,10 +635,1241 @@ func TestNode4(t *testing.T) {
 	if err2 != nil {
 		t.Error(err2)
 	}
+	time.Sleep(100 * time.Millisecond)
 	if err := msg.Write(&s1, n, msg.CmdPong, conn); err != nil {
 		t.Error(err)
 	}
+	time.Sleep(100 * time.Millisecond)
+	pis := GetPeerInfo()
+	if len(pis) != 1 || pis[0].PingTime < 0.1 || pis[0].MinPing != pis[0].PingTime {
+		t.Error("latency should be measured by ping", pis)
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestV1Peer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	//messages of protocol version 1, without checksum and compression.
+	type v1Header struct {
+		Magic   uint32
+		Length  uint32
+		Command byte
+	}
+	type v1Addr struct {
+		Address string
+		Service byte
+	}
+	type v1Version struct {
+		Version   uint16
+		Nonce     uint64
+		AddrFrom  v1Addr
+		AddrTo    v1Addr
+		UserAgent string
+	}
+
+	conn, remote := net.Pipe()
+	defer conn.Close()
+	defer remote.Close()
+	if err := remote.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Error(err)
+	}
+	br := bufio.NewReader(remote)
+	dec := msgpack.NewDecoder(br)
+	readV1 := func() (byte, []byte, error) {
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return 0, nil, err
+		}
+		if n != 3 {
+			return 0, nil, fmt.Errorf("v1 node cannot read a header with %d fields", n)
+		}
+		var h v1Header
+		if h.Magic, err = dec.DecodeUint32(); err != nil {
+			return 0, nil, err
+		}
+		if h.Length, err = dec.DecodeUint32(); err != nil {
+			return 0, nil, err
+		}
+		if h.Command, err = dec.DecodeUint8(); err != nil {
+			return 0, nil, err
+		}
+		buf := make([]byte, h.Length)
+		_, err = io.ReadFull(br, buf)
+		return h.Command, buf, err
+	}
+	writeV1 := func(m interface{}, cmd byte) error {
+		var dat []byte
+		if m != nil {
+			dat = arypack.Marshal(m)
+		}
+		h := arypack.Marshal(&v1Header{
+			Magic:   s.Config.MessageMagic,
+			Length:  uint32(len(dat)),
+			Command: cmd,
+		})
+		_, err := remote.Write(append(h, dat...))
+		return err
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		v := &v1Version{
+			Version:   1,
+			Nonce:     1,
+			AddrFrom:  v1Addr{Address: "127.0.0.1" + s1.MyHostPort},
+			AddrTo:    v1Addr{Address: "127.0.0.1" + s.MyHostPort},
+			UserAgent: "v1",
+		}
+		if err := writeV1(v, msg.CmdVersion); err != nil {
+			t.Error(err)
+			return
+		}
+		if cmd, _, err := readV1(); err != nil || cmd != msg.CmdVerack {
+			t.Error("should receive verack", cmd, err)
+			return
+		}
+		cmd, buf, err := readV1()
+		if err != nil || cmd != msg.CmdVersion {
+			t.Error("should receive version", cmd, err)
+			return
+		}
+		//validate as v1 nodes do.
+		var v2 v1Version
+		if err := arypack.Unmarshal(buf, &v2); err != nil {
+			t.Error(err)
+			return
+		}
+		if v2.AddrFrom.Service != 0 || v2.AddrTo.Service != 0 {
+			t.Error("v1 node rejects unknown service", v2.AddrFrom.Service, v2.AddrTo.Service)
+			return
+		}
+		if err := writeV1(nil, msg.CmdVerack); err != nil {
+			t.Error(err)
+		}
+		nc := nonce()
+		if err := writeV1(&nc, msg.CmdPing); err != nil {
+			t.Error(err)
+		}
+		if cmd, _, err := readV1(); err != nil || cmd != msg.CmdPong {
+			t.Error("should receive pong", cmd, err)
+		}
+	}()
+
+	r := msg.NewReader(conn)
+	p, err := std.readVersion(&s, conn, r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.version != 1 {
+		t.Error("should talk version 1", p.version)
+	}
+	if err := std.writeVersion(&s, p.remote, conn, r, 0); err != nil {
+		t.Fatal(err)
+	}
+	cmd, buf, err := r.ReadHeader(&s)
+	if err != nil || cmd != msg.CmdPing {
+		t.Fatal("should receive ping", cmd, err)
+	}
+	nc, err := msg.ReadNonce(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.queue = newSendQueue()
+	p.compress = msg.CompressAll
+	if err := p.write(&s, nc, msg.CmdPong); err != nil {
+		t.Error(err)
+	}
+	<-ch
+	p.disconnect()
+}
+
+func TestMisbehave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+	p := &peer{
+		node: std,
+		host: "10.0.0.1",
+		remote: msg.Addr{
+			Address: "10.0.0.1:14270",
+		},
+	}
+	for i := 0; i < 4; i++ {
+		if err := p.misbehave(&s, offUnsolicited, errors.New("test")); err != nil {
+			t.Error(err)
+		}
+	}
+	if std.isBanned(p.host) {
+		t.Error("should not be banned")
+	}
+	std.peers.scores[p.host].updated = time.Now().Add(-time.Hour)
+	if err := p.misbehave(&s, offUnsolicited, errors.New("test")); err != nil {
+		t.Error("score should decay", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.misbehave(&s, offUnsolicited, errors.New("test")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := p.misbehave(&s, offUnsolicited, errors.New("test")); err == nil {
+		t.Error("should be banned")
+	}
+	b, ok := GetBanned()[p.host]
+	if !ok {
+		t.Error("should be banned")
+	}
+	if b.Reason != offUnsolicited.reason {
+		t.Error("invalid reason", b.Reason)
+	}
+	if _, ok := std.peers.scores[p.host]; ok {
+		t.Error("score should be cleared after ban")
+	}
+
+	p2 := &peer{
+		node: std,
+		host: "10.0.0.2",
+		remote: msg.Addr{
+			Address: "10.0.0.2:14270",
+		},
+		perm: setting.PermNoBan,
+	}
+	for i := 0; i < 10; i++ {
+		if err := p2.misbehave(&s, offInvalidTx, errors.New("test")); err != nil {
+			t.Error("noban peer should not be banned", err)
+		}
+	}
+	if _, ok := std.peers.scores[p2.host]; ok {
+		t.Error("noban peer should not be scored")
+	}
+}
+
+func TestSetBan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+	if err := SetBan(&s, "10.1.2.3/16", "test", time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err := SetBan(&s, "::1", "test", time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err := SetBan(&s, "10.1.2.3.4", "test", time.Hour); err == nil {
+		t.Error("should be error")
+	}
+	if !std.isBanned("10.1.200.1") {
+		t.Error("should be banned")
+	}
+	if std.isBanned("10.2.0.1") {
+		t.Error("should not be banned")
+	}
+	if err := std.initDB(&s); err != nil {
+		t.Error(err)
+	}
+	bs := GetBanned()
+	if len(bs) != 2 {
+		t.Error("ban list should be persisted", bs)
+	}
+	if b := bs["10.1.0.0/16"]; b.Reason != "test" || b.Until.Sub(b.Created) != time.Hour {
+		t.Error("invalid ban", b)
+	}
+	if err := ClearBan(&s, "10.1.0.0/16"); err != nil {
+		t.Error(err)
+	}
+	if err := ClearBan(&s, "10.1.0.0/16"); err == nil {
+		t.Error("should be error")
+	}
+	if std.isBanned("10.1.200.1") {
+		t.Error("should not be banned")
+	}
+	if err := ClearBan(&s, ""); err != nil {
+		t.Error(err)
+	}
+	if err := std.initDB(&s); err != nil {
+		t.Error(err)
+	}
+	if len(GetBanned()) != 0 {
+		t.Error("ban list should be cleared")
+	}
+}
+
+func TestAddrBook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	adrs := make([]msg.Addr, 1000)
+	for i := range adrs {
+		adrs[i] = *msg.NewAddr(net.JoinHostPort(net.IPv4(10, byte(i>>8), byte(i), 1).String(), "14270"), msg.ServiceFull)
+		adrs[i].Time = time.Now().Unix()
+	}
+	if err := std.putAddrs(&s, "192.168.0.1", adrs...); err != nil {
+		t.Error(err)
+	}
+	if n := std.addrSize(); n > newBucketsPerSource*bucketSize {
+		t.Error("a source should not fill the table", n)
+	}
+	for i := range adrs {
+		adrs[i].Address = net.JoinHostPort(net.IPv4(11, byte(i>>8), byte(i), 1).String(), "14270")
+	}
+	if err := std.putAddrs(&s, "172.16.0.1", adrs...); err != nil {
+		t.Error(err)
+	}
+	n := std.addrSize()
+	srcs := make(map[string]int)
+	for _, k := range std.nodesDB.Addrs {
+		srcs[k.Source]++
+	}
+	if srcs["192.168.0.0"] == 0 || srcs["172.16.0.0"] == 0 ||
+		srcs["172.16.0.0"] > newBucketsPerSource*bucketSize {
+		t.Error("a source should not evict addresses from others", srcs)
+	}
+
+	p, ok := std.pick(func(string) bool { return false })
+	if !ok {
+		t.Fatal("should be picked")
+	}
+	if err := std.attempt(&s, p); err != nil {
+		t.Error(err)
+	}
+	if k := std.nodesDB.Addrs[p.Address]; k.Attempts != 1 || k.LastAttempt.IsZero() {
+		t.Error("invalid attempt", k)
+	}
+	if _, ok := std.pick(func(adr string) bool { return adr != p.Address }); ok {
+		t.Error("should not be picked just after an attempt")
+	}
+	if err := std.good(&s, p); err != nil {
+		t.Error(err)
+	}
+	if k := std.nodesDB.Addrs[p.Address]; !k.Tried || k.Attempts != 0 || k.LastSuccess.IsZero() {
+		t.Error("should be tried", k)
+	}
+
+	if !std.nodesDB.dirty {
+		t.Error("should be dirty")
+	}
+	if err := std.save(&s); err != nil {
+		t.Error(err)
+	}
+	if std.nodesDB.dirty {
+		t.Error("should be saved")
+	}
+	if err := std.initDB(&s); err != nil {
+		t.Error(err)
+	}
+	if std.addrSize() != n {
+		t.Error("addresses should be persisted", std.addrSize(), n)
+	}
+	if k := std.nodesDB.Addrs[p.Address]; k == nil || !k.Tried {
+		t.Error("tried should be persisted")
+	}
+	for _, a := range std.get(0) {
+		if a.Time == 0 {
+			t.Error("time should be set")
+		}
+	}
+	if err := std.remove(&s, p); err != nil {
+		t.Error(err)
+	}
+	if _, ok := std.nodesDB.Addrs[p.Address]; ok {
+		t.Error("should be removed")
+	}
+
+	//addresses stored by older versions are migrated.
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		if err := db.Del(txn, addrBookKey, db.HeaderNodeIP); err != nil {
+			return err
+		}
+		old := map[string]msg.Addr{
+			p.Address: p,
+		}
+		return db.Put(txn, nil, old, db.HeaderNodeIP)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := std.initDB(&s); err != nil {
+		t.Error(err)
+	}
+	if _, ok := std.nodesDB.Addrs[p.Address]; !ok {
+		t.Error("old address should be migrated")
+	}
+	err = s.DB.View(func(txn *badger.Txn) error {
+		var old map[string]msg.Addr
+		return db.Get(txn, nil, &old, db.HeaderNodeIP)
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Error("old addresses should be deleted", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	dial := func() *net.TCPConn {
+		conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	now := time.Now()
+	ps := make([]*peer, 12)
+	for i := range ps {
+		ps[i] = &peer{
+			node:      std,
+			conn:      dial(),
+			remote:    *msg.NewAddr(fmt.Sprintf("10.0.0.%d:14270", i), msg.ServiceFull),
+			inbound:   true,
+			minRTT:    time.Duration(i+1) * time.Millisecond,
+			connected: now.Add(-time.Duration(len(ps)-i) * time.Minute),
+		}
+		std.peers.Peers[ps[i].remote.Address] = ps[i]
+	}
+	ps[10].markUseful()
+	ps[11].markUseful()
+	var se setting.Setting
+	se.MaxInbound = uint16(len(ps))
+	se.MaxOutbound = 1
+
+	if e := std.evictCandidate(); e != ps[9] {
+		t.Error("invalid eviction candidate", e)
+	}
+	out := &peer{
+		node:   std,
+		conn:   dial(),
+		remote: *msg.NewAddr("10.0.1.1:14270", msg.ServiceFull),
+	}
+	if err := out.add(&se); err != nil {
+		t.Error(err)
+	}
+	out2 := &peer{
+		node:   std,
+		remote: *msg.NewAddr("10.0.1.2:14270", msg.ServiceFull),
+	}
+	if err := out2.add(&se); err == nil {
+		t.Error("outbound peers should be full")
+	}
+	in := &peer{
+		node:    std,
+		conn:    dial(),
+		remote:  *msg.NewAddr("10.0.2.1:14270", msg.ServiceFull),
+		inbound: true,
+	}
+	if err := in.add(&se); err != nil {
+		t.Error(err)
+	}
+	if std.isConnected(ps[9].remote.Address) || !std.isConnected(in.remote.Address) {
+		t.Error("should be evicted")
+	}
+	ps[9].delete()
+	if !std.isConnected(in.remote.Address) {
+		t.Error("should not delete the new peer")
+	}
+
+	std.peers.Peers = make(map[string]*peer)
+	se.MaxInbound = protectLatency
+	for i := 0; i < protectLatency; i++ {
+		std.peers.Peers[ps[i].remote.Address] = ps[i]
+	}
+	if err := in.add(&se); err == nil {
+		t.Error("all inbound peers should be protected")
+	}
+	in.whitelisted = true
+	if err := in.add(&se); err != nil {
+		t.Error("whitelisted peer should bypass limits", err)
+	}
+	if e := std.evictCandidate(); e == in {
+		t.Error("whitelisted peer should not be evicted")
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{
+		node:      std,
+		conn:      conn,
+		remote:    *msg.NewAddr("10.0.0.1:14270", msg.ServiceFull),
+		userAgent: "test",
+	}
+	if err := p.add(&s); err != nil {
+		t.Error(err)
+	}
+	before := GetNetTotals()
+	n := nonce()
+	if err := p.write(&s, &n, msg.CmdPing); err != nil {
+		t.Error(err)
+	}
+	std.flush(time.Second)
+	p.recv(msg.CmdPong, 10)
+	p.recv(msg.CmdPong, 20)
+	pis := GetPeerInfo()
+	if len(pis) != 1 {
+		t.Fatal("invalid peerinfo")
+	}
+	pi := pis[0]
+	if pi.Inbound || pi.UserAgent != "test" || pi.ConnTime == 0 {
+		t.Error("invalid peerinfo", pi)
+	}
+	if pi.MsgsSentPerMsg["ping"] != 1 || pi.BytesSent == 0 ||
+		pi.BytesSentPerMsg["ping"] != pi.BytesSent {
+		t.Error("invalid sent stats", pi)
+	}
+	if pi.MsgsRecvPerMsg["pong"] != 2 || pi.BytesRecv != 30 || pi.LastRecv == 0 {
+		t.Error("invalid recv stats", pi)
+	}
+	after := GetNetTotals()
+	if after.TotalBytesSent-before.TotalBytesSent != pi.BytesSent ||
+		after.TotalBytesRecv-before.TotalBytesRecv != 30 {
+		t.Error("invalid net totals", before, after)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+	defer std.setSyncState(syncSynced)
+
+	if si := GetSyncInfo(); si.State != "synced" || si.Progress != 100 {
+		t.Error("should be synced in debug mode", si)
+	}
+	std.setSyncState(syncConnecting)
+	if std.syncSub(&s) {
+		t.Error("should not be synced without peers")
+	}
+	if si := GetSyncInfo(); si.State != "connecting" || si.Progress != 0 {
+		t.Error("invalid sync info", si)
+	}
+	std.setSyncState(syncLeaves)
+	std.leavesReceived()
+	if std.syncSub(&s) {
+		t.Error("should not be synced before fetching")
+	}
+	if si := GetSyncInfo(); si.State != "fetching" {
+		t.Error("invalid sync info", si)
+	}
+
+	var h [32]byte
+	h[0] = 1
+	if err := imesh.AddNoexistTxHash(&s, h[:], tx.TypeNormal); err != nil {
+		t.Error(err)
+	}
+	if std.syncSub(&s) {
+		t.Error("should not be synced with missing txs")
+	}
+	if si := GetSyncInfo(); si.Missing != 1 || si.Progress != 0 {
+		t.Error("invalid sync info", si)
+	}
+
+	//the tx is never resolved.
+	defer func(d time.Duration) {
+		syncStallTimeout = d
+	}(syncStallTimeout)
+	syncStallTimeout = 100 * time.Millisecond
+	if std.syncSub(&s) {
+		t.Error("should not be synced before the stall timeout")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !std.syncSub(&s) {
+		t.Error("should be synced after the stall timeout")
+	}
+	if si := GetSyncInfo(); si.State != "synced" {
+		t.Error("invalid sync info", si)
+	}
+
+	var h2 tx.Hash = make([]byte, 32)
+	std.addLocal(h2)
+	if !std.takeLocal(h2) || std.takeLocal(h2) {
+		t.Error("local tx should be taken once")
+	}
+}
+
+func TestDandelion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+	s.Dandelion = true
+	defer func() {
+		s.Dandelion = false
+	}()
+
+	tr := tx.New(s.Config, genesis)
+	tr.AddInput(genesis, 0)
+	if err := tr.AddOutput(s.Config, a.Address58(s.Config), aklib.ADKSupply); err != nil {
+		t.Error(err)
+	}
+	if err := tr.Sign(a); err != nil {
+		t.Error(err)
+	}
+	if err := tr.PoW(); err != nil {
+		t.Error(err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.SetDeadline(time.Now().Add(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	p := &peer{
+		node:    std,
+		conn:    conn,
+		remote:  *msg.NewAddr("10.0.0.1:14270", msg.ServiceFull),
+		version: msg.MessageVersion,
+	}
+	if err := p.add(&s); err != nil {
+		t.Error(err)
+	}
+	if std.stemPeer(p) != nil {
+		t.Error("should not stem back to the sender")
+	}
+
+	if err := SendTx(&s, tr, tx.TypeNormal); err != nil {
+		t.Error(err)
+	}
+	cmd, buf, err := msg.ReadHeader(&s, remote)
+	if err != nil {
+		t.Error(err)
+	}
+	if cmd != msg.CmdStemTx {
+		t.Error("tx should be stemmed", cmd)
+	}
+	vs, err := msg.ReadTxs(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(vs) != 1 || !bytes.Equal(vs[0].Tx.Hash(), tr.Hash()) {
+		t.Error("invalid stem tx")
+	}
+	if !std.isStem(tr.Hash()) {
+		t.Error("tx should be in the stem phase")
+	}
+
+	if err := std.resolve(&s); err != nil {
+		t.Error(err)
+	}
+	std.stems.Lock()
+	std.stems.txs[tr.Hash().Array()].embargo = time.Now()
+	std.stems.Unlock()
+	std.fluffExpired(&s)
+	cmd, buf, err = msg.ReadHeader(&s, remote)
+	if err != nil {
+		t.Error(err)
+	}
+	if cmd != msg.CmdInv {
+		t.Error("tx should be fluffed after embargo", cmd)
+	}
+	invs, err := msg.ReadInventories(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(invs) != 1 || invs[0].Hash != tr.Hash().Array() {
+		t.Error("invalid inv")
+	}
+	if std.isStem(tr.Hash()) {
+		t.Error("tx should be fluffed")
+	}
+}
+
+func TestConnMgr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	se := s
+	se.DefaultNodes = []string{"127.0.0.1:1"}
+	std.initConnMgr(&se)
+	adrs := []msg.Addr{
+		*msg.NewAddr("10.1.0.1:14270", msg.ServiceFull),
+		*msg.NewAddr("10.1.0.2:14270", msg.ServiceFull),
+		*msg.NewAddr("10.2.0.1:14270", msg.ServiceFull),
+	}
+	if err := std.putAddrs(&s, "", adrs...); err != nil {
+		t.Error(err)
+	}
+
+	adr, _, found := std.nextTarget()
+	if !found || adr.Address != "127.0.0.1:1" {
+		t.Error("default node should be dialed first", adr)
+	}
+	std.dialed(adr.Address, errors.New("refused"))
+
+	groups := make(map[string]struct{})
+	for i := 0; i < 2; i++ {
+		adr, _, found = std.nextTarget()
+		if !found {
+			t.Fatal("should be found")
+		}
+		if adr.Address == "127.0.0.1:1" {
+			t.Error("should be backed off")
+		}
+		if _, ok := groups[group(adr.Address)]; ok {
+			t.Error("outbound peers should be in different groups", adr)
+		}
+		groups[group(adr.Address)] = struct{}{}
+		if i == 0 {
+			std.peers.Peers[adr.Address] = &peer{
+				node:   std,
+				remote: adr,
+			}
+			std.dialed(adr.Address, nil)
+		}
+	}
+	_, wait, found := std.nextTarget()
+	if found {
+		t.Error("should not be found")
+	}
+	if wait <= 0 || wait > backoffMin {
+		t.Error("invalid wait", wait)
+	}
+
+	std.dialed(adr.Address, errors.New("refused"))
+	std.dialed(adr.Address, errors.New("refused"))
+	std.dialed(adr.Address, errors.New("refused"))
+	var cs *ConnState
+	for _, c := range GetConnState() {
+		if c.Address == adr.Address {
+			cs = c
+		}
+		if c.Address == "127.0.0.1:1" && !c.Permanent {
+			t.Error("default node should be permanent")
+		}
+	}
+	if cs == nil || cs.Failures != 3 || cs.Dialing || cs.LastError != "refused" {
+		t.Fatal("invalid conn state", cs)
+	}
+	if d := time.Until(time.Unix(cs.NextRetry, 0)); d < 3*backoffMin || d > 4*backoffMin {
+		t.Error("invalid backoff", d)
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	pn := NewPipeNetwork()
+	to := net.JoinHostPort(s.Bind, strconv.Itoa(int(s.Port)))
+	SetTransport(pn.Transport(to))
+	defer SetTransport(nil)
+	l, err := std.start(ctx, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pn.Transport("127.0.0.3:1").Listen(to); err == nil {
+		t.Error("should be in use")
+	}
+	if _, err := pn.Transport("127.0.0.3:1").Dial("127.0.0.4:1"); err == nil {
+		t.Error("should be refused")
+	}
+
+	conn, err := pn.Transport("127.0.0.2:" + strconv.Itoa(int(s1.Port))).Dial(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	v := msg.NewVersion(&s1, *msg.NewAddr(to, msg.ServiceFull), 0)
+	if err := msg.Write(&s1, v, msg.CmdVersion, conn); err != nil {
+		t.Error(err)
+	}
+	cmd, _, err := msg.ReadHeader(&s1, conn)
+	if err != nil {
+		t.Error(err)
+	}
+	if cmd != msg.CmdVerack {
+		t.Error("message must be verack after Version")
+	}
+	cmd, buf, err := msg.ReadHeader(&s1, conn)
+	if err != nil {
+		t.Error(err)
+	}
+	if cmd != msg.CmdVersion {
+		t.Error("cmd must be version for handshake")
+	}
+	if _, err := msg.ReadVersion(&s1, buf, 0); err != nil {
+		t.Error(err)
+	}
+	if err := msg.Write(&s1, nil, msg.CmdVerack, conn); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second)
+	pis := GetPeerInfo()
+	if len(pis) != 1 || !pis[0].Inbound ||
+		pis[0].Address != "127.0.0.2:"+strconv.Itoa(int(s1.Port)) {
+		t.Fatal("invalid peers", pis)
+	}
 	if err := l.Close(); err != nil {
 		t.Error(err)
 	}
+	if _, err := pn.Transport("127.0.0.3:1").Dial(to); err == nil {
+		t.Error("should be refused after close")
+	}
+}
+
+func TestStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	pn := NewPipeNetwork()
+	SetTransport(pn.Transport(net.JoinHostPort(s.Bind, strconv.Itoa(int(s.Port)))))
+	defer SetTransport(nil)
+	if _, err := std.start(std.withCancel(ctx), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(std.Running()) == 0 {
+		t.Error("should be running")
+	}
+	if err := Stop(&s, 10*time.Second); err != nil {
+		t.Error(err)
+	}
+	if r := std.Running(); len(r) != 0 {
+		t.Error("should be stopped", r)
+	}
+
+	ctx2 := std.withCancel(ctx)
+	block := make(chan struct{})
+	std.goWorker("blocker", func() {
+		<-ctx2.Done()
+		<-block
+	})
+	std.nodesDB.Lock()
+	std.nodesDB.dirty = true
+	std.nodesDB.Unlock()
+	err := Stop(&s, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "blocker") {
+		t.Error("should report running routines", err)
+	}
+	if !std.nodesDB.dirty {
+		t.Error("should not persist while routines are running")
+	}
+	close(block)
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	defer std.initBootstrap()
+	std.lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("offline")
+	}
+	s.Config.DNS = []aklib.SRV{
+		aklib.SRV{
+			Service: "seeds",
+			Name:    "aidoskuneen.com",
+		}}
+	s.SeedNodes = []string{"10.0.0.1:14270", "bad"}
+	fname := "./test_peers.json"
+	defer func() {
+		if err := os.Remove(fname); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := ioutil.WriteFile(fname, []byte(`["10.0.0.2:14270","10.0.0.3:14270","bad"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.PeersFile = fname
+	s.MaxOutbound = 10
+	std.bootstrap(&s)
+	if std.addrSize() != 3 {
+		t.Error("should have addresses from static seeds and the peers file", std.addrSize())
+	}
+
+	if err := std.ExportPeers(fname); err != nil {
+		t.Error(err)
+	}
+	std.nodesDB.Addrs = make(adrmap)
+	if err := ImportPeers(&s, fname); err != nil {
+		t.Error(err)
+	}
+	if std.addrSize() != 3 {
+		t.Error("should import exported addresses", std.addrSize())
+	}
+
+	std.nodesDB.Addrs = make(adrmap)
+	std.sources = []*bootstrapSource{
+		{"test", func(*setting.Setting) (string, msg.Addrs, error) {
+			return "", msg.Addrs{*msg.NewAddr("10.0.0.4:14270", msg.ServiceFull)}, nil
+		}},
+	}
+	std.bootstrap(&s)
+	if std.addrSize() != 1 {
+		t.Error("should have addresses from the injected source", std.addrSize())
+	}
+}
+
+//socks5 is a SOCKS5 stand-in which connects every CONNECT request to target,
+//and sends requested hosts to the returned channel.
+func socks5(t *testing.T, target string) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				//greeting: ver, nmethods, methods
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := conn.Write([]byte{5, 0}); err != nil {
+					t.Error(err)
+					return
+				}
+				//request: ver, cmd, rsv, atyp(domain), len, name, port
+				if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+					t.Error(err)
+					return
+				}
+				if buf[1] != 1 || buf[3] != 3 {
+					t.Error("should be CONNECT to a domain name", buf[:5])
+					return
+				}
+				l := int(buf[4])
+				if _, err := io.ReadFull(conn, buf[:l+2]); err != nil {
+					t.Error(err)
+					return
+				}
+				hosts <- string(buf[:l])
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer dst.Close()
+				if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+					t.Error(err)
+					return
+				}
+				go io.Copy(dst, conn)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return l, hosts
+}
+
+func TestTor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setup(ctx, t)
+	defer teardown(t)
+	defer cancel()
+
+	const onion = "expyuzz4wqqyqhjn.onion"
+	target := "127.0.0.1:" + strconv.Itoa(int(s1.Port))
+	ps, hosts := socks5(t, target)
+	defer ps.Close()
+
+	s.UseTor = true
+	s.Proxy = ps.Addr().String()
+	s.MyHostPort = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion:" + strconv.Itoa(int(s.Port))
+	s1.UseTor = true
+	s1.MyHostPort = onion + ":" + strconv.Itoa(int(s1.Port))
+
+	l, err := net.Listen("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Error(err)
+		}
+		r := msg.NewReader(conn)
+		p, err := std.readVersion(&s1, conn, r, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := std.writeVersion(&s1, p.remote, conn, r, 0); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	tr, err := std.getTransport(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := std.dial(ctx, &s, tr, *msg.NewAddr(s1.MyHostPort, msg.ServiceFull))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	if h := <-hosts; h != onion {
+		t.Error("should be dialed through the proxy", h)
+	}
+	if pr.host != onion || pr.remote.Address != s1.MyHostPort {
+		t.Error("invalid remote", pr.host, pr.remote.Address)
+	}
+	if err := std.putAddrs(&s, pr.host, pr.remote); err != nil {
+		t.Error(err)
+	}
+	found := false
+	for _, a := range std.get(msg.MaxAddrs) {
+		if a.Address == s1.MyHostPort {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("onion address should be gossiped")
+	}
+
+	adrs := msg.Addrs{pr.remote, *msg.NewAddr("127.0.0.1:14014", msg.ServiceFull)}
+	v, err := msg.ReadAddrs(&s, arypack.Marshal(adrs))
+	if err != nil || len(*v) != 2 {
+		t.Error("onion address should be accepted with use_tor", err)
+	}
+	s.UseTor = false
+	v, err = msg.ReadAddrs(&s, arypack.Marshal(adrs))
+	if err != nil || len(*v) != 1 || (*v)[0].Address != "127.0.0.1:14014" {
+		t.Error("onion address should be dropped without use_tor", err)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue()
+	for _, cmd := range []byte{msg.CmdTxs, msg.CmdPing, msg.CmdLeaves, msg.CmdValidation, msg.CmdProposal} {
+		if _, err := q.push(&packet{cmd: cmd, dat: []byte{cmd}}); err != nil {
+			t.Error(err)
+		}
+	}
+	if q.len() != 5 {
+		t.Error("invalid queue size", q.len())
+	}
+	for _, cmd := range []byte{msg.CmdValidation, msg.CmdProposal, msg.CmdPing, msg.CmdTxs, msg.CmdLeaves} {
+		if pk := q.pop(); pk == nil || pk.cmd != cmd {
+			t.Error("invalid order", pk, cmd)
+		}
+	}
+	if q.pop() != nil || q.len() != 0 {
+		t.Error("should be empty")
+	}
+
+	big := &packet{cmd: msg.CmdTxs, dat: make([]byte, maxSendQueue+1)}
+	if stalled, err := q.push(big); err != errSendQueueFull || stalled {
+		t.Error("should be full but not stalled", err, stalled)
+	}
+	q.full = time.Now().Add(-sendQueueStall)
+	if stalled, err := q.push(big); err != errSendQueueFull || !stalled {
+		t.Error("should be stalled", err, stalled)
+	}
+
+	//a slow reader drains a packet at a time.
+	q = newSendQueue()
+	chunk := &packet{cmd: msg.CmdTxs, dat: make([]byte, maxSendQueue/8)}
+	for i := 0; i < 8; i++ {
+		if _, err := q.push(chunk); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := q.push(chunk); err != errSendQueueFull {
+		t.Error("should be full", err)
+	}
+	q.full = time.Now().Add(-sendQueueStall)
+	q.pop()
+	if stalled, err := q.push(chunk); err != nil || stalled {
+		t.Error("should be queued", err, stalled)
+	}
+	if stalled, err := q.push(chunk); err != errSendQueueFull || !stalled {
+		t.Error("slow reader should be stalled", err, stalled)
+	}
+	for q.len() >= sendQueueLowWater {
+		q.pop()
+	}
+	if !q.full.IsZero() {
+		t.Error("drained queue should not be full")
+	}
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := &peer{
+		node:   std,
+		conn:   conn,
+		remote: *msg.NewAddr("10.0.0.1:14270", msg.ServiceFull),
+		queue:  newSendQueue(),
+	}
+	p.queue.size = maxSendQueue
+	p.queue.full = time.Now().Add(-sendQueueStall)
+	se := setting.Setting{}
+	se.Config = aklib.DebugConfig
+	nc := nonce()
+	if err := p.write(&se, &nc, msg.CmdPing); err != errSendQueueFull {
+		t.Error("should be full", err)
+	}
+	select {
+	case <-p.queue.closed:
+	default:
+		t.Error("stalled peer should be disconnected")
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("connection should be closed")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	var l rateLimiter
+	if d := l.reserve(0, 1<<30); d != 0 {
+		t.Error("should be unlimited", d)
+	}
+	if d := l.reserve(1000, 1000); d != 0 {
+		t.Error("burst should not wait", d)
+	}
+	if d := l.reserve(1000, 500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("should wait for half a second", d)
+	}
+
+	var m rateMeter
+	m.add(rateWindow * 100)
+	if r := m.rate(); r != 100 {
+		t.Error("invalid rate", r)
+	}
+	m.sec -= rateWindow
+	if r := m.rate(); r != 0 {
+		t.Error("old bytes should be forgotten", r)
+	}
+
+	n := New(nil, imesh.Default(), nil)
+	p := &peer{node: n}
+	se := setting.Setting{
+		MaxUploadRate:     1000,
+		PeerMaxUploadRate: 100,
+	}
+	if d := p.throttle(&se, true, msg.CmdTxs, 100); d != 0 {
+		t.Error("burst should not wait", d)
+	}
+	if d := p.throttle(&se, true, msg.CmdTxs, 100); d < 900*time.Millisecond {
+		t.Error("should be limited by the peer limit", d)
+	}
+	if d := p.throttle(&se, true, msg.CmdValidation, 1<<20); d != 0 {
+		t.Error("consensus messages should be exempted", d)
+	}
+	if d := p.throttle(&se, false, msg.CmdTxs, 1<<20); d != 0 {
+		t.Error("download should be unlimited", d)
+	}
+	p.sent(msg.CmdTxs, rateWindow*10)
+	p.recv(msg.CmdTxs, rateWindow*20)
+	bi := n.GetBandwidthInfo(&se)
+	if bi.UploadRate != 10 || bi.DownloadRate != 20 || bi.MaxUploadRate != 1000 || bi.PeerMaxUploadRate != 100 {
+		t.Error("invalid bandwidth info", bi)
+	}
+	if d := p.throttled(&se, true); d < 900*time.Millisecond {
+		t.Error("should wait for the peer limit", d)
+	}
+	if d := p.throttled(&se, false); d != 0 {
+		t.Error("download should not wait", d)
+	}
+
+	//consensus packets queued while waiting for the limits are written first.
+	se.Config = aklib.DebugConfig
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p2 := &peer{
+		node:   n,
+		conn:   conn,
+		remote: *msg.NewAddr("10.0.0.1:14270", msg.ServiceFull),
+		queue:  newSendQueue(),
+	}
+	defer p2.disconnect()
+	bulk := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		if err := p2.write(&se, bulk, msg.CmdTxs); err != nil {
+			t.Error(err)
+		}
+	}
+	if cmd, _, err := msg.ReadHeader(&se, remote); err != nil || cmd != msg.CmdTxs {
+		t.Error("should read txs", cmd, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := p2.write(&se, bulk, msg.CmdValidation); err != nil {
+		t.Error(err)
+	}
+	for _, c := range []byte{msg.CmdValidation, msg.CmdTxs} {
+		if cmd, _, err := msg.ReadHeader(&se, remote); err != nil || cmd != c {
+			t.Error("invalid order", cmd, c, err)
+		}
+	}
 }
@@ -23,6 +23,7 @@ package node
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -32,6 +33,7 @@ import (
 
 	akrand "github.com/AidosKuneen/aklib/rand"
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
@@ -43,17 +45,27 @@ const (
 	rwTimeout         = 30 * time.Second
 	//BanTime is time to be banned
 	BanTime = time.Hour
+	//notFoundExpiry is time to forget that a peer didn't have a tx.
+	notFoundExpiry = 10 * time.Minute
+	//pingInterval is the interval to ping peers for measuring latencies.
+	pingInterval = 2 * time.Minute
 )
 
-//peers is a slice of connecting peers.
-var peers = struct {
+//peerSet is a set of connecting peers.
+type peerSet struct {
 	Peers  map[string]*peer
-	banned map[string]time.Time
+	banned map[string]*Ban
+	scores map[string]*score
 	cons   *consensus.Peer
+	store  sync.Mutex //serializes storing the ban list
 	sync.RWMutex
-}{
-	Peers:  make(map[string]*peer),
-	banned: make(map[string]time.Time),
+}
+
+//notFoundSet records peers which replied CmdNotFound for tx hashes,
+//not to ask them again until the next search.
+type notFoundSet struct {
+	hosts map[[32]byte]map[string]time.Time
+	sync.Mutex
 }
 
 type wdata struct {
@@ -64,19 +76,44 @@ type wdata struct {
 
 //peer represetnts an opponent of a connection.
 type peer struct {
-	conn    *net.TCPConn
-	remote  msg.Addr
-	written []wdata
+	conn          net.Conn
+	reader        *msg.Reader
+	host          string //IP of the remote
+	remote        msg.Addr
+	version       uint16 //negotiated protocol version
+	compress      byte   //compression algorithm the remote can decode
+	written       []wdata
+	inbound       bool
+	connected     time.Time
+	rtt           time.Duration //latency measured by the last ping
+	minRTT        time.Duration //minimum latency measured by pings, 0 if not measured
+	useful        time.Time     //last time the remote sent us a new tx or validation
+	userAgent     string
+	remoteVersion uint16 //protocol version the remote advertised
+	stats         peerStats
+	bandwidth     bandwidth
+	whitelisted   bool //bypasses connection limits
+	perm          setting.Permission
+	queue         *sendQueue //set when added to the Peer list
+	node          *Node
 	sync.RWMutex
 }
 
-//GetBanned returns a banned list.
-func GetBanned() map[string]time.Time {
-	peers.RLock()
-	defer peers.RUnlock()
-	r := make(map[string]time.Time)
-	for k, v := range peers.banned {
-		r[k] = v
+//GetBanned returns a list of banned addresses and subnets.
+func GetBanned() map[string]Ban {
+	return std.GetBanned()
+}
+
+//GetBanned returns a list of banned addresses and subnets.
+func (n *Node) GetBanned() map[string]Ban {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	now := time.Now()
+	r := make(map[string]Ban)
+	for k, v := range n.peers.banned {
+		if v.Until.After(now) {
+			r[k] = *v
+		}
 	}
 
 	return r
@@ -84,11 +121,16 @@ func GetBanned() map[string]time.Time {
 
 //GetPeerlist returns a peer list.
 func GetPeerlist() []msg.Addr {
-	peers.RLock()
-	defer peers.RUnlock()
-	r := make([]msg.Addr, len(peers.Peers))
+	return std.GetPeerlist()
+}
+
+//GetPeerlist returns a peer list.
+func (n *Node) GetPeerlist() []msg.Addr {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	r := make([]msg.Addr, len(n.peers.Peers))
 	i := 0
-	for _, p := range peers.Peers {
+	for _, p := range n.peers.Peers {
 		r[i] = p.remote
 		i++
 	}
@@ -96,118 +138,207 @@ func GetPeerlist() []msg.Addr {
 }
 
 //ConsensusPeer is for consensus to communicate with peers.
-type ConsensusPeer struct{}
+//The zero value communicates with peers of the default Node.
+type ConsensusPeer struct {
+	n *Node
+}
+
+func (cp *ConsensusPeer) node() *Node {
+	if cp.n == nil {
+		return std
+	}
+	return cp.n
+}
 
 //GetLedger get a ledger with id.
 func (cp *ConsensusPeer) GetLedger(s *setting.Setting, id consensus.LedgerID) {
-	WriteAll(s, &id, msg.CmdGetLedger)
+	cp.node().WriteAll(s, &id, msg.CmdGetLedger)
 }
 
 //BroadcastProposal broadcast our proposal.
 func (cp *ConsensusPeer) BroadcastProposal(s *setting.Setting, p *consensus.Proposal) {
-	WriteAll(s, p, msg.CmdProposal)
+	cp.node().WriteAll(s, p, msg.CmdProposal)
 }
 
 //BroadcastValidatoin broadcast our validation.
 func (cp *ConsensusPeer) BroadcastValidatoin(s *setting.Setting, v *consensus.Validation) {
-	WriteAll(s, v, msg.CmdValidation)
+	cp.node().WriteAll(s, v, msg.CmdValidation)
 }
 
 //GetTx get a tx with hash h.
 func (cp *ConsensusPeer) GetTx(s *setting.Setting, h tx.Hash) {
-	if err := imesh.AddNoexistTxHash(s, h, tx.TypeNormal); err != nil {
+	if err := cp.node().mesh.AddNoexistTxHash(s, h, tx.TypeNormal); err != nil {
 		log.Println(err)
 	}
 }
 
 //newPeer returns Peer struct.
 //locked
-func newPeer(v *msg.Version, conn *net.TCPConn, s *setting.Setting) (*peer, error) {
-	remote := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+func (n *Node) newPeer(v *msg.Version, conn net.Conn, s *setting.Setting) (*peer, error) {
+	remote := remoteHost(conn)
+	h, po, err2 := net.SplitHostPort(v.AddrFrom.Address)
+	if err2 != nil {
+		return nil, err2
+	}
+	//inbounds from the Tor hidden service are all from localhost.
+	ip := net.ParseIP(remote)
+	viaTor := s.UseTor && ip != nil && ip.IsLoopback()
+	if viaTor && setting.IsOnion(h) {
+		remote = h
+	}
 	if s.InBlacklist(remote) {
 		return nil, errors.New("remote is in blacklist")
 	}
-	err2 := func() error {
-		peers.Lock()
-		defer peers.Unlock()
-		if t, exist := peers.banned[remote]; exist {
-			if t.Add(BanTime).Before(time.Now()) {
-				delete(peers.banned, remote)
-			} else {
-				return errors.New("the remote node is banned now")
-			}
-		}
-		return nil
-	}()
-	if err2 != nil {
-		return nil, err2
+	perm, wl := s.Whitelisted(remote)
+	if perm&setting.PermNoBan == 0 && n.isBanned(remote) {
+		return nil, errors.New("the remote node is banned now")
 	}
 	if s.InBlacklist(v.AddrFrom.Address) {
 		return nil, errors.New("remote is in blacklist")
 	}
-	if !s.UseTor {
-		h, po, err2 := net.SplitHostPort(v.AddrFrom.Address)
-		if err2 != nil {
-			return nil, err2
-		}
-		if h == "" {
-			v.AddrFrom.Address = net.JoinHostPort(remote, po)
-		}
+	if h == "" && !viaTor {
+		v.AddrFrom.Address = net.JoinHostPort(remote, po)
 	}
 
-	p := &peer{
-		conn:   conn,
-		remote: v.AddrFrom,
+	ver, err2 := v.Negotiate()
+	if err2 != nil {
+		return nil, err2
 	}
-	peers.RLock()
-	defer peers.RUnlock()
-	if len(peers.Peers) >= int(s.MaxConnections)*10 {
-		return nil, errors.New("peers are too much")
+	p := &peer{
+		conn:          conn,
+		host:          remote,
+		remote:        v.AddrFrom,
+		version:       ver,
+		compress:      v.Compression(),
+		userAgent:     v.UserAgent,
+		remoteVersion: v.Version,
+		whitelisted:   wl,
+		perm:          perm,
+		node:          n,
 	}
-	if _, exist := peers.Peers[p.remote.Address]; exist {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	if _, exist := n.peers.Peers[p.remote.Address]; exist {
 		return nil, errors.New("already connected")
 	}
 	return p, nil
 }
 
 //Add adds to the Peer list.
+//If inbound peers are full, an inbound peer is evicted for p if possible.
+//Whitelisted peers are added regardless of limits.
 func (p *peer) add(s *setting.Setting) error {
-	peers.Lock()
-	defer peers.Unlock()
-	if len(peers.Peers) >= int(s.MaxConnections)*2 {
-		return errors.New("peers is too big")
+	e, err := p.insert(s)
+	if err != nil {
+		return err
 	}
-	if _, exist := peers.Peers[p.remote.Address]; exist {
-		return errors.New("already connected")
+	if e != nil {
+		p.node.publishPeer(event.PeerDisconnected, e)
 	}
-	peers.Peers[p.remote.Address] = p
-
+	p.node.publishPeer(event.PeerConnected, p)
 	return nil
 }
 
+//insert inserts p to the Peer list and returns the evicted peer if exists.
+func (p *peer) insert(s *setting.Setting) (*peer, error) {
+	n := p.node
+	n.peers.Lock()
+	defer n.peers.Unlock()
+	if _, exist := n.peers.Peers[p.remote.Address]; exist {
+		return nil, errors.New("already connected")
+	}
+	var e *peer
+	in, out := n.countPeers()
+	switch {
+	case p.whitelisted:
+	case !p.inbound && out >= int(s.MaxOutbound):
+		return nil, errors.New("outbound peers are full")
+	case p.inbound && in >= int(s.MaxInbound):
+		e = n.evictCandidate()
+		if e == nil {
+			return nil, errors.New("inbound peers are full")
+		}
+		log.Println("evicting", e.remote.Address, "for", p.remote.Address)
+		delete(n.peers.Peers, e.remote.Address)
+		e.disconnect()
+	}
+	p.connected = time.Now()
+	if p.queue == nil {
+		p.queue = newSendQueue()
+	}
+	n.peers.Peers[p.remote.Address] = p
+
+	return e, nil
+}
+
 func (p *peer) delete() {
-	peers.Lock()
-	defer peers.Unlock()
-	delete(peers.Peers, p.remote.Address)
+	n := p.node
+	n.peers.Lock()
+	deleted := n.peers.Peers[p.remote.Address] == p
+	if deleted {
+		delete(n.peers.Peers, p.remote.Address)
+	}
+	n.peers.Unlock()
+	if p.queue != nil {
+		p.queue.close()
+	}
+	if deleted {
+		n.publishPeer(event.PeerDisconnected, p)
+	}
+}
+
+//publishPeer publishes an event typ about peer p.
+func (n *Node) publishPeer(typ event.Type, p *peer) {
+	n.Bus().Publish(&event.Event{
+		Type: typ,
+		Peer: p.remote.Address,
+	})
 }
 
-func isConnected(adr string) bool {
-	_, exist := peers.Peers[adr]
+func (n *Node) isConnected(adr string) bool {
+	_, exist := n.peers.Peers[adr]
 	return exist
 }
 
 //ConnSize returns number of connection peers.
 func ConnSize() int {
-	peers.RLock()
-	defer peers.RUnlock()
-	return len(peers.Peers)
+	return std.ConnSize()
+}
+
+//ConnSize returns number of connection peers.
+func (n *Node) ConnSize() int {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	return len(n.peers.Peers)
 }
 
 //WriteAll writes a command to all connected peers.
 func WriteAll(s *setting.Setting, m interface{}, cmd byte) {
-	peers.RLock()
-	defer peers.RUnlock()
-	for _, p := range peers.Peers {
+	std.WriteAll(s, m, cmd)
+}
+
+//WriteAll queues a command to all connected peers.
+func (n *Node) WriteAll(s *setting.Setting, m interface{}, cmd byte) {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	for _, p := range n.peers.Peers {
+		if !p.supports(cmd) {
+			continue
+		}
+		if err := p.write(s, m, cmd); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//writeRelay writes a packet to all connected peers with relay permission.
+func (n *Node) writeRelay(s *setting.Setting, m interface{}, cmd byte) {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	for _, p := range n.peers.Peers {
+		if p.perm&setting.PermRelay == 0 || !p.supports(cmd) {
+			continue
+		}
 		if err := p.write(s, m, cmd); err != nil {
 			log.Println(err)
 		}
@@ -215,26 +346,39 @@ func WriteAll(s *setting.Setting, m interface{}, cmd byte) {
 }
 
 //WriteGetData writes a get_data command to all connected peers.
-func writeGetData(s *setting.Setting, invs msg.Inventories) {
-	peers.RLock()
-	defer peers.RUnlock()
+func (n *Node) writeGetData(s *setting.Setting, invs msg.Inventories) {
+	//new search round, so ask all peers again.
+	n.notFound.Lock()
+	for _, inv := range invs {
+		delete(n.notFound.hosts, inv.Hash)
+	}
+	n.notFound.Unlock()
+
+	n.peers.RLock()
+	defer n.peers.RUnlock()
 	for i := len(invs) - 1; i >= 0; i-- {
 		j := akrand.R.Intn(i + 1)
 		invs[i], invs[j] = invs[j], invs[i]
 	}
-	if len(peers.Peers) == 0 {
+	ps := make([]*peer, 0, len(n.peers.Peers))
+	for _, p := range n.peers.Peers {
+		if p.supports(msg.CmdGetData) {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
 		log.Println("no peers to writegetdata")
 		return
 	}
-	n := 2 * len(invs) / len(peers.Peers)
-	if n*len(peers.Peers) != 2*len(invs) {
-		n++
+	per := 2 * len(invs) / len(ps)
+	if per*len(ps) != 2*len(invs) {
+		per++
 	}
 	no := 0
-	for _, p := range peers.Peers {
-		winvs := make(msg.Inventories, 0, n)
+	for _, p := range ps {
+		winvs := make(msg.Inventories, 0, per)
 		start := no
-		for i := 0; i < n; i++ {
+		for i := 0; i < per; i++ {
 			winvs = append(winvs, invs[no])
 			if no++; no >= len(invs) {
 				no = 0
@@ -249,7 +393,67 @@ func writeGetData(s *setting.Setting, invs msg.Inventories) {
 	}
 }
 
-//Write writes a packet to peer p.
+//reask asks invs which p didn't have to other peers immediately,
+//instead of waiting for the next search.
+func (n *Node) reask(s *setting.Setting, p *peer, invs msg.Inventories) {
+	n.notFound.Lock()
+	defer n.notFound.Unlock()
+	now := time.Now()
+	for h, hs := range n.notFound.hosts {
+		for adr, t := range hs {
+			if now.Sub(t) > notFoundExpiry {
+				delete(hs, adr)
+			}
+		}
+		if len(hs) == 0 {
+			delete(n.notFound.hosts, h)
+		}
+	}
+
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	ws := make(map[*peer]msg.Inventories)
+	for _, inv := range invs {
+		has, err := imesh.Has(s.DB, inv.Hash[:])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if has {
+			continue
+		}
+		hs, ok := n.notFound.hosts[inv.Hash]
+		if !ok {
+			hs = make(map[string]time.Time)
+			n.notFound.hosts[inv.Hash] = hs
+		}
+		hs[p.remote.Address] = now
+		ps := make([]*peer, 0, len(n.peers.Peers))
+		for _, q := range n.peers.Peers {
+			if _, asked := hs[q.remote.Address]; !asked && q.supports(msg.CmdGetData) {
+				ps = append(ps, q)
+			}
+		}
+		if len(ps) == 0 {
+			log.Println("no peers to reask", hex.EncodeToString(inv.Hash[:]))
+			continue
+		}
+		q := ps[akrand.R.Intn(len(ps))]
+		ws[q] = append(ws[q], inv)
+	}
+	for q, winvs := range ws {
+		if err := q.write(s, winvs, msg.CmdGetData); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//supports returns true if the remote can handle the command cmd.
+func (p *peer) supports(cmd byte) bool {
+	return msg.Supports(cmd, p.version, p.remote.Service)
+}
+
+//write queues a packet to peer p.
 func (p *peer) write(s *setting.Setting, m interface{}, cmd byte) error {
 	log.Println("writing packet cmd", cmd)
 
@@ -279,11 +483,9 @@ func (p *peer) write(s *setting.Setting, m interface{}, cmd byte) error {
 		w.data = n[:]
 		p.written = append(p.written, w)
 	}
-	if err := p.conn.SetWriteDeadline(time.Now().Add(rwTimeout)); err != nil {
-		return err
-	}
 	log.Println("writing", cmd, p.remote)
-	return msg.Write(s, m, cmd, p.conn)
+	p.node.record(p.remote.Address, false, cmd, m)
+	return p.enqueue(s, m, cmd)
 }
 
 func (p *peer) isWritten(cmd byte, data []byte) int {
@@ -297,15 +499,37 @@ func (p *peer) isWritten(cmd byte, data []byte) int {
 	return -1
 }
 
-func (p *peer) received(cmd byte, data []byte) error {
+//received removes the request cmd for a reply from the written list,
+//and returns the time the request was written.
+func (p *peer) received(cmd byte, data []byte) (time.Time, error) {
 	i := p.isWritten(cmd, data)
 	if i < 0 {
-		return fmt.Errorf("no command for %v", cmd)
+		return time.Time{}, fmt.Errorf("no command for %v", cmd)
 	}
 	p.Lock()
 	defer p.Unlock()
+	t := p.written[i].time
 	p.written = append(p.written[:i], p.written[i+1:]...)
-	return nil
+	return t, nil
+}
+
+//ping writes a ping to p for measuring the latency if no ping is waiting for the pong.
+func (p *peer) ping(s *setting.Setting) error {
+	if p.isWritten(msg.CmdPing, nil) >= 0 {
+		return nil
+	}
+	nc := nonce()
+	return p.write(s, &nc, msg.CmdPing)
+}
+
+//pong records the latency d measured by a ping.
+func (p *peer) pong(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.rtt = d
+	if p.minRTT == 0 || d < p.minRTT {
+		p.minRTT = d
+	}
 }
 
 func nonce() msg.Nonce {
@@ -318,21 +542,19 @@ func nonce() msg.Nonce {
 }
 
 //Run runs a rouintine for a peer.
-//悪・即・バン
+//The remote is banned only when its misbehaviour score crosses banThreshold.
 func (p *peer) run(s *setting.Setting) {
 	if err := p.runLoop(s); err != nil {
 		log.Println(err)
-		peers.Lock()
-		h, _, err2 := net.SplitHostPort(p.remote.Address)
-		if err2 != nil {
-			peers.banned[p.remote.Address] = time.Now()
-		} else {
-			peers.banned[h] = time.Now()
-		}
-		peers.Unlock()
-		if err3 := remove(s, p.remote); err3 != nil {
-			log.Println(err3)
+	}
+	if p.perm&setting.PermNoBan != 0 || !p.node.isBanned(p.host) {
+		if err := p.node.seen(s, p.remote); err != nil {
+			log.Println(err)
 		}
+		return
+	}
+	if err3 := p.node.remove(s, p.remote); err3 != nil {
+		log.Println(err3)
 	}
 }
 
@@ -31,13 +31,16 @@ import (
 	"github.com/AidosKuneen/aklib/tx"
 	"github.com/AidosKuneen/aknode/akconsensus"
 	"github.com/AidosKuneen/aknode/imesh"
-	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/setting"
 )
 
 func (p *peer) runLoop(s *setting.Setting) error {
+	n := p.node
 	defer p.delete()
+	if err := p.ping(s); err != nil {
+		log.Println(err)
+	}
 	for {
 		var cmd byte
 		var buf []byte
@@ -45,29 +48,54 @@ func (p *peer) runLoop(s *setting.Setting) error {
 		if err := setReadDeadline(p, time.Now().Add(connectionTimeout)); err != nil {
 			return err
 		}
-		cmd, buf, err2 = msg.ReadHeader(s, p.conn)
+		cmd, buf, err2 = p.reader.ReadHeader(s)
 		if err2 != nil {
 			if ne, ok := err2.(net.Error); ok && ne.Timeout() {
 				if i := p.isWritten(msg.CmdPing, nil); i >= 0 {
-					if err3 := remove(s, p.remote); err3 != nil {
+					if err3 := n.remove(s, p.remote); err3 != nil {
 						log.Println(err3)
 					}
 					return fmt.Errorf("no response from %v", p.remote)
 				}
-				n := nonce()
-				if err := p.write(s, &n, msg.CmdPing); err != nil {
+				nc := nonce()
+				if err := p.write(s, &nc, msg.CmdPing); err != nil {
 					return err
 				}
 				continue
 			}
+			if _, ok := err2.(*msg.ChecksumError); ok {
+				//corrupted, not misbehaving.
+				log.Println(p.remote.Address, err2, ", disconnecting")
+				return nil
+			}
+			if isIOError(err2) {
+				return err2
+			}
+			//cannot read following messages after a broken message.
+			if err := p.misbehave(s, readOffence(err2), err2); err != nil {
+				return err
+			}
 			return err2
 		}
 		log.Println("read packet cmd", cmd)
+		p.recv(cmd, p.reader.Size())
+		if d := p.throttle(s, false, cmd, p.reader.Size()); d > 0 {
+			//delays reading following messages to slow down the remote.
+			select {
+			case <-time.After(d):
+			case <-p.done():
+				return nil
+			}
+		}
+		n.record(p.remote.Address, true, cmd, buf)
 		switch cmd {
 		case msg.CmdPing:
 			v, err := msg.ReadNonce(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, offMalformed, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			if err := p.write(s, v, msg.CmdPong); err != nil {
 				log.Println(err)
@@ -77,28 +105,42 @@ func (p *peer) runLoop(s *setting.Setting) error {
 		case msg.CmdPong:
 			v, err := msg.ReadNonce(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, offMalformed, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
-			if err := p.received(msg.CmdPing, v[:]); err != nil {
-				return err
+			t, err := p.received(msg.CmdPing, v[:])
+			if err != nil {
+				if err2 := p.misbehave(s, offUnsolicited, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
+			p.pong(time.Since(t))
 
 		case msg.CmdGetAddr:
-			adrs := get(msg.MaxAddrs)
+			adrs := n.get(msg.MaxAddrs)
 			if err := p.write(s, adrs, msg.CmdAddr); err != nil {
 				log.Println(err)
 				return nil
 			}
 
 		case msg.CmdAddr:
-			if err := p.received(msg.CmdGetAddr, nil); err != nil {
-				return err
+			if _, err := p.received(msg.CmdGetAddr, nil); err != nil {
+				if err2 := p.misbehave(s, offUnsolicited, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			v, err := msg.ReadAddrs(s, buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
 			}
-			if err := putAddrs(s, *v...); err != nil {
+			if err := n.putAddrs(s, p.host, *v...); err != nil {
 				log.Println(err)
 				continue
 			}
@@ -106,7 +148,10 @@ func (p *peer) runLoop(s *setting.Setting) error {
 		case msg.CmdInv:
 			invs, err := msg.ReadInventories(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			for _, inv := range invs {
 				typ, err := inv.Type.ToTxType()
@@ -114,25 +159,36 @@ func (p *peer) runLoop(s *setting.Setting) error {
 					log.Println(err)
 					continue
 				}
-				if err := imesh.AddNoexistTxHash(s, inv.Hash[:], typ); err != nil {
+				n.fluffed(inv.Hash)
+				if err := n.mesh.AddNoexistTxHashFrom(s, inv.Hash[:], typ, p.remote.Address); err != nil {
 					log.Println(err)
 					continue
 				}
 			}
-			Resolve()
+			n.Resolve()
 
 		case msg.CmdGetData:
 			invs, err := msg.ReadInventories(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			trs := make(msg.Txs, 0, len(invs))
+			var nf msg.Inventories
 			for _, inv := range invs {
 				switch inv.Type {
 				case msg.InvTxNormal:
+					//don't reveal txs in the stem phase.
+					if n.isStem(inv.Hash[:]) {
+						nf = append(nf, inv)
+						continue
+					}
 					tr, err := imesh.GetTx(s.DB, inv.Hash[:])
 					if err != nil {
 						log.Println(err)
+						nf = append(nf, inv)
 						continue
 					}
 					trs = append(trs, &msg.Tx{
@@ -149,6 +205,7 @@ func (p *peer) runLoop(s *setting.Setting) error {
 					tr, err := imesh.GetMinableTx(s, inv.Hash[:], typ)
 					if err != nil {
 						log.Println(err)
+						nf = append(nf, inv)
 						continue
 					}
 					trs = append(trs, &msg.Tx{
@@ -156,7 +213,15 @@ func (p *peer) runLoop(s *setting.Setting) error {
 						Tx:   tr,
 					})
 				default:
-					return fmt.Errorf("unknown inv type %v", inv.Type)
+					if err2 := p.misbehave(s, offMalformed, fmt.Errorf("unknown inv type %v", inv.Type)); err2 != nil {
+						return err2
+					}
+				}
+			}
+			if len(nf) != 0 && p.supports(msg.CmdNotFound) {
+				if err := p.write(s, nf, msg.CmdNotFound); err != nil {
+					log.Println(err)
+					return nil
 				}
 			}
 			if len(trs) == 0 {
@@ -166,39 +231,72 @@ func (p *peer) runLoop(s *setting.Setting) error {
 				log.Println(err)
 				return nil
 			}
-			Resolve()
+			n.Resolve()
+
+		case msg.CmdNotFound:
+			invs, err := msg.ReadInventories(buf)
+			if err != nil {
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
+			}
+			n.reask(s, p, invs)
 
 		case msg.CmdTxs:
 			vs, err := msg.ReadTxs(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			for _, v := range vs {
 				typ, err := v.Type.ToTxType()
 				if err != nil {
-					return err
+					if err2 := p.misbehave(s, offMalformed, err); err2 != nil {
+						return err2
+					}
+					continue
 				}
 				if err := v.Tx.Check(s.Config, typ); err != nil {
-					return err
+					if err2 := p.misbehave(s, offInvalidTx, err); err2 != nil {
+						return err2
+					}
+					continue
+				}
+				has, err := imesh.Has(s.DB, v.Tx.Hash())
+				if err != nil {
+					log.Println(err)
+					continue
 				}
-				if err := imesh.CheckAddTx(s, v.Tx, typ); err != nil {
+				if err := n.mesh.CheckAddTxFrom(s, v.Tx, typ, p.remote.Address); err != nil {
 					log.Println(err)
+					continue
+				}
+				if !has {
+					p.markUseful()
 				}
 			}
-			Resolve()
+			n.Resolve()
 
 		case msg.CmdGetLeaves:
 			v, err := msg.ReadLeavesFrom(buf)
 			if err != nil {
-				log.Println(err)
-				return err
+				if err2 := p.misbehave(s, offMalformed, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
-			ls := leaves.GetAll()
+			ls := n.mesh.Leaves().GetAll()
 			idx := sort.Search(len(ls), func(i int) bool {
 				return bytes.Compare(ls[i], v[:]) >= 0
 			})
 			h := make(msg.Inventories, 0, len(ls)-idx)
 			for i := idx; i < len(ls) && i < msg.MaxLeaves; i++ {
+				if n.isStem(ls[i]) {
+					continue
+				}
 				h = append(h, &msg.Inventory{
 					Type: msg.InvTxNormal,
 					Hash: ls[i].Array(),
@@ -212,24 +310,39 @@ func (p *peer) runLoop(s *setting.Setting) error {
 		case msg.CmdLeaves:
 			v, err := msg.ReadInventories(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, readOffence(err), err); err2 != nil {
+					return err2
+				}
+				continue
 			}
-			if err := p.received(msg.CmdGetLeaves, nil); err != nil {
-				return err
+			if _, err := p.received(msg.CmdGetLeaves, nil); err != nil {
+				if err2 := p.misbehave(s, offUnsolicited, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			for _, h := range v {
 				if h.Type != msg.InvTxNormal {
-					return fmt.Errorf("invalid inventory type %v", h.Type)
+					if err2 := p.misbehave(s, offMalformed, fmt.Errorf("invalid inventory type %v", h.Type)); err2 != nil {
+						return err2
+					}
+					continue
 				}
-				if err := imesh.AddNoexistTxHash(s, h.Hash[:], tx.TypeNormal); err != nil {
+				if err := n.mesh.AddNoexistTxHashFrom(s, h.Hash[:], tx.TypeNormal, p.remote.Address); err != nil {
 					log.Println(err)
 				}
 			}
 			if len(v) == msg.MaxLeaves {
 				gl := v[len(v)-1].Hash
-				WriteAll(s, &gl, msg.CmdGetLeaves)
+				n.WriteAll(s, &gl, msg.CmdGetLeaves)
+			}
+			n.leavesReceived()
+			n.Resolve()
+
+		case msg.CmdStemTx:
+			if err := p.readStemTx(s, buf); err != nil {
+				return err
 			}
-			Resolve()
 
 		case msg.CmdClose:
 			return nil
@@ -237,7 +350,10 @@ func (p *peer) runLoop(s *setting.Setting) error {
 		case msg.CmdGetLedger:
 			v, err := akconsensus.ReadGetLeadger(buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, offMalformed, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			l, err := akconsensus.GetLedger(s, v)
 			if err != nil {
@@ -249,38 +365,54 @@ func (p *peer) runLoop(s *setting.Setting) error {
 				continue
 			}
 		case msg.CmdLedger:
-			v, err := akconsensus.ReadLeadger(s, peers.cons, buf)
+			v, err := akconsensus.ReadLeadger(s, n.peers.cons, buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, offInvalidLedger, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			id := v.ID()
-			if err := p.received(msg.CmdGetLedger, id[:]); err != nil {
-				return err
+			if _, err := p.received(msg.CmdGetLedger, id[:]); err != nil {
+				if err2 := p.misbehave(s, offUnsolicited, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
-			if err := akconsensus.PutLedger(s, v); err != nil {
-				return err
+			if err := n.cons.PutLedger(s, v); err != nil {
+				log.Println(err)
+				continue
 			}
 		case msg.CmdValidation:
-			v, noexist, err := akconsensus.ReadValidation(s, peers.cons, buf)
+			v, noexist, err := n.cons.ReadValidation(s, n.peers.cons, buf)
 			if err != nil {
-				return err
+				if err2 := p.misbehave(s, offBadSignature, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			if noexist {
-				WriteAll(s, v, msg.CmdValidation)
+				p.markUseful()
+				n.WriteAll(s, v, msg.CmdValidation)
 			}
 
 		case msg.CmdProposal:
-			v, noexist, err := akconsensus.ReadProposal(s, peers.cons, buf)
+			v, noexist, err := n.cons.ReadProposal(s, n.peers.cons, buf)
 			if err != nil {
-				log.Println(err)
-				return err
+				if err2 := p.misbehave(s, offBadSignature, err); err2 != nil {
+					return err2
+				}
+				continue
 			}
 			if noexist {
-				WriteAll(s, v, msg.CmdProposal)
+				p.markUseful()
+				n.WriteAll(s, v, msg.CmdProposal)
 			}
 
 		default:
-			return fmt.Errorf("invalid cmd %d", cmd)
+			if err2 := p.misbehave(s, offUnknownCmd, fmt.Errorf("invalid cmd %d", cmd)); err2 != nil {
+				return err2
+			}
 		}
 	}
 }
@@ -0,0 +1,292 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//lanes of send queues in priority order.
+const (
+	laneConsensus = iota
+	laneNormal
+	laneBulk
+	lanes
+)
+
+const (
+	//maxSendQueue is the max bytes of packets queued for a peer.
+	maxSendQueue = 32 * 1024 * 1024
+	//sendQueueLowWater is the bytes below which a full queue is regarded as drained.
+	sendQueueLowWater = maxSendQueue / 2
+	//sendQueueStall is the duration after which a peer whose queue stays full is disconnected.
+	sendQueueStall = rwTimeout
+	//flushTimeout is the max duration to wait for send queues at stop.
+	flushTimeout = time.Second
+)
+
+var errSendQueueFull = errors.New("send queue is full")
+
+//lane returns the lane of cmd. Consensus messages jump ahead of
+//others, and txs and leaves go after all others.
+func lane(cmd byte) int {
+	switch cmd {
+	case msg.CmdProposal, msg.CmdValidation, msg.CmdGetLedger, msg.CmdLedger:
+		return laneConsensus
+	case msg.CmdTxs, msg.CmdLeaves:
+		return laneBulk
+	}
+	return laneNormal
+}
+
+type packet struct {
+	cmd byte
+	dat []byte
+}
+
+//sendQueue is an outbound queue with priority lanes of a peer,
+//which is written to the connection by the writer routine of the peer.
+type sendQueue struct {
+	lanes   [lanes][]*packet
+	size    int       //bytes in the queue
+	full    time.Time //when the queue became full, zero if not full
+	ready   chan struct{}
+	closed  chan struct{}
+	started bool
+	sync.Mutex
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+//push queues pk. It returns errSendQueueFull with true
+//if the queue has been full for sendQueueStall.
+func (q *sendQueue) push(pk *packet) (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+	select {
+	case <-q.closed:
+		return false, errors.New("send queue is closed")
+	default:
+	}
+	if q.size+len(pk.dat) > maxSendQueue {
+		now := time.Now()
+		if q.full.IsZero() {
+			q.full = now
+		}
+		return now.Sub(q.full) >= sendQueueStall, errSendQueueFull
+	}
+	l := lane(pk.cmd)
+	q.lanes[l] = append(q.lanes[l], pk)
+	q.size += len(pk.dat)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return false, nil
+}
+
+//pop returns the first packet in the highest lane, or nil if empty.
+func (q *sendQueue) pop() *packet {
+	q.Lock()
+	defer q.Unlock()
+	for l := range q.lanes {
+		if len(q.lanes[l]) == 0 {
+			continue
+		}
+		pk := q.lanes[l][0]
+		q.lanes[l][0] = nil
+		q.lanes[l] = q.lanes[l][1:]
+		q.size -= len(pk.dat)
+		//a slow reader which drains a little doesn't reset the stall.
+		if q.size < sendQueueLowWater {
+			q.full = time.Time{}
+		}
+		return pk
+	}
+	return nil
+}
+
+//peek returns the first packet in the highest lane without removing it, or nil if empty.
+func (q *sendQueue) peek() *packet {
+	q.Lock()
+	defer q.Unlock()
+	for l := range q.lanes {
+		if len(q.lanes[l]) != 0 {
+			return q.lanes[l][0]
+		}
+	}
+	return nil
+}
+
+//len returns the bytes in the queue.
+func (q *sendQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.size
+}
+
+//close closes the queue and discards queued packets.
+func (q *sendQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	select {
+	case <-q.closed:
+		return
+	default:
+	}
+	close(q.closed)
+	for l := range q.lanes {
+		q.lanes[l] = nil
+	}
+	q.size = 0
+}
+
+//enqueue encodes m with cmd and queues it for the writer, which is started
+//at the first time. The peer is disconnected if its queue stays full.
+func (p *peer) enqueue(s *setting.Setting, m interface{}, cmd byte) error {
+	var buf bytes.Buffer
+	if err := msg.WriteCompressed(s, m, cmd, p.version, p.compress, &buf); err != nil {
+		return err
+	}
+	q := p.queue
+	if q == nil {
+		return errors.New("peer is not connected")
+	}
+	q.Lock()
+	if !q.started {
+		q.started = true
+		p.node.goWorker("writer", func() {
+			p.writeLoop(s)
+		})
+	}
+	q.Unlock()
+	stalled, err := q.push(&packet{
+		cmd: cmd,
+		dat: buf.Bytes(),
+	})
+	if stalled {
+		log.Println("send queue of", p.remote.Address, "stays full, disconnecting")
+		p.disconnect()
+	}
+	return err
+}
+
+//writeLoop writes packets in the queue to the connection until the queue is closed,
+//within upload limits in setting s.
+//It waits for the limits before popping a packet, so that consensus packets
+//queued meanwhile are written first.
+func (p *peer) writeLoop(s *setting.Setting) {
+	q := p.queue
+	for {
+		pk := q.peek()
+		if pk == nil {
+			select {
+			case <-q.ready:
+				continue
+			case <-q.closed:
+				return
+			}
+		}
+		if lane(pk.cmd) != laneConsensus {
+			if d := p.throttled(s, true); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-q.ready:
+				case <-q.closed:
+					return
+				}
+				continue
+			}
+		}
+		if pk = q.pop(); pk == nil {
+			continue
+		}
+		//the bytes are paid before popping the next packet.
+		p.throttle(s, true, pk.cmd, len(pk.dat))
+		if err := p.conn.SetWriteDeadline(time.Now().Add(rwTimeout)); err != nil {
+			log.Println(err)
+		}
+		cw := &countWriter{
+			writer: p.conn,
+		}
+		_, err := cw.Write(pk.dat)
+		p.Lock()
+		p.sent(pk.cmd, cw.n)
+		p.Unlock()
+		if err != nil {
+			log.Println(p.remote.Address, err)
+			p.disconnect()
+			return
+		}
+	}
+}
+
+//done returns a channel which is closed when p is disconnected.
+func (p *peer) done() <-chan struct{} {
+	if p.queue == nil {
+		return nil
+	}
+	return p.queue.closed
+}
+
+//disconnect closes the queue and the connection of p.
+func (p *peer) disconnect() {
+	if p.queue != nil {
+		p.queue.close()
+	}
+	if p.conn == nil {
+		return
+	}
+	if err := p.conn.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+//flush waits until queues of all peers are empty or timeout.
+func (n *Node) flush(timeout time.Duration) {
+	end := time.Now().Add(timeout)
+	for time.Now().Before(end) {
+		size := 0
+		n.peers.RLock()
+		for _, p := range n.peers.Peers {
+			if p.queue != nil {
+				size += p.queue.len()
+			}
+		}
+		n.peers.RUnlock()
+		if size == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+//workerSet is a set of running routines of a node.
+type workerSet struct {
+	running map[string]int
+	cancels []context.CancelFunc
+	wg      sync.WaitGroup
+	sync.Mutex
+}
+
+//withCancel returns a context which is canceled by Stop.
+func (n *Node) withCancel(ctx context.Context) context.Context {
+	ctx2, cancel2 := context.WithCancel(ctx)
+	n.workers.Lock()
+	n.workers.cancels = append(n.workers.cancels, cancel2)
+	n.workers.Unlock()
+	return ctx2
+}
+
+//goWorker runs f in a goroutine named name, which is waited in Stop.
+func (n *Node) goWorker(name string, f func()) {
+	n.workers.Lock()
+	n.workers.running[name]++
+	n.workers.wg.Add(1)
+	n.workers.Unlock()
+	go func() {
+		defer func() {
+			n.workers.Lock()
+			if n.workers.running[name]--; n.workers.running[name] == 0 {
+				delete(n.workers.running, name)
+			}
+			n.workers.Unlock()
+			n.workers.wg.Done()
+		}()
+		f()
+	}()
+}
+
+//Running returns names of running routines with their numbers.
+func (n *Node) Running() []string {
+	n.workers.Lock()
+	defer n.workers.Unlock()
+	r := make([]string, 0, len(n.workers.running))
+	for name, no := range n.workers.running {
+		if no > 1 {
+			name = fmt.Sprintf("%s(%d)", name, no)
+		}
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+//Stop stops the default node with timeout.
+func Stop(s *setting.Setting, timeout time.Duration) error {
+	return std.Stop(s, timeout)
+}
+
+//Stop sends close to all peers and waits for their send queues to be flushed briefly,
+//cancels all routines including miners, disconnects all peers,
+//and waits for them until timeout. After that it persists
+//the address book, unresolved txs and leaves of the iMesh.
+//If routines are still running after timeout, nothing is persisted because they may
+//still write DB, and it returns an error with their names. In that case
+//the DB must not be closed by the caller.
+func (n *Node) Stop(s *setting.Setting, timeout time.Duration) error {
+	n.WriteAll(s, nil, msg.CmdClose)
+	n.flush(flushTimeout)
+	n.workers.Lock()
+	for _, c := range n.workers.cancels {
+		c()
+	}
+	n.workers.cancels = nil
+	n.workers.Unlock()
+	//stop writers of peers.
+	n.peers.RLock()
+	for _, p := range n.peers.Peers {
+		p.disconnect()
+	}
+	n.peers.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.workers.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("still running after %v: %s", timeout, strings.Join(n.Running(), ", "))
+	}
+	if err := n.save(s); err != nil {
+		return err
+	}
+	return n.mesh.Save(s)
+}
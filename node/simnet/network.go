@@ -0,0 +1,272 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package simnet runs aknode instances in one process over an in-memory network
+// with configurable latency, loss and partitions, for integration tests.
+package simnet
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aknode/node"
+)
+
+//minRTO is the minimum delay of a retransmission of a lost write.
+const minRTO = 200 * time.Millisecond
+
+//Network is an in-memory network between nodes.
+//Loss is emulated as in TCP: a lost write is retransmitted after RTO,
+//so it delays the stream instead of corrupting it.
+type Network struct {
+	pipe      *node.PipeNetwork
+	latency   time.Duration
+	loss      float64
+	partition map[string]int //address -> group
+	conns     map[*conn]struct{}
+	rand      *rand.Rand
+	sync.Mutex
+}
+
+//NewNetwork returns a network without latency, loss and partitions.
+func NewNetwork() *Network {
+	return &Network{
+		pipe:  node.NewPipeNetwork(),
+		conns: make(map[*conn]struct{}),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+//SetLatency sets the one-way latency of all connections.
+func (n *Network) SetLatency(d time.Duration) {
+	n.Lock()
+	defer n.Unlock()
+	n.latency = d
+}
+
+//SetLoss sets the probability of losing a write, from 0 to 1.
+func (n *Network) SetLoss(p float64) {
+	n.Lock()
+	defer n.Unlock()
+	n.loss = p
+}
+
+//Partition splits nodes into groups of addresses.
+//Nodes in different groups cannot connect to each other,
+//and existing connections between them are closed.
+//Nodes not in any group can connect to all nodes.
+func (n *Network) Partition(groups ...[]string) {
+	n.Lock()
+	n.partition = make(map[string]int)
+	for i, g := range groups {
+		for _, adr := range g {
+			n.partition[adr] = i
+		}
+	}
+	var closing []*conn
+	for c := range n.conns {
+		if !n.reachable(c.local, c.remote) {
+			closing = append(closing, c)
+		}
+	}
+	n.Unlock()
+	for _, c := range closing {
+		if err := c.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Lock()
+	defer n.Unlock()
+	n.partition = nil
+}
+
+//reachable returns true if a can connect to b.
+//n must be locked by caller.
+func (n *Network) reachable(a, b string) bool {
+	ga, ok1 := n.partition[a]
+	gb, ok2 := n.partition[b]
+	return !ok1 || !ok2 || ga == gb
+}
+
+//delay returns the delay of a write.
+func (n *Network) delay() time.Duration {
+	n.Lock()
+	defer n.Unlock()
+	d := n.latency
+	for n.loss > 0 && n.rand.Float64() < n.loss {
+		rto := 2 * n.latency
+		if rto < minRTO {
+			rto = minRTO
+		}
+		d += rto
+	}
+	return d
+}
+
+//Transport returns a transport on the network for a node whose address is self.
+func (n *Network) Transport(self string) node.Transport {
+	return &transport{
+		network: n,
+		self:    self,
+		pipe:    n.pipe.Transport(self),
+	}
+}
+
+type transport struct {
+	network *Network
+	self    string
+	pipe    node.Transport
+}
+
+func (t *transport) Listen(adr string) (net.Listener, error) {
+	l, err := t.pipe.Listen(adr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{
+		Listener: l,
+		network:  t.network,
+	}, nil
+}
+
+func (t *transport) Dial(adr string) (net.Conn, error) {
+	t.network.Lock()
+	ok := t.network.reachable(t.self, adr)
+	t.network.Unlock()
+	if !ok {
+		return nil, errors.New("network is unreachable")
+	}
+	c, err := t.pipe.Dial(adr)
+	if err != nil {
+		return nil, err
+	}
+	return t.network.wrap(c, t.self, adr), nil
+}
+
+type listener struct {
+	net.Listener
+	network *Network
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.network.wrap(c, l.Addr().String(), c.RemoteAddr().String()), nil
+}
+
+type packet struct {
+	dat []byte
+	at  time.Time
+}
+
+//conn delays writes by the latency of the network.
+type conn struct {
+	net.Conn
+	network *Network
+	local   string
+	remote  string
+	queue   chan *packet
+	last    time.Time //delivery time of the last packet
+	closed  chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+func (n *Network) wrap(c net.Conn, local, remote string) *conn {
+	cn := &conn{
+		Conn:    c,
+		network: n,
+		local:   local,
+		remote:  remote,
+		queue:   make(chan *packet, 1024),
+		closed:  make(chan struct{}),
+	}
+	n.Lock()
+	n.conns[cn] = struct{}{}
+	n.Unlock()
+	go cn.pump()
+	return cn
+}
+
+//pump delivers packets in order when they arrive.
+func (c *conn) pump() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case p := <-c.queue:
+			time.Sleep(time.Until(p.at))
+			if _, err := c.Conn.Write(p.dat); err != nil {
+				if err := c.Close(); err != nil {
+					log.Println(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	at := time.Now().Add(c.network.delay())
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+	p := &packet{
+		dat: append([]byte{}, b...),
+		at:  at,
+	}
+	//select picks randomly if queue is also ready.
+	select {
+	case <-c.closed:
+		return 0, errors.New("use of closed connection")
+	default:
+	}
+	select {
+	case c.queue <- p:
+		return len(b), nil
+	case <-c.closed:
+		return 0, errors.New("use of closed connection")
+	}
+}
+
+func (c *conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.network.Lock()
+		delete(c.network.conns, c)
+		c.network.Unlock()
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package simnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/AidosKuneen/aklib"
+	"github.com/AidosKuneen/aklib/address"
+	"github.com/AidosKuneen/aklib/db"
+	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
+	"github.com/AidosKuneen/aknode/imesh"
+	"github.com/AidosKuneen/aknode/node"
+	"github.com/AidosKuneen/aknode/setting"
+	"github.com/AidosKuneen/consensus"
+)
+
+//port is the port of all simulated nodes.
+const port = 14270
+
+//stopTimeout is the timeout for stopping a node.
+const stopTimeout = 10 * time.Second
+
+//pollInterval is for polling states of nodes in Wait functions.
+const pollInterval = 100 * time.Millisecond
+
+//Config is the configuration of a simulation.
+type Config struct {
+	Nodes      int
+	Validators int    //first Validators nodes run validators trusting each other
+	Dir        string //root directory for DBs, a temporary one is used if empty
+}
+
+//Node is a simulated aknode instance.
+type Node struct {
+	Setting *setting.Setting
+	Address string
+	Node    *node.Node
+}
+
+//Sim is a simulation of aknode instances.
+type Sim struct {
+	Network *Network
+	Nodes   []*Node
+	Owner   *address.Address //owns all tokens in genesis
+	Genesis tx.Hash
+	dir     string
+	temp    bool
+	cancel  context.CancelFunc
+}
+
+//New starts cfg.Nodes nodes which connect to each other.
+func New(ctx context.Context, cfg *Config) (*Sim, error) {
+	if cfg.Nodes <= 0 || cfg.Validators > cfg.Nodes {
+		return nil, errors.New("invalid number of nodes")
+	}
+	sim := &Sim{
+		Network: NewNetwork(),
+		dir:     cfg.Dir,
+	}
+	if sim.dir == "" {
+		dir, err := ioutil.TempDir("", "simnet")
+		if err != nil {
+			return nil, err
+		}
+		sim.dir = dir
+		sim.temp = true
+	}
+	conf := *aklib.DebugConfig
+	conf.DNS = nil
+	seed := address.GenerateSeed32()
+	owner, err := address.New(&conf, seed)
+	if err != nil {
+		return nil, err
+	}
+	sim.Owner = owner
+	conf.Genesis = map[string]uint64{
+		owner.Address58(&conf): aklib.ADKSupply,
+	}
+
+	secrets := make([]string, cfg.Validators)
+	ids := make([]string, cfg.Validators)
+	for i := range secrets {
+		seed := address.GenerateSeed32()
+		secrets[i] = address.HDSeed58(&conf, seed, []byte(""), true)
+		pub, err := address.NewNode(&conf, seed)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = pub.Address58(&conf)
+	}
+	hosts := make([]string, cfg.Nodes)
+	adrs := make([]string, cfg.Nodes)
+	for i := range adrs {
+		hosts[i] = fmt.Sprintf("10.%d.0.1", i+1)
+		adrs[i] = net.JoinHostPort(hosts[i], strconv.Itoa(port))
+	}
+
+	ctx2, cancel := context.WithCancel(ctx)
+	sim.cancel = cancel
+	for i, adr := range adrs {
+		s := &setting.Setting{
+			RootDir:     filepath.Join(sim.dir, strconv.Itoa(i)),
+			Bind:        hosts[i],
+			Port:        port,
+			MyHostPort:  adr,
+			MaxInbound:  uint16(cfg.Nodes),
+			MaxOutbound: uint16(cfg.Nodes),
+		}
+		s.Config = &conf
+		for _, a := range adrs {
+			if a != adr {
+				s.DefaultNodes = append(s.DefaultNodes, a)
+			}
+		}
+		if i < cfg.Validators {
+			s.RunValidator = true
+			s.ValidatorSecret = secrets[i]
+			for j, id := range ids {
+				if j != i {
+					s.TrustedNodes = append(s.TrustedNodes, id)
+				}
+			}
+		}
+		n := &Node{
+			Setting: s,
+			Address: adr,
+		}
+		sim.Nodes = append(sim.Nodes, n)
+		if err := sim.start(ctx2, n); err != nil {
+			sim.Close()
+			return nil, err
+		}
+	}
+	sim.Genesis = sim.Nodes[0].Node.Mesh().Leaves().Get(1)[0]
+	return sim, nil
+}
+
+func (sim *Sim) start(ctx context.Context, n *Node) error {
+	var err error
+	s := n.Setting
+	if err = os.MkdirAll(s.RootDir, 0755); err != nil {
+		return err
+	}
+	s.DB, err = db.Open(filepath.Join(s.RootDir, "db"))
+	if err != nil {
+		return err
+	}
+	mesh, err := imesh.New(s)
+	if err != nil {
+		return err
+	}
+	n.Node = node.New(s, mesh, akconsensus.New(mesh, event.New()))
+	n.Node.SetTransport(sim.Network.Transport(n.Address))
+	_, err = n.Node.Start(ctx, false)
+	return err
+}
+
+//Close stops all nodes and removes DBs if they are in a temporary directory.
+func (sim *Sim) Close() {
+	for _, n := range sim.Nodes {
+		if n.Node == nil {
+			continue
+		}
+		if err := n.Node.Stop(n.Setting, stopTimeout); err != nil {
+			log.Println(err)
+		}
+	}
+	sim.cancel()
+	for _, n := range sim.Nodes {
+		if n.Setting.DB == nil {
+			continue
+		}
+		if err := n.Setting.DB.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if !sim.temp {
+		return
+	}
+	if err := os.RemoveAll(sim.dir); err != nil {
+		log.Println(err)
+	}
+}
+
+//SendTx submits tr to the i-th node as a locally originated tx.
+func (sim *Sim) SendTx(i int, tr *tx.Transaction) error {
+	n := sim.Nodes[i]
+	return n.Node.SendTx(n.Setting, tr, tx.TypeNormal)
+}
+
+//wait calls f for all nodes until f returns true for all of them or timeout.
+func (sim *Sim) wait(timeout time.Duration, f func(*Node) (bool, error)) error {
+	end := time.Now().Add(timeout)
+	for {
+		ok := true
+		for _, n := range sim.Nodes {
+			done, err := f(n)
+			if err != nil {
+				return err
+			}
+			if !done {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(end) {
+			return errors.New("timeout")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+//WaitTx waits until all nodes have the tx h.
+func (sim *Sim) WaitTx(h tx.Hash, timeout time.Duration) error {
+	return sim.wait(timeout, func(n *Node) (bool, error) {
+		return imesh.Has(n.Setting.DB, h)
+	})
+}
+
+//TxStatuses returns the status of the tx h in each node.
+func (sim *Sim) TxStatuses(h tx.Hash) ([]*imesh.TxInfo, error) {
+	r := make([]*imesh.TxInfo, len(sim.Nodes))
+	for i, n := range sim.Nodes {
+		ti, err := imesh.GetTxInfo(n.Setting.DB, h)
+		if err != nil {
+			return nil, err
+		}
+		r[i] = ti
+	}
+	return r, nil
+}
+
+//Ledgers returns the latest solid ledger of each node.
+func (sim *Sim) Ledgers() []*consensus.Ledger {
+	r := make([]*consensus.Ledger, len(sim.Nodes))
+	for i, n := range sim.Nodes {
+		r[i] = n.Node.Consensus().LatestLedger()
+	}
+	return r
+}
+
+//WaitLedger waits until all nodes reach the same solid ledger whose sequence is seq or more.
+func (sim *Sim) WaitLedger(seq consensus.Seq, timeout time.Duration) error {
+	return sim.wait(timeout, func(n *Node) (bool, error) {
+		ls := sim.Ledgers()
+		for _, l := range ls {
+			if l.Seq < seq || l.ID() != ls[0].ID() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package simnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func pair(t *testing.T, n *Network, a, b string) (net.Conn, net.Conn) {
+	l, err := n.Transport(b).Listen(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	ch := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- c
+	}()
+	c, err := n.Transport(a).Dial(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, <-ch
+}
+
+func roundTrip(t *testing.T, c1, c2 net.Conn) time.Duration {
+	start := time.Now()
+	if _, err := c1.Write([]byte("ping")); err != nil {
+		t.Error(err)
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(c2, buf[:]); err != nil {
+		t.Error(err)
+	}
+	if string(buf[:]) != "ping" {
+		t.Error("invalid data")
+	}
+	return time.Since(start)
+}
+
+func TestNetwork(t *testing.T) {
+	n := NewNetwork()
+	c1, c2 := pair(t, n, "10.1.0.1:1", "10.2.0.1:1")
+	if d := roundTrip(t, c1, c2); d > 50*time.Millisecond {
+		t.Error("should not be delayed", d)
+	}
+	if c2.RemoteAddr().String() != "10.1.0.1:1" {
+		t.Error("invalid remote address", c2.RemoteAddr())
+	}
+
+	n.SetLatency(100 * time.Millisecond)
+	if d := roundTrip(t, c2, c1); d < 100*time.Millisecond || d > 200*time.Millisecond {
+		t.Error("should be delayed by latency", d)
+	}
+	n.SetLatency(0)
+	n.SetLoss(0.5)
+	lost := false
+	for i := 0; i < 20; i++ {
+		if roundTrip(t, c1, c2) >= minRTO {
+			lost = true
+		}
+	}
+	if !lost {
+		t.Error("should be lost")
+	}
+	n.SetLoss(0)
+
+	n.Partition([]string{"10.1.0.1:1"}, []string{"10.2.0.1:1"})
+	if _, err := c1.Write([]byte("ping")); err == nil {
+		t.Error("connection should be closed by partition")
+	}
+	if _, err := n.Transport("10.1.0.1:1").Dial("10.2.0.1:1"); err == nil {
+		t.Error("should be unreachable")
+	}
+	n.Heal()
+	c1, c2 = pair(t, n, "10.1.0.1:1", "10.2.0.1:1")
+	roundTrip(t, c1, c2)
+}
+
+func TestSim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sim, err := New(ctx, &Config{Nodes: 3, Validators: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	if len(sim.Nodes) != 3 || sim.Genesis == nil {
+		t.Error("invalid sim")
+	}
+	if sim.Nodes[0].Node == sim.Nodes[1].Node ||
+		sim.Nodes[0].Node.Mesh() == sim.Nodes[1].Node.Mesh() {
+		t.Error("nodes should not share states")
+	}
+	if err := sim.WaitTx(sim.Genesis, time.Second); err != nil {
+		t.Error(err)
+	}
+}
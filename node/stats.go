@@ -0,0 +1,203 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AidosKuneen/aknode/msg"
+)
+
+//netTotals is numbers of bytes sent and received by all peers since start.
+type netTotals struct {
+	sent uint64
+	recv uint64
+}
+
+//msgStat is statistics of messages with a command.
+type msgStat struct {
+	bytes uint64
+	count uint64
+}
+
+//peerStats is statistics of messages with a peer.
+type peerStats struct {
+	sent     map[byte]*msgStat
+	recv     map[byte]*msgStat
+	lastSend time.Time
+	lastRecv time.Time
+}
+
+func (ps *peerStats) add(sent bool, cmd byte, n int) {
+	if ps.sent == nil {
+		ps.sent = make(map[byte]*msgStat)
+		ps.recv = make(map[byte]*msgStat)
+	}
+	m := ps.recv
+	if sent {
+		m = ps.sent
+		ps.lastSend = time.Now()
+	} else {
+		ps.lastRecv = time.Now()
+	}
+	st, ok := m[cmd]
+	if !ok {
+		st = &msgStat{}
+		m[cmd] = st
+	}
+	st.bytes += uint64(n)
+	st.count++
+}
+
+//countWriter counts bytes written to writer.
+type countWriter struct {
+	writer io.Writer
+	n      int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += n
+	return n, err
+}
+
+//sent records a message with cmd whose size is n was sent.
+//p must be locked by caller.
+func (p *peer) sent(cmd byte, n int) {
+	p.stats.add(true, cmd, n)
+	p.bandwidth.up.add(n)
+	p.node.bandwidth.up.add(n)
+	atomic.AddUint64(&p.node.totals.sent, uint64(n))
+}
+
+//recv records a message with cmd whose size is n was received.
+func (p *peer) recv(cmd byte, n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.stats.add(false, cmd, n)
+	p.bandwidth.down.add(n)
+	p.node.bandwidth.down.add(n)
+	atomic.AddUint64(&p.node.totals.recv, uint64(n))
+}
+
+//PeerInfo is statistics of a connected peer.
+type PeerInfo struct {
+	Address         string            `json:"address"`
+	Services        byte              `json:"services"`
+	Inbound         bool              `json:"inbound"`
+	ConnTime        int64             `json:"conntime"`
+	UserAgent       string            `json:"useragent"`
+	Version         uint16            `json:"version"`
+	NegotiatedVer   uint16            `json:"negotiated_version"`
+	BytesSent       uint64            `json:"bytessent"`
+	BytesRecv       uint64            `json:"bytesrecv"`
+	BytesSentPerMsg map[string]uint64 `json:"bytessent_per_msg"`
+	BytesRecvPerMsg map[string]uint64 `json:"bytesrecv_per_msg"`
+	MsgsSentPerMsg  map[string]uint64 `json:"msgssent_per_msg"`
+	MsgsRecvPerMsg  map[string]uint64 `json:"msgsrecv_per_msg"`
+	LastSend        int64             `json:"lastsend"`
+	LastRecv        int64             `json:"lastrecv"`
+	PingTime        float64           `json:"pingtime"` //of the last ping in seconds
+	MinPing         float64           `json:"minping"`  //in seconds
+}
+
+//NetTotals is numbers of bytes sent and received since start.
+type NetTotals struct {
+	TotalBytesRecv uint64 `json:"totalbytesrecv"`
+	TotalBytesSent uint64 `json:"totalbytessent"`
+	TimeMillis     int64  `json:"timemillis"`
+}
+
+func unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func perMsg(m map[byte]*msgStat) (map[string]uint64, map[string]uint64, uint64) {
+	bytes := make(map[string]uint64, len(m))
+	count := make(map[string]uint64, len(m))
+	var total uint64
+	for cmd, st := range m {
+		bytes[msg.CmdName(cmd)] = st.bytes
+		count[msg.CmdName(cmd)] = st.count
+		total += st.bytes
+	}
+	return bytes, count, total
+}
+
+func (p *peer) info() *PeerInfo {
+	p.RLock()
+	defer p.RUnlock()
+	pi := &PeerInfo{
+		Address:       p.remote.Address,
+		Services:      p.remote.Service,
+		Inbound:       p.inbound,
+		ConnTime:      unix(p.connected),
+		UserAgent:     p.userAgent,
+		Version:       p.remoteVersion,
+		NegotiatedVer: p.version,
+		LastSend:      unix(p.stats.lastSend),
+		LastRecv:      unix(p.stats.lastRecv),
+		PingTime:      p.rtt.Seconds(),
+		MinPing:       p.minRTT.Seconds(),
+	}
+	pi.BytesSentPerMsg, pi.MsgsSentPerMsg, pi.BytesSent = perMsg(p.stats.sent)
+	pi.BytesRecvPerMsg, pi.MsgsRecvPerMsg, pi.BytesRecv = perMsg(p.stats.recv)
+	return pi
+}
+
+//GetPeerInfo returns statistics of connected peers sorted by address.
+func GetPeerInfo() []*PeerInfo {
+	return std.GetPeerInfo()
+}
+
+//GetPeerInfo returns statistics of connected peers sorted by address.
+func (n *Node) GetPeerInfo() []*PeerInfo {
+	n.peers.RLock()
+	defer n.peers.RUnlock()
+	r := make([]*PeerInfo, 0, len(n.peers.Peers))
+	for _, p := range n.peers.Peers {
+		r = append(r, p.info())
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Address < r[j].Address
+	})
+	return r
+}
+
+//GetNetTotals returns numbers of bytes sent and received since start.
+func GetNetTotals() *NetTotals {
+	return std.GetNetTotals()
+}
+
+//GetNetTotals returns numbers of bytes sent and received since start.
+func (n *Node) GetNetTotals() *NetTotals {
+	return &NetTotals{
+		TotalBytesRecv: atomic.LoadUint64(&n.totals.recv),
+		TotalBytesSent: atomic.LoadUint64(&n.totals.sent),
+		TimeMillis:     time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
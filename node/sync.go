@@ -0,0 +1,296 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AidosKuneen/aklib/rand"
+	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/msg"
+	"github.com/AidosKuneen/aknode/setting"
+)
+
+const (
+	syncInterval      = time.Second
+	syncRetry         = 10 * time.Second //before asking a missing tx again
+	syncLeavesTimeout = time.Minute      //for waiting leaves from peers
+)
+
+//syncStallTimeout is the time after which the initial sync is given up
+//and the node relays normally if fetching makes no progress,
+//because some announced txs may never be resolved.
+var syncStallTimeout = 5 * time.Minute
+
+type syncState byte
+
+//states of the initial sync.
+const (
+	syncConnecting syncState = iota + 1 //waiting for peers
+	syncLeaves                          //waiting for leaves of peers
+	syncFetching                        //walking backwards from leaves
+	syncSynced                          //caught up, relaying normally
+)
+
+var syncStates = map[syncState]string{
+	syncConnecting: "connecting",
+	syncLeaves:     "leaves",
+	syncFetching:   "fetching",
+	syncSynced:     "synced",
+}
+
+type syncStatus struct {
+	state     syncState
+	changed   time.Time //when the state was changed
+	startNo   uint64    //#txs in imesh when fetching started
+	leaves    bool
+	requested map[[32]byte]time.Time
+	progress  time.Time             //when the last progress of fetching was made
+	lastNo    uint64                //#txs in imesh at progress
+	lastMiss  int                   //#missing txs at progress
+	locals    map[[32]byte]struct{} //locally originated txs, announced even while syncing
+	sync.RWMutex
+}
+
+//SyncInfo is the progress of the initial sync.
+type SyncInfo struct {
+	State    string  `json:"state"`
+	Known    int     `json:"known"`    //#txs fetched since the sync started
+	Missing  int     `json:"missing"`  //#txs referred but not fetched yet
+	Progress float64 `json:"progress"` //in percent
+	ETA      int64   `json:"eta"`      //in seconds, rough because missing txs refer more txs
+}
+
+func (n *Node) setSyncState(st syncState) {
+	n.syncer.Lock()
+	defer n.syncer.Unlock()
+	log.Println("sync state:", syncStates[n.syncer.state], "->", syncStates[st])
+	n.syncer.state = st
+	n.syncer.changed = time.Now()
+	switch st {
+	case syncLeaves:
+		n.syncer.leaves = false
+	case syncFetching:
+		n.syncer.startNo = n.mesh.GetTxNo()
+		n.syncer.progress = n.syncer.changed
+		n.syncer.lastNo = n.syncer.startNo
+		n.syncer.lastMiss = -1
+	case syncSynced:
+		n.syncer.requested = make(map[[32]byte]time.Time)
+	}
+}
+
+func (n *Node) isSynced() bool {
+	n.syncer.RLock()
+	defer n.syncer.RUnlock()
+	return n.syncer.state == syncSynced
+}
+
+//addLocal marks h as a locally originated tx.
+func (n *Node) addLocal(h tx.Hash) {
+	n.syncer.Lock()
+	defer n.syncer.Unlock()
+	n.syncer.locals[h.Array()] = struct{}{}
+}
+
+//takeLocal returns true and unmarks h if h is a locally originated tx.
+func (n *Node) takeLocal(h tx.Hash) bool {
+	n.syncer.Lock()
+	defer n.syncer.Unlock()
+	_, ok := n.syncer.locals[h.Array()]
+	delete(n.syncer.locals, h.Array())
+	return ok
+}
+
+//stalled returns true if fetching has made no progress for syncStallTimeout.
+func (n *Node) stalled(missing int) bool {
+	no := n.mesh.GetTxNo()
+	n.syncer.Lock()
+	defer n.syncer.Unlock()
+	if no != n.syncer.lastNo || missing != n.syncer.lastMiss {
+		n.syncer.progress = time.Now()
+		n.syncer.lastNo = no
+		n.syncer.lastMiss = missing
+		return false
+	}
+	return time.Since(n.syncer.progress) > syncStallTimeout
+}
+
+//leavesReceived notifies the syncer that leaves arrived from a peer.
+func (n *Node) leavesReceived() {
+	n.syncer.Lock()
+	defer n.syncer.Unlock()
+	n.syncer.leaves = true
+}
+
+//GetSyncInfo returns the progress of the initial sync.
+func GetSyncInfo() *SyncInfo {
+	return std.GetSyncInfo()
+}
+
+//GetSyncInfo returns the progress of the initial sync.
+func (n *Node) GetSyncInfo() *SyncInfo {
+	missing, waiting := n.mesh.Missing()
+	n.syncer.RLock()
+	defer n.syncer.RUnlock()
+	si := &SyncInfo{
+		State:   syncStates[n.syncer.state],
+		Missing: len(missing),
+	}
+	switch n.syncer.state {
+	case syncSynced:
+		si.Progress = 100
+		return si
+	case syncFetching:
+	default:
+		return si
+	}
+	si.Known = int(n.mesh.GetTxNo()-n.syncer.startNo) + waiting
+	if total := si.Known + si.Missing; total > 0 {
+		si.Progress = 100 * float64(si.Known) / float64(total)
+	}
+	if si.Known > 0 {
+		elapsed := time.Since(n.syncer.changed)
+		si.ETA = int64(elapsed.Seconds() * float64(si.Missing) / float64(si.Known))
+	}
+	return si
+}
+
+//startSync starts the initial sync, which asks leaves to all peers
+//and fetches missing txs from peers in parallel until no tx is missing.
+func (n *Node) startSync(ctx context.Context, s *setting.Setting) {
+	n.setSyncState(syncConnecting)
+	n.goWorker("sync", func() {
+		ctx2, cancel2 := context.WithCancel(ctx)
+		defer cancel2()
+		for {
+			select {
+			case <-ctx2.Done():
+				return
+			case <-time.After(syncInterval):
+				if n.syncSub(s) {
+					return
+				}
+			}
+		}
+	})
+}
+
+//syncSub runs a step of the initial sync and returns true if synced.
+func (n *Node) syncSub(s *setting.Setting) bool {
+	n.syncer.RLock()
+	st, changed, leaves := n.syncer.state, n.syncer.changed, n.syncer.leaves
+	n.syncer.RUnlock()
+
+	switch st {
+	case syncConnecting:
+		if n.ConnSize() == 0 {
+			return false
+		}
+		n.setSyncState(syncLeaves)
+		var lfrom msg.LeavesFrom
+		n.WriteAll(s, &lfrom, msg.CmdGetLeaves)
+	case syncLeaves:
+		if !leaves && time.Since(changed) < syncLeavesTimeout {
+			return false
+		}
+		n.setSyncState(syncFetching)
+	case syncFetching:
+		missing, waiting := n.mesh.Missing()
+		if len(missing) == 0 && waiting == 0 {
+			n.setSyncState(syncSynced)
+			return true
+		}
+		if n.stalled(len(missing)) {
+			log.Println("no progress in fetching, giving up", len(missing), "missing txs")
+			n.setSyncState(syncSynced)
+			return true
+		}
+		n.fetch(s, missing)
+	case syncSynced:
+		return true
+	}
+	return false
+}
+
+//fetch asks missing txs to peers, dividing them among peers.
+//A tx is asked again to another peer after syncRetry.
+func (n *Node) fetch(s *setting.Setting, missing []*tx.HashWithType) {
+	n.peers.RLock()
+	ps := make([]*peer, 0, len(n.peers.Peers))
+	for _, p := range n.peers.Peers {
+		if p.supports(msg.CmdGetData) {
+			ps = append(ps, p)
+		}
+	}
+	n.peers.RUnlock()
+	if len(ps) == 0 {
+		return
+	}
+
+	n.syncer.Lock()
+	now := time.Now()
+	ms := make(map[[32]byte]struct{}, len(missing))
+	invs := make([]msg.Inventories, len(ps))
+	i := rand.R.Intn(len(ps))
+	for _, m := range missing {
+		h := m.Hash.Array()
+		ms[h] = struct{}{}
+		if t, ok := n.syncer.requested[h]; ok && now.Sub(t) < syncRetry {
+			continue
+		}
+		typ, err := msg.TxType2InvType(m.Type)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for j := 0; j < len(ps) && len(invs[i]) >= msg.MaxInv; j++ {
+			i = (i + 1) % len(ps)
+		}
+		if len(invs[i]) >= msg.MaxInv {
+			break
+		}
+		invs[i] = append(invs[i], &msg.Inventory{
+			Type: typ,
+			Hash: h,
+		})
+		n.syncer.requested[h] = now
+		i = (i + 1) % len(ps)
+	}
+	for h := range n.syncer.requested {
+		if _, ok := ms[h]; !ok {
+			delete(n.syncer.requested, h)
+		}
+	}
+	n.syncer.Unlock()
+
+	for i, p := range ps {
+		if len(invs[i]) == 0 {
+			continue
+		}
+		if err := p.write(s, invs[i], msg.CmdGetData); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+//Transport makes connections between nodes.
+type Transport interface {
+	//Listen announces on the local address adr.
+	Listen(adr string) (net.Listener, error)
+	//Dial connects to the address adr.
+	Dial(adr string) (net.Conn, error)
+}
+
+//SetTransport sets the transport for connecting nodes.
+//nil means TCP (through proxy if set in setting).
+func SetTransport(t Transport) {
+	std.SetTransport(t)
+}
+
+//SetTransport sets the transport for connecting nodes.
+//nil means TCP (through proxy if set in setting).
+func (n *Node) SetTransport(t Transport) {
+	n.transport = t
+}
+
+type netTransport struct {
+	network string
+	dial    func(string, string) (net.Conn, error)
+}
+
+//NewTransport returns a transport on network ("tcp" or "unix"),
+//which dials via the SOCKS5 proxy if proxy is not empty.
+func NewTransport(network, proxyAdr string) (Transport, error) {
+	t := &netTransport{
+		network: network,
+		dial:    net.Dial,
+	}
+	if proxyAdr == "" {
+		return t, nil
+	}
+	if network != "tcp" {
+		return nil, errors.New("proxy is only for tcp")
+	}
+	p, err := proxy.SOCKS5("tcp", proxyAdr, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	t.dial = func(network, adr string) (net.Conn, error) {
+		conn, err := p.Dial(network, adr)
+		if err != nil {
+			return nil, err
+		}
+		return &proxiedConn{
+			Conn:   conn,
+			remote: hostAddr(adr),
+		}, nil
+	}
+	return t, nil
+}
+
+//hostAddr is a host:port which may be unresolved, e.g. an onion address.
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "tcp"
+}
+func (a hostAddr) String() string {
+	return string(a)
+}
+
+//proxiedConn is a connection through the proxy, whose remote is
+//the dialed address instead of the proxy.
+type proxiedConn struct {
+	net.Conn
+	remote hostAddr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (t *netTransport) Listen(adr string) (net.Listener, error) {
+	return net.Listen(t.network, adr)
+}
+
+func (t *netTransport) Dial(adr string) (net.Conn, error) {
+	return t.dial(t.network, adr)
+}
+
+//remoteHost returns the host of the remote of conn.
+func remoteHost(conn net.Conn) string {
+	adr := conn.RemoteAddr()
+	if tcp, ok := adr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	h, _, err := net.SplitHostPort(adr.String())
+	if err != nil {
+		return adr.String()
+	}
+	return h
+}
+
+//PipeNetwork is an in-memory network whose connections are net.Pipe.
+type PipeNetwork struct {
+	listeners map[string]*pipeListener
+	sync.Mutex
+}
+
+//NewPipeNetwork returns an empty in-memory network.
+func NewPipeNetwork() *PipeNetwork {
+	return &PipeNetwork{
+		listeners: make(map[string]*pipeListener),
+	}
+}
+
+//Transport returns a transport on the network for a node whose address is self.
+func (n *PipeNetwork) Transport(self string) Transport {
+	return &pipeTransport{
+		network: n,
+		self:    self,
+	}
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeConn struct {
+	net.Conn
+	local  pipeAddr
+	remote pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type pipeListener struct {
+	network *PipeNetwork
+	adr     pipeAddr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		l.network.Lock()
+		delete(l.network.listeners, string(l.adr))
+		l.network.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.adr
+}
+
+type pipeTransport struct {
+	network *PipeNetwork
+	self    string
+}
+
+func (t *pipeTransport) Listen(adr string) (net.Listener, error) {
+	t.network.Lock()
+	defer t.network.Unlock()
+	if _, ok := t.network.listeners[adr]; ok {
+		return nil, errors.New("address already in use")
+	}
+	l := &pipeListener{
+		network: t.network,
+		adr:     pipeAddr(adr),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[adr] = l
+	return l, nil
+}
+
+func (t *pipeTransport) Dial(adr string) (net.Conn, error) {
+	t.network.Lock()
+	l, ok := t.network.listeners[adr]
+	t.network.Unlock()
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{
+		Conn:   c2,
+		local:  pipeAddr(adr),
+		remote: pipeAddr(t.self),
+	}:
+	case <-l.closed:
+		return nil, errors.New("connection refused")
+	}
+	return &pipeConn{
+		Conn:   c1,
+		local:  pipeAddr(t.self),
+		remote: pipeAddr(adr),
+	}, nil
+}
@@ -24,6 +24,8 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"sort"
+	"time"
 
 	"github.com/AidosKuneen/aklib/address"
 	"github.com/AidosKuneen/aklib/rpc"
@@ -32,40 +34,98 @@ import (
 	"github.com/AidosKuneen/aknode/walletImpl"
 )
 
-func listpeer(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) listpeer(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	res.Result = node.GetPeerlist()
 	return nil
 }
-func dumpprivkey(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	if pwd == nil {
+
+func (sv *Server) getpeerinfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	res.Result = node.GetPeerInfo()
+	return nil
+}
+
+func (sv *Server) getnettotals(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	res.Result = node.GetNetTotals()
+	return nil
+}
+
+func (sv *Server) getconnstate(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	res.Result = node.GetConnState()
+	return nil
+}
+
+func (sv *Server) dumpprivkey(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
+	if sv.wallet.pwd == nil {
 		return errors.New("call walletpassphrase first")
 	}
-	seed, err := wallet.DecryptSeed(pwd)
+	seed, err := sv.wallet.DecryptSeed(sv.wallet.pwd)
 	if err != nil {
 		return err
 	}
-	res.Result = address.HDSeed58(conf.Config, seed, pwd, false)
+	res.Result = address.HDSeed58(conf.Config, seed, sv.wallet.pwd, false)
 	return nil
 }
 
-func listbanned(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) listbanned(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	bs := node.GetBanned()
 	banned := make([]*rpc.Bans, 0, len(bs))
 	for k, v := range bs {
 		banned = append(banned, &rpc.Bans{
 			Address: k,
-			Created: v.Unix(),
-			Until:   v.Add(node.BanTime).Unix(),
-			Reason:  "node misbehaving",
+			Created: v.Created.Unix(),
+			Until:   v.Until.Unix(),
+			Reason:  v.Reason,
 		})
 	}
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].Address < banned[j].Address
+	})
 	res.Result = banned
 	return nil
 }
 
-func stop(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+//setban bans an IP address or a CIDR subnet.
+//params: address, bantime in seconds (optional), reason (optional)
+func (sv *Server) setban(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	var adr, reason string
+	var bantime int64
+	n, err := parseParam(req, &adr, &bantime, &reason)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > 3 {
+		return errors.New("invalid param length")
+	}
+	d := node.BanTime
+	if bantime < 0 {
+		return errors.New("invalid bantime")
+	}
+	if bantime > 0 {
+		d = time.Duration(bantime) * time.Second
+	}
+	if reason == "" {
+		reason = "manually banned"
+	}
+	return node.SetBan(conf, adr, reason, d)
+}
+
+//clearban removes an IP address or a CIDR subnet from the ban list.
+//All bans are removed if no address is specified.
+func (sv *Server) clearban(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	var adr string
+	n, err := parseParam(req, &adr)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return errors.New("invalid param length")
+	}
+	return node.ClearBan(conf, adr)
+}
+
+func (sv *Server) stop(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	res.Result = "aknode servere stopping"
 	conf.Stop <- struct{}{}
 	return nil
@@ -78,7 +138,7 @@ type dump struct {
 	Address map[string]*walletImpl.Address `json:"address"`
 }
 
-func dumpwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) dumpwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	fname := ""
 	n, err := parseParam(req, &fname)
 	if err != nil {
@@ -87,8 +147,8 @@ func dumpwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) erro
 	if n != 1 {
 		return errors.New("invalid #params")
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
 	h, err := walletImpl.GetHistory(&conf.DBConfig)
 	if err != nil {
 		return err
@@ -98,7 +158,7 @@ func dumpwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) erro
 		return err
 	}
 	d := &dump{
-		Wallet:  wallet,
+		Wallet:  sv.wallet.Wallet,
 		Hist:    h,
 		Address: adrs,
 	}
@@ -109,7 +169,7 @@ func dumpwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) erro
 	return ioutil.WriteFile(fname, dat, 0644)
 }
 
-func importwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) importwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	fname := ""
 	n, err := parseParam(req, &fname)
 	if err != nil {
@@ -126,14 +186,14 @@ func importwallet(conf *setting.Setting, req *rpc.Request, res *rpc.Response) er
 	if err := json.Unmarshal(dat, &d); err != nil {
 		return err
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	*wallet = *d.Wallet
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	*sv.wallet.Wallet = *d.Wallet
 	if err := walletImpl.PutHistory(&conf.DBConfig, d.Hist); err != nil {
 		return err
 	}
 	for _, adr := range d.Address {
-		if err := wallet.PutAddress(&conf.DBConfig, pwd, adr, false); err != nil {
+		if err := sv.wallet.PutAddress(&conf.DBConfig, sv.wallet.pwd, adr, false); err != nil {
 			return err
 		}
 	}
@@ -38,7 +38,7 @@ import (
 	"github.com/AidosKuneen/aklib/db"
 	"github.com/AidosKuneen/aklib/rpc"
 	"github.com/AidosKuneen/aklib/tx"
-	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/msg"
 	"github.com/AidosKuneen/aknode/node"
@@ -53,15 +53,15 @@ func TestControlAPI(t *testing.T) {
 	defer teardown(t)
 	defer cancel()
 
-	pwd = []byte("pwd")
-	if err := New(&s, pwd); err != nil {
+	std.wallet.pwd = []byte("pwd")
+	if err := New(&s, std.wallet.pwd); err != nil {
 		t.Error(err)
 	}
-	_, err := wallet.DecryptSeed(pwd)
+	_, err := std.wallet.DecryptSeed(std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	GoNotify(ctx, &s, node.RegisterTxNotifier, akconsensus.RegisterTxNotifier)
+	GoNotify(ctx, &s, event.Default())
 	acs := []string{"ac1"}
 	var adr string
 	for _, ac := range acs {
@@ -92,7 +92,7 @@ func TestControlAPI(t *testing.T) {
 	testdumpseed(t)
 	teststop(t)
 	testdumpwallet(t)
-	testimportwallet(t, pwd)
+	testimportwallet(t, std.wallet.pwd)
 
 	to := net.JoinHostPort(s.Bind, strconv.Itoa(int(s.Port)))
 	conn, err2 := net.DialTimeout("tcp", to, 3*time.Second)
@@ -136,6 +136,8 @@ func TestControlAPI(t *testing.T) {
 	}
 	time.Sleep(5 * time.Second)
 	testlistpeer(t, 1)
+	testgetpeerinfo(t)
+	testgetnettotals(t)
 	ni := testgetnodeinfo(t)
 	if ni.Connections != 1 {
 		t.Error("invalid nodeinfo")
@@ -158,6 +160,61 @@ func TestControlAPI(t *testing.T) {
 	}
 	testlistpeer(t, 0)
 	testlistbanned(t)
+	testsetban(t)
+}
+
+func testsetban(t *testing.T) {
+	req := &rpc.Request{
+		JSONRPC: "1.0",
+		ID:      "curltest",
+		Method:  "setban",
+		Params:  json.RawMessage(`["192.168.0.1/24", 600, "spam"]`),
+	}
+	var resp rpc.Response
+	if err := std.setban(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	req.Params = json.RawMessage(`["192.168.0.300"]`)
+	if err := std.setban(&s, req, &resp); err == nil {
+		t.Error("should be error")
+	}
+	req.Method = "listbanned"
+	req.Params = json.RawMessage{}
+	if err := std.listbanned(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	bs, ok := resp.Result.([]*rpc.Bans)
+	if !ok {
+		t.Error("invalid return")
+	}
+	if len(bs) != 2 {
+		t.Error("invalid listbanned")
+	}
+	if bs[1].Address != "192.168.0.0/24" || bs[1].Reason != "spam" ||
+		bs[1].Until-bs[1].Created != 600 {
+		t.Error("invalid banned", bs[1])
+	}
+
+	req.Method = "clearban"
+	req.Params = json.RawMessage(`["192.168.0.0/24"]`)
+	if err := std.clearban(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	req.Params = json.RawMessage{}
+	if err := std.clearban(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	req.Method = "listbanned"
+	if err := std.listbanned(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	bs, ok = resp.Result.([]*rpc.Bans)
+	if !ok {
+		t.Error("invalid return")
+	}
+	if len(bs) != 0 {
+		t.Error("invalid listbanned")
+	}
 }
 
 func testlistbanned(t *testing.T) {
@@ -168,7 +225,7 @@ func testlistbanned(t *testing.T) {
 		Params:  json.RawMessage{},
 	}
 	var resp rpc.Response
-	if err := listbanned(&s, req, &resp); err != nil {
+	if err := std.listbanned(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -202,7 +259,7 @@ func testlistpeer(t *testing.T, n int) {
 		Params:  json.RawMessage{},
 	}
 	var resp rpc.Response
-	if err := listpeer(&s, req, &resp); err != nil {
+	if err := std.listpeer(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -219,7 +276,7 @@ func testlistpeer(t *testing.T, n int) {
 	if n == 0 {
 		return
 	}
-	if peers[0].Service != 0 {
+	if peers[0].Service != msg.ServiceFull {
 		t.Error("invalid peerlist")
 	}
 	if !strings.HasPrefix(peers[0].Address, "127.0.0.1:") &&
@@ -228,6 +285,58 @@ func testlistpeer(t *testing.T, n int) {
 	}
 }
 
+func testgetpeerinfo(t *testing.T) {
+	req := &rpc.Request{
+		JSONRPC: "1.0",
+		ID:      "curltest",
+		Method:  "getpeerinfo",
+		Params:  json.RawMessage{},
+	}
+	var resp rpc.Response
+	if err := std.getpeerinfo(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	if resp.Error != nil {
+		t.Error(resp.Error)
+	}
+	t.Log(resp.Result)
+	pis, ok := resp.Result.([]*node.PeerInfo)
+	if !ok {
+		t.Error("invalid return")
+	}
+	if len(pis) != 1 {
+		t.Fatal("invalid peerinfo")
+	}
+	if !pis[0].Inbound || pis[0].Version != msg.MessageVersion ||
+		pis[0].ConnTime == 0 || pis[0].UserAgent == "" {
+		t.Error("invalid peerinfo", pis[0])
+	}
+}
+
+func testgetnettotals(t *testing.T) {
+	req := &rpc.Request{
+		JSONRPC: "1.0",
+		ID:      "curltest",
+		Method:  "getnettotals",
+		Params:  json.RawMessage{},
+	}
+	var resp rpc.Response
+	if err := std.getnettotals(&s, req, &resp); err != nil {
+		t.Error(err)
+	}
+	if resp.Error != nil {
+		t.Error(resp.Error)
+	}
+	t.Log(resp.Result)
+	nt, ok := resp.Result.(*node.NetTotals)
+	if !ok {
+		t.Error("invalid return")
+	}
+	if nt.TimeMillis == 0 {
+		t.Error("invalid nettotals")
+	}
+}
+
 func testdumpseed(t *testing.T) {
 	req := &rpc.Request{
 		JSONRPC: "1.0",
@@ -236,7 +345,7 @@ func testdumpseed(t *testing.T) {
 		Params:  json.RawMessage{},
 	}
 	var resp rpc.Response
-	if err := dumpprivkey(&s, req, &resp); err != nil {
+	if err := std.dumpprivkey(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -247,11 +356,11 @@ func testdumpseed(t *testing.T) {
 	if !ok {
 		t.Error("invalid return")
 	}
-	r, _, err := address.HDFrom58(s.Config, seed, pwd)
+	r, _, err := address.HDFrom58(s.Config, seed, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	se, err := wallet.DecryptSeed(pwd)
+	se, err := std.wallet.DecryptSeed(std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -269,7 +378,7 @@ func teststop(t *testing.T) {
 		Params:  json.RawMessage{},
 	}
 	var resp rpc.Response
-	if err := stop(&s, req, &resp); err != nil {
+	if err := std.stop(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -296,7 +405,7 @@ func testdumpwallet(t *testing.T) {
 	}
 	t.Log(wdat, string(req.Params))
 	var resp rpc.Response
-	if err := dumpwallet(&s, req, &resp); err != nil {
+	if err := std.dumpwallet(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -309,12 +418,12 @@ func testdumpwallet(t *testing.T) {
 
 func testimportwallet(t *testing.T, pwdd []byte) {
 	wdat := filepath.Join(tdir, "tmp.dat")
-	bu := wallet
-	wallet = &walletImpl.Wallet{
+	bu := std.wallet.Wallet
+	std.wallet.Wallet = &walletImpl.Wallet{
 		AddressChange: make(map[string]struct{}),
 		AddressPublic: make(map[string]struct{}),
 	}
-	pwd = pwdd
+	std.wallet.pwd = pwdd
 	hist, err := walletImpl.GetHistory(&s.DBConfig)
 	if err != nil {
 		t.Error(err)
@@ -352,39 +461,39 @@ func testimportwallet(t *testing.T, pwdd []byte) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err2 := importwallet(&s, req, &resp); err2 != nil {
+	if err2 := std.importwallet(&s, req, &resp); err2 != nil {
 		t.Error(err2)
 	}
 	if resp.Error != nil {
 		t.Error(resp.Error)
 	}
-	if !bytes.Equal(bu.EncSeed, wallet.EncSeed) {
+	if !bytes.Equal(bu.EncSeed, std.wallet.EncSeed) {
 		t.Error("invalid encseed")
 	}
-	if bu.Pool.Index != wallet.Pool.Index {
+	if bu.Pool.Index != std.wallet.Pool.Index {
 		t.Error("invalid pool index")
 	}
-	if len(bu.Pool.Address) != len(wallet.Pool.Address) {
+	if len(bu.Pool.Address) != len(std.wallet.Pool.Address) {
 		t.Error("invalid pool address")
 	}
 	for i := range bu.Pool.Address {
-		if bu.Pool.Address[i] != wallet.Pool.Address[i] {
+		if bu.Pool.Address[i] != std.wallet.Pool.Address[i] {
 			t.Error("invalid pool address")
 		}
 	}
-	if len(bu.AddressChange) != len(wallet.AddressChange) {
+	if len(bu.AddressChange) != len(std.wallet.AddressChange) {
 		t.Error("invalid account address")
 	}
-	if len(bu.AddressPublic) != len(wallet.AddressPublic) {
+	if len(bu.AddressPublic) != len(std.wallet.AddressPublic) {
 		t.Error("invalid account address")
 	}
 	for adr := range bu.AddressChange {
-		if _, ok := wallet.AddressChange[adr]; !ok {
+		if _, ok := std.wallet.AddressChange[adr]; !ok {
 			t.Error("invalid account address")
 		}
 	}
 	for adr := range bu.AddressPublic {
-		if _, ok := wallet.AddressPublic[adr]; !ok {
+		if _, ok := std.wallet.AddressPublic[adr]; !ok {
 			t.Error("invalid account address")
 		}
 	}
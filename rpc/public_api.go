@@ -41,7 +41,7 @@ import (
 	"github.com/AidosKuneen/consensus"
 )
 
-func sendrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) sendrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var txent []byte
 	typ := tx.TypeNormal
 	n, err := parseParam(req, &txent, &typ)
@@ -68,17 +68,24 @@ func sendrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 		}
 		typ = tx.TypeNormal
 	}
-	if err := imesh.CheckAddTx(conf, &tr, typ); err != nil {
+	if err := node.SendTx(conf, &tr, typ); err != nil {
 		return err
 	}
-	node.Resolve()
 	res.Result = hex.EncodeToString(tr.Hash())
 	return nil
 }
 
-func getnodeinfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+//nodeInfo is rpc.NodeInfo with the progress of the initial sync
+//and the bandwidth of the node.
+type nodeInfo struct {
+	*rpc.NodeInfo
+	Sync      *node.SyncInfo      `json:"sync"`
+	Bandwidth *node.BandwidthInfo `json:"bandwidth"`
+}
+
+func (sv *Server) getnodeinfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	lid := akconsensus.LatestLedger().ID()
-	res.Result = &rpc.NodeInfo{
+	ni := &rpc.NodeInfo{
 		Version:         setting.Version,
 		ProtocolVersion: msg.MessageVersion,
 		WalletVersion:   walletVersion,
@@ -91,10 +98,15 @@ func getnodeinfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) err
 		LatestLedger:    hex.EncodeToString(lid[:]),
 		LatestLedgerNo:  int(akconsensus.LatestLedger().Seq),
 	}
+	res.Result = &nodeInfo{
+		NodeInfo:  ni,
+		Sync:      node.GetSyncInfo(),
+		Bandwidth: node.GetBandwidthInfo(conf),
+	}
 	return nil
 }
 
-func getleaves(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getleaves(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	num := tx.DefaultPreviousSize
 	n, err := parseParam(req, &num)
 	if err != nil {
@@ -112,7 +124,7 @@ func getleaves(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 	return nil
 }
 
-func getlasthistory(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getlasthistory(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	adr := ""
 	n, err := parseParam(req, &adr)
 	if err != nil {
@@ -136,7 +148,7 @@ func getlasthistory(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	res.Result = r
 	return nil
 }
-func getrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	txid := ""
 	jsonformat := false
 	n, err := parseParam(req, &txid, &jsonformat)
@@ -162,7 +174,7 @@ func getrawtx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 	return nil
 }
 
-func getminabletx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getminabletx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var v interface{}
 	n, err := parseParam(req, &v)
 	if err != nil {
@@ -206,7 +218,7 @@ func getminabletx(conf *setting.Setting, req *rpc.Request, res *rpc.Response) er
 	return nil
 }
 
-func gettxsstatus(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) gettxsstatus(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	if len(req.Params) == 0 {
 		return errors.New("must specify txid")
 	}
@@ -271,7 +283,7 @@ func gettxsstatus(conf *setting.Setting, req *rpc.Request, res *rpc.Response) er
 	return nil
 }
 
-func getmultisiginfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getmultisiginfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	if len(req.Params) == 0 {
 		return errors.New("must specify mutisig address")
 	}
@@ -294,7 +306,7 @@ func getmultisiginfo(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	return nil
 }
 
-func getledger(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getledger(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	txid := ""
 	n, err := parseParam(req, &txid)
 	if err != nil {
@@ -125,7 +125,7 @@ func testgetmultisiginfo(t *testing.T, tr *tx.Transaction) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getmultisiginfo(&s, req, &resp); err != nil {
+	if err := std.getmultisiginfo(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -165,7 +165,7 @@ func testgettxsstatus(t *testing.T, h tx.Hash, isConf bool) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := gettxsstatus(&s, req, &resp); err != nil {
+	if err := std.gettxsstatus(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -211,7 +211,7 @@ func testgethist(t *testing.T, h tx.Hash) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getlasthistory(&s, req, &resp); err != nil {
+	if err := std.getlasthistory(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -254,7 +254,7 @@ func testgetleaves(t *testing.T, l tx.Hash) {
 		Method:  "getleaves",
 	}
 	var resp rpc.Response
-	if err := getleaves(&s, req, &resp); err != nil {
+	if err := std.getleaves(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -292,7 +292,7 @@ func testsendrawtx(t *testing.T, tr *tx.Transaction, typ tx.Type) {
 	}
 
 	var resp rpc.Response
-	if err2 := sendrawtx(&s, req, &resp); err2 != nil {
+	if err2 := std.sendrawtx(&s, req, &resp); err2 != nil {
 		t.Error(err2, typ)
 	}
 	if resp.Error != nil {
@@ -325,7 +325,7 @@ func testgetrawtx(t *testing.T, format bool) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getrawtx(&s, req, &resp); err != nil {
+	if err := std.getrawtx(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -365,7 +365,7 @@ func testgetfeetx(t *testing.T, min float64, h tx.Hash) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getminabletx(&s, req, &resp); err != nil {
+	if err := std.getminabletx(&s, req, &resp); err != nil {
 		if h == nil {
 			if err == nil {
 				t.Error("should be error")
@@ -403,7 +403,7 @@ func testgettickettx(t *testing.T, h tx.Hash) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getminabletx(&s, req, &resp); err != nil {
+	if err := std.getminabletx(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -436,7 +436,7 @@ func testgetledger(t *testing.T) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getledger(&s, req, &resp); err != nil {
+	if err := std.getledger(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
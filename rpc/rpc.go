@@ -28,6 +28,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/AidosKuneen/aklib/rpc"
@@ -35,54 +36,108 @@ import (
 	"golang.org/x/net/netutil"
 )
 
-type rpcfunc func(*setting.Setting, *rpc.Request, *rpc.Response) error
+type rpcfunc func(*Server, *setting.Setting, *rpc.Request, *rpc.Response) error
 
 var publicRPCs = map[string]rpcfunc{
-	"sendrawtx":       sendrawtx,
-	"getnodeinfo":     getnodeinfo,
-	"getleaves":       getleaves,
-	"getlasthistory":  getlasthistory,
-	"getrawtx":        getrawtx,
-	"getminabletx":    getminabletx,
-	"gettxsstatus":    gettxsstatus,
-	"getmultisiginfo": getmultisiginfo,
-	"getledger":       getledger,
+	"sendrawtx":       (*Server).sendrawtx,
+	"getnodeinfo":     (*Server).getnodeinfo,
+	"getleaves":       (*Server).getleaves,
+	"getlasthistory":  (*Server).getlasthistory,
+	"getrawtx":        (*Server).getrawtx,
+	"getminabletx":    (*Server).getminabletx,
+	"gettxsstatus":    (*Server).gettxsstatus,
+	"getmultisiginfo": (*Server).getmultisiginfo,
+	"getledger":       (*Server).getledger,
 }
 
 var rpcs = map[string]rpcfunc{
 	//control
-	"listpeer":     listpeer,
-	"listbanned":   listbanned,
-	"stop":         stop,
-	"dumpwallet":   dumpwallet,
-	"importwallet": importwallet,
-	"dumpprivkey":  dumpprivkey,
+	"listpeer":     (*Server).listpeer,
+	"getpeerinfo":  (*Server).getpeerinfo,
+	"getnettotals": (*Server).getnettotals,
+	"getconnstate": (*Server).getconnstate,
+	"listbanned":   (*Server).listbanned,
+	"setban":       (*Server).setban,
+	"clearban":     (*Server).clearban,
+	"stop":         (*Server).stop,
+	"dumpwallet":   (*Server).dumpwallet,
+	"importwallet": (*Server).importwallet,
+	"dumpprivkey":  (*Server).dumpprivkey,
 
 	//wallet
-	"gettransaction":       gettransaction,
-	"validateaddress":      validateaddress,
-	"getnewaddress":        getnewaddress,
-	"listaccounts":         listaccounts,
-	"listaddressgroupings": listaddressgroupings,
-	"settxfee":             settxfee,
-	"getbalance":           getbalance,
-	"listtransactions":     listtransactions,
-	"getaccount":           getaccount,
+	"gettransaction":       (*Server).gettransaction,
+	"validateaddress":      (*Server).validateaddress,
+	"getnewaddress":        (*Server).getnewaddress,
+	"listaccounts":         (*Server).listaccounts,
+	"listaddressgroupings": (*Server).listaddressgroupings,
+	"settxfee":             (*Server).settxfee,
+	"getbalance":           (*Server).getbalance,
+	"listtransactions":     (*Server).listtransactions,
+	"getaccount":           (*Server).getaccount,
 
 	//send
-	"sendmany":         sendmany,
-	"sendfrom":         sendfrom,
-	"sendtoaddress":    sendtoaddress,
-	"walletpassphrase": walletpassphrase,
-	"walletlock":       walletlock,
+	"sendmany":         (*Server).sendmany,
+	"sendfrom":         (*Server).sendfrom,
+	"sendtoaddress":    (*Server).sendtoaddress,
+	"walletpassphrase": (*Server).walletpassphrase,
+	"walletlock":       (*Server).walletlock,
 }
 
-//Run runs RPC server.
+//Server is an RPC server with a wallet.
+type Server struct {
+	wallet *Wallet
+	notify sync.WaitGroup //goroutine of GoNotify
+	//server is the running server, which is stopped by Shutdown.
+	server struct {
+		*http.Server
+		sync.Mutex
+	}
+}
+
+var std = newServer(&Wallet{})
+
+func newServer(w *Wallet) *Server {
+	return &Server{
+		wallet: w,
+	}
+}
+
+//NewServer returns a Server with the wallet in DB of s.
+func NewServer(s *setting.Setting) (*Server, error) {
+	w, err := NewWallet(s)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(w), nil
+}
+
+//Shutdown stops the default server.
+func Shutdown(ctx context.Context) error {
+	return std.Shutdown(ctx)
+}
+
+//Shutdown stops accepting requests and waits for running requests until ctx is done.
+func (sv *Server) Shutdown(ctx context.Context) error {
+	sv.server.Lock()
+	s := sv.server.Server
+	sv.server.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Shutdown(ctx)
+}
+
+//Run runs the default RPC server.
 func Run(ctx context.Context, setting *setting.Setting) net.Listener {
+	return std.Run(ctx, setting)
+}
+
+//Run runs RPC server.
+func (sv *Server) Run(ctx context.Context, setting *setting.Setting) net.Listener {
 	ipport := fmt.Sprintf("%s:%d", setting.RPCBind, setting.RPCPort)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handle(setting, w, r)
+		sv.handle(setting, w, r)
 	})
 
 	s := &http.Server{
@@ -93,6 +148,9 @@ func Run(ctx context.Context, setting *setting.Setting) net.Listener {
 		ReadHeaderTimeout: 30 * time.Minute,
 		MaxHeaderBytes:    1 << 20,
 	}
+	sv.server.Lock()
+	sv.server.Server = s
+	sv.server.Unlock()
 	fmt.Println("Starting RPC Server on", ipport)
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -142,7 +200,7 @@ func isValidAuth(s *setting.Setting, w http.ResponseWriter, r *http.Request) err
 }
 
 //Handle handles api calls.
-func handle(s *setting.Setting, w http.ResponseWriter, r *http.Request) {
+func (sv *Server) handle(s *setting.Setting, w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := r.Body.Close(); err != nil {
 			log.Println(err)
@@ -167,7 +225,7 @@ func handle(s *setting.Setting, w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		err = f(s, &req, &res)
+		err = f(sv, s, &req, &res)
 	}
 	if f, ok := rpcs[req.Method]; ok {
 		exist = true
@@ -178,7 +236,7 @@ func handle(s *setting.Setting, w http.ResponseWriter, r *http.Request) {
 				log.Println(err2)
 				return
 			}
-			err = f(s, &req, &res)
+			err = f(sv, s, &req, &res)
 		}
 	}
 	if !exist {
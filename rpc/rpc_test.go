@@ -71,7 +71,8 @@ func setup(ctx context.Context, t *testing.T) {
 	}
 
 	s.Config = aklib.DebugConfig
-	s.MaxConnections = 1
+	s.MaxInbound = 2
+	s.MaxOutbound = 1
 	s.Bind = "127.0.0.1"
 	s.Port = uint16(rand.Int31n(10000)) + 1025
 	s.MyHostPort = ":" + strconv.Itoa(int(s.Port))
@@ -107,7 +108,8 @@ func setup(ctx context.Context, t *testing.T) {
 	genesis = gs[0]
 
 	s1.Config = aklib.DebugConfig
-	s1.MaxConnections = 1
+	s1.MaxInbound = 2
+	s1.MaxOutbound = 1
 	s1.Port = uint16(rand.Int31n(10000)) + 1025
 	s1.MyHostPort = ":" + strconv.Itoa(int(s1.Port))
 	var err error
@@ -31,7 +31,7 @@ import (
 	"github.com/AidosKuneen/aknode/setting"
 )
 
-func walletpassphrase(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) walletpassphrase(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var spwd string
 	var sec uint
 	n, err := parseParam(req, &spwd, &sec)
@@ -42,32 +42,32 @@ func walletpassphrase(conf *setting.Setting, req *rpc.Request, res *rpc.Response
 	if n != 2 {
 		return errors.New("invalid #params")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	if pwd != nil {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	if sv.wallet.pwd != nil {
 		return errors.New("wallet is already unlocked")
 	}
-	if err := wallet.FillPool(&conf.DBConfig, []byte(spwd)); err != nil {
+	if err := sv.wallet.FillPool(&conf.DBConfig, []byte(spwd)); err != nil {
 		return err
 	}
-	pwd = []byte(spwd)
+	sv.wallet.pwd = []byte(spwd)
 	go func() {
 		time.Sleep(time.Second * time.Duration(sec))
-		mutex.Lock()
-		pwd = nil
-		mutex.Unlock()
+		sv.wallet.mutex.Lock()
+		sv.wallet.pwd = nil
+		sv.wallet.mutex.Unlock()
 	}()
 	return nil
 }
 
-func walletlock(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	pwd = nil
+func (sv *Server) walletlock(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	sv.wallet.pwd = nil
 	return nil
 }
 
-func sendmany(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) sendmany(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var acc string
 	target := map[string]float64{}
 	n, err := parseParam(req, &acc, &target)
@@ -77,9 +77,9 @@ func sendmany(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 	if n < 2 || n > 5 {
 		return errors.New("invalid param length")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	if pwd == nil {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	if sv.wallet.pwd == nil {
 		return errors.New("not priviledged")
 	}
 	trs := make([]*tx.RawOutput, len(target))
@@ -91,14 +91,14 @@ func sendmany(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 		}
 		i++
 	}
-	if acc != wallet.AccountName {
+	if acc != sv.wallet.AccountName {
 		return errors.New("invalid account name")
 	}
-	res.Result, err = Send(conf, []byte(conf.RPCTxTag), trs...)
+	res.Result, err = sv.Send(conf, []byte(conf.RPCTxTag), trs...)
 	return err
 }
 
-func sendfrom(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) sendfrom(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var acc, adrstr string
 	var value float64
 	n, err := parseParam(req, &acc, &adrstr, &value)
@@ -108,15 +108,15 @@ func sendfrom(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 	if n < 3 || n > 6 {
 		return errors.New("invalid param length")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	if pwd == nil {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	if sv.wallet.pwd == nil {
 		return errors.New("not priviledged")
 	}
-	if acc != wallet.AccountName {
+	if acc != sv.wallet.AccountName {
 		return errors.New("invalid account name")
 	}
-	res.Result, err = Send(conf, []byte(conf.RPCTxTag), &tx.RawOutput{
+	res.Result, err = sv.Send(conf, []byte(conf.RPCTxTag), &tx.RawOutput{
 		Address: adrstr,
 		Value:   uint64(value * aklib.ADK),
 	})
@@ -124,7 +124,7 @@ func sendfrom(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error
 	return err
 }
 
-func sendtoaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) sendtoaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var adrstr string
 	var value float64
 	n, err := parseParam(req, &adrstr, &value)
@@ -135,12 +135,12 @@ func sendtoaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) e
 		return errors.New("invalid param length")
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	if pwd == nil {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	if sv.wallet.pwd == nil {
 		return errors.New("not priviledged")
 	}
-	res.Result, err = Send(conf, []byte(conf.RPCTxTag), &tx.RawOutput{
+	res.Result, err = sv.Send(conf, []byte(conf.RPCTxTag), &tx.RawOutput{
 		Address: adrstr,
 		Value:   uint64(value * aklib.ADK),
 	})
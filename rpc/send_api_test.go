@@ -30,7 +30,7 @@ import (
 	"github.com/AidosKuneen/aklib"
 	"github.com/AidosKuneen/aklib/rpc"
 	"github.com/AidosKuneen/aklib/tx"
-	"github.com/AidosKuneen/aknode/akconsensus"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/imesh/leaves"
 	"github.com/AidosKuneen/aknode/msg"
@@ -54,13 +54,13 @@ func TestSendAPI(t *testing.T) {
 	ni2 := testgetnodeinfo(t)
 	t.Log(ni2.TxNo)
 	{
-		_, err := wallet.DecryptSeed(pwdd)
+		_, err := std.wallet.DecryptSeed(pwdd)
 		if err != nil {
 			t.Error(err)
 		}
 	}
-	pwd = nil
-	GoNotify(ctx, &s, node.RegisterTxNotifier, akconsensus.RegisterTxNotifier)
+	std.wallet.pwd = nil
+	GoNotify(ctx, &s, event.Default())
 	acs := []string{""}
 	adr2ac := make(map[string]string)
 	adr2val := make(map[string]uint64)
@@ -108,7 +108,7 @@ func TestSendAPI(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = sendmany(&s, &rpc.Request{Params: reqParams}, nil)
+	err = std.sendmany(&s, &rpc.Request{Params: reqParams}, nil)
 	if err.Error() != "not priviledged" {
 		t.Error("should be error", err)
 	}
@@ -119,7 +119,7 @@ func TestSendAPI(t *testing.T) {
 	testsendmany(t, true, "", "", adr2ac)
 
 	confirmAll(t, nil, true)
-	if err := walletlock(&s, nil, nil); err != nil {
+	if err := std.walletlock(&s, nil, nil); err != nil {
 		t.Error(err)
 	}
 	testsendmany(t, true, "", "", adr2ac)
@@ -144,16 +144,23 @@ func testgetnodeinfo(t *testing.T) *rpc.NodeInfo {
 		Method:  "getrawtx",
 	}
 	var resp rpc.Response
-	if err := getnodeinfo(&s, req, &resp); err != nil {
+	if err := std.getnodeinfo(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
 		t.Error(resp.Error)
 	}
-	result, ok := resp.Result.(*rpc.NodeInfo)
+	ni, ok := resp.Result.(*nodeInfo)
 	if !ok {
-		t.Error("result must be slice")
+		t.Fatal("result must be nodeInfo")
 	}
+	if ni.Sync.State != "synced" || ni.Sync.Progress != 100 {
+		t.Error("invalid sync info", ni.Sync)
+	}
+	if ni.Bandwidth == nil || ni.Bandwidth.MaxUploadRate != s.MaxUploadRate {
+		t.Error("invalid bandwidth info", ni.Bandwidth)
+	}
+	result := ni.NodeInfo
 	if result.Version != setting.Version {
 		t.Error("invalid version")
 	}
@@ -261,7 +268,7 @@ func checkResponse(t *testing.T, diff map[string]int64,
 		if out.Value != uint64(-v) {
 			t.Error("invalid value")
 		}
-		if ok := wallet.FindAddress(out.Address.String()); !ok {
+		if ok := std.wallet.FindAddress(out.Address.String()); !ok {
 			t.Error("invalid account", out.Address)
 		}
 	}
@@ -293,7 +300,7 @@ func testwalletpassphrase1(pwd string, t float64) error {
 		return err
 	}
 	var resp rpc.Response
-	return walletpassphrase(&s, req, &resp)
+	return std.walletpassphrase(&s, req, &resp)
 }
 
 func testwalletpassphrase2(t *testing.T, pwdd string) {
@@ -309,8 +316,8 @@ func testwalletpassphrase2(t *testing.T, pwdd string) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := walletpassphrase(&s, req, &resp); err != nil {
-		t.Log(string(pwd))
+	if err := std.walletpassphrase(&s, req, &resp); err != nil {
+		t.Log(string(std.wallet.pwd))
 		t.Fatal(err)
 	}
 	if resp.Error != nil {
@@ -339,11 +346,11 @@ func testsendmany(t *testing.T, isErr bool, adr1, adr2 string, adr2ac map[string
 		t.Error(err)
 	}
 	var resp rpc.Response
-	utxo0, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo0, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	err = sendmany(&s, req, &resp)
+	err = std.sendmany(&s, req, &resp)
 	if isErr {
 		if err == nil {
 			t.Error("should be error")
@@ -353,9 +360,9 @@ func testsendmany(t *testing.T, isErr bool, adr1, adr2 string, adr2ac map[string
 	if err != nil {
 		t.Error(err)
 	}
-	t.Log(pwd)
+	t.Log(std.wallet.pwd)
 	//
-	utxo1, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo1, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -366,7 +373,7 @@ func testsendmany(t *testing.T, isErr bool, adr1, adr2 string, adr2ac map[string
 		adr2: uint64(0.3 * aklib.ADK),
 	}, false)
 	confirmAll(t, nil, true)
-	utxo2, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo2, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -391,15 +398,15 @@ func testsendtoaddress(t *testing.T, adr1 string, v float64) tx.Hash {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	utxo0, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo0, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	err = sendtoaddress(&s, req, &resp)
+	err = std.sendtoaddress(&s, req, &resp)
 	if err != nil {
 		t.Error(err)
 	}
-	utxo1, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo1, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -409,7 +416,7 @@ func testsendtoaddress(t *testing.T, adr1 string, v float64) tx.Hash {
 		adr1: uint64(0.2 * aklib.ADK),
 	}, false)
 	confirmAll(t, nil, true)
-	utxo2, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo2, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -432,15 +439,15 @@ func testsendfrom(t *testing.T, adr1 string, adr2ac map[string]string) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	utxo0, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo0, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	err = sendfrom(&s, req, &resp)
+	err = std.sendfrom(&s, req, &resp)
 	if err != nil {
 		t.Error(err)
 	}
-	utxo1, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo1, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
@@ -449,7 +456,7 @@ func testsendfrom(t *testing.T, adr1 string, adr2ac map[string]string) {
 		adr1: uint64(0.2 * aklib.ADK),
 	}, false)
 	confirmAll(t, nil, true)
-	utxo2, _, err := wallet.GetAllUTXO(&s.DBConfig, pwd)
+	utxo2, _, err := std.wallet.GetAllUTXO(&s.DBConfig, std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
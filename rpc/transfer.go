@@ -34,16 +34,17 @@ import (
 )
 
 type trWallet struct {
-	conf *setting.Setting
+	conf   *setting.Setting
+	wallet *Wallet
 }
 
 //NewChangeAddress returns a new address for change.
 func (w *trWallet) NewChangeAddress() (*address.Address, error) {
-	adrstr, err := wallet.NewAddress(&w.conf.DBConfig, pwd, false)
+	adrstr, err := w.wallet.NewAddress(&w.conf.DBConfig, w.wallet.pwd, false)
 	if err != nil {
 		return nil, err
 	}
-	adr, err := wallet.GetAddress(&w.conf.DBConfig, adrstr.Address58(w.conf.Config), pwd)
+	adr, err := w.wallet.GetAddress(&w.conf.DBConfig, adrstr.Address58(w.conf.Config), w.wallet.pwd)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -55,12 +56,12 @@ func (w *trWallet) NewChangeAddress() (*address.Address, error) {
 func (w *trWallet) GetUTXO(outtotal uint64) ([]*tx.UTXO, error) {
 	var utxos []*tx.UTXO
 	var total uint64
-	utxos, total, err := wallet.GetUTXO(&w.conf.DBConfig, pwd, false)
+	utxos, total, err := w.wallet.GetUTXO(&w.conf.DBConfig, w.wallet.pwd, false)
 	if err != nil {
 		return nil, err
 	}
 	if outtotal > total {
-		u, _, err := wallet.GetUTXO(&w.conf.DBConfig, pwd, true)
+		u, _, err := w.wallet.GetUTXO(&w.conf.DBConfig, w.wallet.pwd, true)
 		if err != nil {
 			return nil, err
 		}
@@ -76,10 +77,16 @@ func (w *trWallet) GetLeaves() ([]tx.Hash, error) {
 
 var powmutex sync.Mutex
 
-//Send sends token.
+//Send sends token from the default wallet.
 func Send(conf *setting.Setting, tag []byte, outputs ...*tx.RawOutput) (string, error) {
+	return std.Send(conf, tag, outputs...)
+}
+
+//Send sends token from the wallet of sv.
+func (sv *Server) Send(conf *setting.Setting, tag []byte, outputs ...*tx.RawOutput) (string, error) {
 	w := &trWallet{
-		conf: conf,
+		conf:   conf,
+		wallet: sv.wallet,
 	}
 	tr, err := tx.Build(conf.Config, w, tag, outputs, nil)
 	if err != nil {
@@ -95,10 +102,9 @@ func Send(conf *setting.Setting, tag []byte, outputs ...*tx.RawOutput) (string,
 	if err := imesh.IsValid(conf, tr, tx.TypeNormal); err != nil {
 		return "", err
 	}
-	if err := imesh.CheckAddTx(conf, tr, tx.TypeNormal); err != nil {
+	if err := node.SendTx(conf, tr, tx.TypeNormal); err != nil {
 		return "", err
 	}
-	node.Resolve()
 	time.Sleep(6 * time.Second)
 	log.Println("finished PoW. hash=", tr.Hash())
 	return tr.Hash().String(), nil
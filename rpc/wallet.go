@@ -23,14 +23,18 @@ package rpc
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"os/exec"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/setting"
 	"github.com/AidosKuneen/aknode/walletImpl"
@@ -40,32 +44,61 @@ import (
 
 const walletVersion = 1
 
-var pwd []byte
+//notifyBufSize is the size of buffer for events of txs in wallet.
+const notifyBufSize = 1000
 
-var wallet *walletImpl.Wallet
+//Wallet is a wallet of a node with its passphrase while it is unlocked.
+type Wallet struct {
+	*walletImpl.Wallet
+	pwd   []byte
+	mutex sync.RWMutex
+}
 
-//Init initialize wallet struct.
-func Init(s *setting.Setting) error {
+//NewWallet loads a wallet in DB of s.
+func NewWallet(s *setting.Setting) (*Wallet, error) {
+	w := &Wallet{}
+	if err := w.load(s); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Wallet) load(s *setting.Setting) error {
 	var err error
-	wallet, err = walletImpl.Load(&s.DBConfig, nil, "")
+	w.Wallet, err = walletImpl.Load(&s.DBConfig, nil, "")
 	if err == badger.ErrKeyNotFound {
 		return nil
 	}
 	return err
 }
 
-//IsSecretEmpty returns true if wallet is empty.
+//Init initialize the default wallet.
+func Init(s *setting.Setting) error {
+	return std.wallet.load(s)
+}
+
+//IsSecretEmpty returns true if the default wallet is empty.
 func IsSecretEmpty() bool {
-	return wallet.EncSeed == nil
+	return std.IsSecretEmpty()
 }
 
-//New initialize the wallet.
+//IsSecretEmpty returns true if wallet is empty.
+func (sv *Server) IsSecretEmpty() bool {
+	return sv.wallet.EncSeed == nil
+}
+
+//New initialize the default wallet.
 func New(s *setting.Setting, pwdd []byte) error {
-	if err := wallet.InitSeed(&s.DBConfig, pwdd); err != nil {
+	return std.New(s, pwdd)
+}
+
+//New initialize the wallet.
+func (sv *Server) New(s *setting.Setting, pwdd []byte) error {
+	if err := sv.wallet.InitSeed(&s.DBConfig, pwdd); err != nil {
 		return err
 	}
-	wallet.Pool = &walletImpl.Pool{}
-	return wallet.FillPool(&s.DBConfig, pwdd)
+	sv.wallet.Pool = &walletImpl.Pool{}
+	return sv.wallet.FillPool(&s.DBConfig, pwdd)
 }
 
 //GetOutput returns an output related to InOutHash ih.
@@ -75,63 +108,89 @@ func GetOutput(s *setting.Setting, h *walletImpl.History) (*tx.Output, error) {
 	return imesh.GetOutput(s, h.InoutHash)
 }
 
-//GoNotify runs gorouitine to get history of addresses in wallet.
-//This func needs to run even if RPC is stopped for collecting history.
-func GoNotify(ctx context.Context, s *setting.Setting, nreg, creg func(chan []tx.Hash)) {
-	nnotify := make(chan []tx.Hash, 10)
-	nreg(nnotify)
-	cnotify := make(chan []tx.Hash, 10)
-
-	if s.WalletNotify != "" {
-		creg(cnotify)
-		go func() {
-			ctx2, cancel2 := context.WithCancel(ctx)
-			defer cancel2()
-			for {
-				select {
-				case <-ctx2.Done():
-					return
-				case noti := <-cnotify:
-					if err := walletnotifyRunCommand(s, noti); err != nil {
-						log.Println(err)
-					}
-				}
-			}
-		}()
+//GoNotify runs GoNotify of the default server.
+func GoNotify(ctx context.Context, s *setting.Setting, b *event.Bus) {
+	std.GoNotify(ctx, s, b)
+}
+
+//WaitNotify waits for the goroutine of GoNotify of the default server.
+func WaitNotify(timeout time.Duration) error {
+	return std.WaitNotify(timeout)
+}
+
+//WaitNotify waits until the goroutine started by GoNotify stops after its ctx is done,
+//so that the DB can be closed.
+func (sv *Server) WaitNotify(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		sv.notify.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("wallet notify is still running after %v", timeout)
 	}
+}
+
+//GoNotify runs gorouitine to get history of addresses in wallet,
+//and runs the walletnotify command, by subscribing events in b.
+//This func needs to run even if RPC is stopped for collecting history.
+func (sv *Server) GoNotify(ctx context.Context, s *setting.Setting, b *event.Bus) {
+	//must not block publishers, or resolving txs stalls.
+	sub := b.Subscribe(notifyBufSize, event.DropNewest, event.TxResolved, event.TxConfirmed)
+	sv.notify.Add(1)
 	go func() {
+		defer sv.notify.Done()
 		ctx2, cancel2 := context.WithCancel(ctx)
 		defer cancel2()
+		defer sub.Unsubscribe()
+		var dropped uint64
 		for {
 			select {
 			case <-ctx2.Done():
 				return
-			case noti := <-nnotify:
-				trs := make([]*imesh.TxInfo, 0, len(noti))
-				for _, h := range noti {
-					tr, err := imesh.GetTxInfo(s.DB, h)
-					if err != nil {
+			case e := <-sub.C:
+				if e.Type == event.TxResolved {
+					sv.updateHistory(s, e.Txs)
+				}
+				//run after the history is stored.
+				if s.WalletNotify != "" {
+					if err := sv.walletnotifyRunCommand(s, e.Txs); err != nil {
 						log.Println(err)
 					}
-					trs = append(trs, tr)
 				}
-				sort.Slice(trs, func(i, j int) bool {
-					return trs[i].Received.Before(trs[j].Received)
-				})
-				if err := walletnotifyUpdate(s, trs); err != nil {
-					log.Println(err)
-				}
-				if s.WalletNotify != "" {
-					cnotify <- noti
+				if d := sub.Dropped(); d != dropped {
+					log.Println("wallet is too slow,", d-dropped, "events were dropped, history may miss txs")
+					dropped = d
 				}
 			}
 		}
 	}()
 }
 
+func (sv *Server) updateHistory(s *setting.Setting, noti []tx.Hash) {
+	trs := make([]*imesh.TxInfo, 0, len(noti))
+	for _, h := range noti {
+		tr, err := imesh.GetTxInfo(s.DB, h)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		trs = append(trs, tr)
+	}
+	sort.Slice(trs, func(i, j int) bool {
+		return trs[i].Received.Before(trs[j].Received)
+	})
+	if err := sv.walletnotifyUpdate(s, trs); err != nil {
+		log.Println(err)
+	}
+}
+
 var debugNotify chan string
 
-func walletnotifyRunCommand(s *setting.Setting, noti []tx.Hash) error {
+func (sv *Server) walletnotifyRunCommand(s *setting.Setting, noti []tx.Hash) error {
 start:
 	for _, h := range noti {
 		tr, err := imesh.GetTxInfo(s.DB, h)
@@ -139,7 +198,7 @@ start:
 			return err
 		}
 		for _, out := range tr.Body.Outputs {
-			if !wallet.FindAddress(out.Address.String()) {
+			if !sv.wallet.FindAddress(out.Address.String()) {
 				continue
 			}
 			str, err := runCommand(s, h)
@@ -156,7 +215,7 @@ start:
 			if err != nil {
 				return err
 			}
-			if !wallet.FindAddress(out.Address.String()) {
+			if !sv.wallet.FindAddress(out.Address.String()) {
 				continue
 			}
 			str, err := runCommand(s, h)
@@ -172,16 +231,16 @@ start:
 	}
 	return nil
 }
-func walletnotifyUpdate(s *setting.Setting, trs []*imesh.TxInfo) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (sv *Server) walletnotifyUpdate(s *setting.Setting, trs []*imesh.TxInfo) error {
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
 	hist, err := walletImpl.GetHistory(&s.DBConfig)
 	if err != nil {
 		return err
 	}
 	for _, tr := range trs {
 		for i, out := range tr.Body.Outputs {
-			if !wallet.FindAddress(out.Address.String()) {
+			if !sv.wallet.FindAddress(out.Address.String()) {
 				continue
 			}
 			hist = append(hist, &walletImpl.History{
@@ -198,7 +257,7 @@ func walletnotifyUpdate(s *setting.Setting, trs []*imesh.TxInfo) error {
 			if err != nil {
 				return err
 			}
-			if !wallet.FindAddress(out.Address.String()) {
+			if !sv.wallet.FindAddress(out.Address.String()) {
 				continue
 			}
 			hist = append(hist, &walletImpl.History{
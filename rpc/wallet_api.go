@@ -24,7 +24,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"log"
-	"sync"
 
 	"github.com/AidosKuneen/aklib"
 	"github.com/AidosKuneen/aklib/address"
@@ -37,11 +36,9 @@ import (
 	"github.com/AidosKuneen/consensus"
 )
 
-var mutex sync.RWMutex
-
 const nConfirm = 100000
 
-func getnewaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getnewaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var acc string
 	n, err := parseParam(req, &acc)
 	if err != nil {
@@ -50,33 +47,33 @@ func getnewaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) e
 	if n != 0 && n != 1 {
 		return errors.New("invalid param length")
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	if len(wallet.AddressPublic) == 0 {
-		wallet.AccountName = acc
+	sv.wallet.mutex.Lock()
+	defer sv.wallet.mutex.Unlock()
+	if len(sv.wallet.AddressPublic) == 0 {
+		sv.wallet.AccountName = acc
 	} else {
-		if wallet.AccountName != acc {
+		if sv.wallet.AccountName != acc {
 			return errors.New("invalid accout name")
 		}
 	}
-	res.Result, err = wallet.NewPublicAddressFromPool(&conf.DBConfig)
+	res.Result, err = sv.wallet.NewPublicAddressFromPool(&conf.DBConfig)
 	return err
 }
 
-func listaddressgroupings(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
-	mutex.RLock()
-	defer mutex.RUnlock()
+func (sv *Server) listaddressgroupings(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
 	var result [][][]interface{}
 	var r0 [][]interface{}
 	us := make(map[string]uint64)
-	utxos, _, err := wallet.GetAllUTXO(&conf.DBConfig, pwd)
+	utxos, _, err := sv.wallet.GetAllUTXO(&conf.DBConfig, sv.wallet.pwd)
 	if err != nil {
 		return err
 	}
 	for _, utxo := range utxos {
 		us[utxo.Address.String()] = utxo.Value
 	}
-	for _, adr := range wallet.AllAddress() {
+	for _, adr := range sv.wallet.AllAddress() {
 		r1 := make([]interface{}, 0, 3)
 		r1 = append(r1, adr)
 		r1 = append(r1, float64(us[adr])/aklib.ADK)
@@ -84,8 +81,8 @@ func listaddressgroupings(conf *setting.Setting, req *rpc.Request, res *rpc.Resp
 		if err != nil {
 			return err
 		}
-		if _, ok := wallet.AddressPublic[adr]; ok {
-			r1 = append(r1, wallet.AccountName)
+		if _, ok := sv.wallet.AddressPublic[adr]; ok {
+			r1 = append(r1, sv.wallet.AccountName)
 		}
 		r0 = append(r0, r1)
 	}
@@ -94,7 +91,7 @@ func listaddressgroupings(conf *setting.Setting, req *rpc.Request, res *rpc.Resp
 	return nil
 }
 
-func getbalance(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getbalance(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	accstr := "*"
 	n, err := parseParam(req, &accstr)
 	if err != nil {
@@ -103,31 +100,31 @@ func getbalance(conf *setting.Setting, req *rpc.Request, res *rpc.Response) erro
 	if n > 3 {
 		return errors.New("invalid param length")
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
-	if accstr != "*" && wallet.AccountName != accstr {
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
+	if accstr != "*" && sv.wallet.AccountName != accstr {
 		return errors.New("invalid accout name")
 	}
-	_, bal, err := wallet.GetAllUTXO(&conf.DBConfig, pwd)
+	_, bal, err := sv.wallet.GetAllUTXO(&conf.DBConfig, sv.wallet.pwd)
 	res.Result = float64(bal) / 100000000
 	return err
 }
 
-func listaccounts(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
-	mutex.RLock()
-	defer mutex.RUnlock()
+func (sv *Server) listaccounts(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
 	result := make(map[string]float64)
-	_, ba, err := wallet.GetAllUTXO(&conf.DBConfig, pwd)
+	_, ba, err := sv.wallet.GetAllUTXO(&conf.DBConfig, sv.wallet.pwd)
 	if err != nil {
 		return err
 	}
-	result[wallet.AccountName] = float64(ba) / aklib.ADK
+	result[sv.wallet.AccountName] = float64(ba) / aklib.ADK
 	res.Result = result
 	return nil
 }
 
 //only 'isvalid' params is valid, others may be incorrect.
-func validateaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) validateaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var adrstr string
 	n, err := parseParam(req, &adrstr)
 	if err != nil {
@@ -141,9 +138,9 @@ func validateaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	if err == nil {
 		valid = true
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
-	isMine := wallet.FindAddress(adrstr)
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
+	isMine := sv.wallet.FindAddress(adrstr)
 	infoi := rpc.Info{
 		IsValid: valid,
 		Address: adrstr,
@@ -152,7 +149,7 @@ func validateaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	t := false
 	empty := ""
 	if isMine {
-		infoi.Account = &wallet.AccountName
+		infoi.Account = &sv.wallet.AccountName
 		infoi.IsWatchOnly = &t
 		infoi.IsScript = &t
 		infoi.Pubkey = &empty
@@ -162,12 +159,12 @@ func validateaddress(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	return nil
 }
 
-func settxfee(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) settxfee(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	res.Result = true
 	return nil
 }
 
-func gettransaction(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) gettransaction(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	var str string
 	n, err := parseParam(req, &str)
 	if err != nil {
@@ -186,11 +183,11 @@ func gettransaction(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 	if err != nil {
 		return err
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
 	detailss = make([]*rpc.Details, 0, len(tr.Body.Inputs)+len(tr.Body.Outputs))
 	for vout, out := range tr.Body.Outputs {
-		dt, errr := newTransaction(conf, tr, out, int64(vout), false)
+		dt, errr := sv.newTransaction(conf, tr, out, int64(vout), false)
 		if errr != nil {
 			return errr
 		}
@@ -209,7 +206,7 @@ func gettransaction(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 		if err != nil {
 			return err
 		}
-		dt, errr := newTransaction(conf, tr, out, int64(in.Index), true)
+		dt, errr := sv.newTransaction(conf, tr, out, int64(in.Index), true)
 		if errr != nil {
 			return errr
 		}
@@ -253,7 +250,7 @@ func gettransaction(conf *setting.Setting, req *rpc.Request, res *rpc.Response)
 }
 
 //dont supprt over 1000 txs.
-func listtransactions(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) listtransactions(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	acc := "*"
 	num := 10
 	skip := 0
@@ -264,13 +261,13 @@ func listtransactions(conf *setting.Setting, req *rpc.Request, res *rpc.Response
 	if n > 4 {
 		return errors.New("invalid param length")
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
 	hist, err := walletImpl.GetHistory(&conf.DBConfig)
 	if err != nil {
 		return err
 	}
-	if acc != "*" && acc != wallet.AccountName {
+	if acc != "*" && acc != sv.wallet.AccountName {
 		return errors.New("invalid accout name")
 	}
 	var ltx []*rpc.Transaction
@@ -291,7 +288,7 @@ func listtransactions(conf *setting.Setting, req *rpc.Request, res *rpc.Response
 		if h.Type == tx.TypeIn {
 			vout = tr.Body.Inputs[h.Index].Index
 		}
-		dt, err := newTransaction(conf, tr, out, int64(vout), h.Type == tx.TypeIn)
+		dt, err := sv.newTransaction(conf, tr, out, int64(vout), h.Type == tx.TypeIn)
 		if err != nil {
 			return err
 		}
@@ -302,12 +299,12 @@ func listtransactions(conf *setting.Setting, req *rpc.Request, res *rpc.Response
 }
 
 //not rpc func
-func newTransaction(conf *setting.Setting, tr *imesh.TxInfo, out *tx.Output, vout int64, isInput bool) (*rpc.Transaction, error) {
+func (sv *Server) newTransaction(conf *setting.Setting, tr *imesh.TxInfo, out *tx.Output, vout int64, isInput bool) (*rpc.Transaction, error) {
 	adr, err := address.Address58(conf.Config, out.Address)
 	if err != nil {
 		return nil, err
 	}
-	ok := wallet.FindAddress(adr)
+	ok := sv.wallet.FindAddress(adr)
 	f := false
 	value := int64(out.Value)
 	if isInput {
@@ -326,7 +323,7 @@ func newTransaction(conf *setting.Setting, tr *imesh.TxInfo, out *tx.Output, vou
 		Abandoned:         &f,
 	}
 	if ok {
-		dt.Account = &wallet.AccountName
+		dt.Account = &sv.wallet.AccountName
 	}
 	if tr.IsAccepted() {
 		lid := hex.EncodeToString(tr.StatNo[:])
@@ -351,7 +348,7 @@ func newTransaction(conf *setting.Setting, tr *imesh.TxInfo, out *tx.Output, vou
 	return dt, nil
 }
 
-func getaccount(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
+func (sv *Server) getaccount(conf *setting.Setting, req *rpc.Request, res *rpc.Response) error {
 	adr := ""
 	n, err := parseParam(req, &adr)
 	if err != nil {
@@ -360,12 +357,12 @@ func getaccount(conf *setting.Setting, req *rpc.Request, res *rpc.Response) erro
 	if n != 1 {
 		return errors.New("invalid param length")
 	}
-	mutex.RLock()
-	defer mutex.RUnlock()
-	ok := wallet.FindAddress(adr)
+	sv.wallet.mutex.RLock()
+	defer sv.wallet.mutex.RUnlock()
+	ok := sv.wallet.FindAddress(adr)
 	if !ok {
 		return errors.New("address not found")
 	}
-	res.Result = wallet.AccountName
+	res.Result = sv.wallet.AccountName
 	return nil
 }
@@ -39,6 +39,7 @@ import (
 	"github.com/AidosKuneen/aklib/rand"
 	"github.com/AidosKuneen/aklib/rpc"
 	"github.com/AidosKuneen/aklib/tx"
+	"github.com/AidosKuneen/aknode/event"
 	"github.com/AidosKuneen/aknode/imesh"
 	"github.com/AidosKuneen/aknode/node"
 
@@ -49,7 +50,7 @@ var (
 	ledger *consensus.Ledger
 )
 
-func confirmAll(t *testing.T, notify chan []tx.Hash, confirm bool) {
+func confirmAll(t *testing.T, bus *event.Bus, confirm bool) {
 	var txs []tx.Hash
 	ledger = &consensus.Ledger{
 		ParentID:  consensus.GenesisID,
@@ -98,13 +99,11 @@ func confirmAll(t *testing.T, notify chan []tx.Hash, confirm bool) {
 		t.Error(err)
 	}
 
-	if notify != nil {
-		select {
-		case notify <- txs:
-			t.Log("notified")
-		case <-time.After(5 * time.Second):
-			t.Fatal("failed to notify")
-		}
+	if bus != nil {
+		bus.Publish(&event.Event{
+			Type: event.TxConfirmed,
+			Txs:  txs,
+		})
 		t.Log("notifird", len(txs))
 		for _, tr := range txs {
 			select {
@@ -125,15 +124,15 @@ func TestWalletAPI2(t *testing.T) {
 	setup(ctx, t)
 	defer teardown(t)
 	defer cancel()
-	pwd = []byte("pwd")
-	if err := New(&s, pwd); err != nil {
+	std.wallet.pwd = []byte("pwd")
+	if err := New(&s, std.wallet.pwd); err != nil {
 		t.Error(err)
 	}
-	_, err := wallet.DecryptSeed(pwd)
+	_, err := std.wallet.DecryptSeed(std.wallet.pwd)
 	if err != nil {
 		t.Error(err)
 	}
-	pwd = nil
+	std.wallet.pwd = nil
 	newAddressT(t, "")
 	req := &rpc.Request{
 		JSONRPC: "1.0",
@@ -147,7 +146,7 @@ func TestWalletAPI2(t *testing.T) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getnewaddress(&s, req, &resp); err == nil {
+	if err := std.getnewaddress(&s, req, &resp); err == nil {
 		t.Error("should  be error")
 	}
 }
@@ -161,15 +160,13 @@ func TestWalletAPI(t *testing.T) {
 	if err := New(&s, pwdd); err != nil {
 		t.Fatal(err)
 	}
-	_, err := wallet.DecryptSeed(pwdd)
+	_, err := std.wallet.DecryptSeed(pwdd)
 	if err != nil {
 		t.Error(err)
 	}
-	pwd = nil
-	var cnotify chan []tx.Hash
-	GoNotify(ctx, &s, node.RegisterTxNotifier, func(ch chan []tx.Hash) {
-		cnotify = ch
-	})
+	std.wallet.pwd = nil
+	bus := event.Default()
+	GoNotify(ctx, &s, bus)
 	acs := []string{""}
 	adr2ac := make(map[string]string)
 	adr2val := make(map[string]uint64)
@@ -219,15 +216,15 @@ func TestWalletAPI(t *testing.T) {
 			t.Error(err)
 		}
 		if preadr != "" {
-			pwd = pwdd
-			gadr, err := wallet.GetAddress(&s.DBConfig, preadr, pwd)
+			std.wallet.pwd = pwdd
+			gadr, err := std.wallet.GetAddress(&s.DBConfig, preadr, std.wallet.pwd)
 			if err != nil {
 				t.Error(err)
 			}
 			if err := gadr.Sign(tr); err != nil {
 				t.Fatal(err)
 			}
-			pwd = nil
+			std.wallet.pwd = nil
 			ac2val[adr2ac[preadr]] -= prev / 2
 			adr2val[preadr] /= 2
 		}
@@ -300,7 +297,7 @@ func TestWalletAPI(t *testing.T) {
 		testlisttransactions(t, ac, ac2ts[ac], false)
 	}
 
-	confirmAll(t, cnotify, true)
+	confirmAll(t, bus, true)
 	testgetaccount(t, adrr, adr2ac[adrr])
 	testvalidateaddress1(t, "AKADRSD2smqjURgpGy3iYx67Vr3nGs7jqe444Hi7vkabhNSvnc58UDVNV", true)
 	testvalidateaddress1(t, "AKADRSD2smqjURgpGy3iYx67Vr3nGs7jqe444Hi7vkabhNSvnc58UDVNa", false)
@@ -330,7 +327,7 @@ func testgetaccount(t *testing.T, adr, ac string) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := getaccount(&s, req, &resp); err != nil {
+	if err := std.getaccount(&s, req, &resp); err != nil {
 		t.Error(err, adr, ac)
 	}
 	if resp.Error != nil {
@@ -352,7 +349,7 @@ func testlistaddressgroupings(t *testing.T, adr2ac map[string]string, adr2val ma
 		Method:  "listaddressgroupings",
 	}
 	var resp rpc.Response
-	if err := listaddressgroupings(&s, req, &resp); err != nil {
+	if err := std.listaddressgroupings(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -410,7 +407,7 @@ func testvalidateaddress2(t *testing.T, adr, ac string) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := validateaddress(&s, req, &resp); err != nil {
+	if err := std.validateaddress(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -452,7 +449,7 @@ func testvalidateaddress1(t *testing.T, adr string, isValid bool) {
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := validateaddress(&s, req, &resp); err != nil {
+	if err := std.validateaddress(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -494,7 +491,7 @@ func testgettransaction(t *testing.T, adr2ac map[string]string, tr *tx.Transacti
 		t.Error(err)
 	}
 	var resp rpc.Response
-	if err := gettransaction(&s, req, &resp); err != nil {
+	if err := std.gettransaction(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -619,7 +616,7 @@ func testgetbalance(t *testing.T, ac string, ac2val map[string]uint64) {
 	}
 
 	var resp rpc.Response
-	if err := getbalance(&s, req, &resp); err != nil {
+	if err := std.getbalance(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -642,7 +639,7 @@ func testgetbalance2(t *testing.T, ac2val map[string]uint64) {
 	}
 
 	var resp rpc.Response
-	if err := getbalance(&s, req, &resp); err != nil {
+	if err := std.getbalance(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -678,7 +675,7 @@ func testlisttransactions(t *testing.T, ac string, hashes []*rpc.Transaction, is
 	}
 
 	var resp rpc.Response
-	if err := listtransactions(&s, req, &resp); err != nil {
+	if err := std.listtransactions(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -777,7 +774,7 @@ func testlisttransactions2(t *testing.T, isConf bool, adr2ac map[string]string,
 	}
 
 	var resp rpc.Response
-	if err := listtransactions(&s, req, &resp); err != nil {
+	if err := std.listtransactions(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -872,7 +869,7 @@ func testListAccounts(t *testing.T, ac2val map[string]uint64, acc ...string) {
 		Method:  "listaccounts",
 	}
 	var resp rpc.Response
-	if err := listaccounts(&s, req, &resp); err != nil {
+	if err := std.listaccounts(&s, req, &resp); err != nil {
 		t.Error(err)
 	}
 	if resp.Error != nil {
@@ -911,7 +908,7 @@ func newAddressT(t *testing.T, ac string) []string {
 	}
 	var resp rpc.Response
 	for i := range adrs {
-		if err := getnewaddress(&s, req, &resp); err != nil {
+		if err := std.getnewaddress(&s, req, &resp); err != nil {
 			t.Error(err)
 		}
 		if resp.Error != nil {
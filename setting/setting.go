@@ -48,22 +48,58 @@ type Address struct {
 	Port    uint16 `json:"port"`
 }
 
+//Permission is a set of permissions of whitelisted peers.
+type Permission byte
+
+//Permissions of whitelisted peers.
+const (
+	//PermNoBan means the peer is never banned by misbehaviour scores or ban lists.
+	PermNoBan Permission = 1 << iota
+	//PermRelay means txs are relayed to the peer even during the initial sync.
+	PermRelay
+)
+
+var permissions = map[string]Permission{
+	"noban": PermNoBan,
+	"relay": PermRelay,
+}
+
+//Whitelist is an IP address or a CIDR subnet whose peers bypass connection limits,
+//with permissions ("noban" and/or "relay") for them.
+type Whitelist struct {
+	Net         string   `json:"net"`
+	Permissions []string `json:"permissions"`
+}
+
 //Setting is  a aknode setting.
 type Setting struct {
-	Version    string   `json:"-"`
-	Debug      bool     `json:"debug"`
-	Testnet    byte     `json:"testnet"`
-	Blacklists []string `json:"blacklists"`
-	RootDir    string   `json:"root_dir"`
-	UseTor     bool     `json:"-"` //disabled
+	Version    string      `json:"-"`
+	Debug      bool        `json:"debug"`
+	Capture    bool        `json:"capture"`
+	Testnet    byte        `json:"testnet"`
+	Blacklists []string    `json:"blacklists"`
+	Whitelists []Whitelist `json:"whitelists"`
+	RootDir    string      `json:"root_dir"`
+	UseTor     bool        `json:"use_tor"`
 
 	MyHostPort   string   `json:"my_host_port"`
 	DefaultNodes []string `json:"default_nodes"`
+	SeedNodes    []string `json:"seed_nodes"`
+	PeersFile    string   `json:"peers_file"`
 
 	Bind           string `json:"bind"`
 	Port           uint16 `json:"port"`
-	MaxConnections uint16 `json:"max_connections"`
+	MaxConnections uint16 `json:"max_connections"` //deprecated, default of max_outbound
+	MaxInbound     uint16 `json:"max_inbound"`
+	MaxOutbound    uint16 `json:"max_outbound"`
 	Proxy          string `json:"proxy"`
+	ProxyOnly      bool   `json:"proxy_only"`
+	Dandelion      bool   `json:"dandelion"`
+
+	MaxUploadRate       uint64 `json:"max_upload_rate"`
+	MaxDownloadRate     uint64 `json:"max_download_rate"`
+	PeerMaxUploadRate   uint64 `json:"peer_max_upload_rate"`
+	PeerMaxDownloadRate uint64 `json:"peer_max_download_rate"`
 
 	UsePublicRPC      bool   `json:"use_public_rpc"`
 	RPCBind           string `json:"rpc_bind"`
@@ -109,10 +145,20 @@ func Load(s []byte, onlyTestnet bool) (*Setting, error) {
 	}
 
 	for _, a := range se.Blacklists {
-		if err := se.CheckAddress(a, false, false); err != nil {
+		if err := se.checkNet(a); err != nil {
 			return nil, err
 		}
 	}
+	for _, w := range se.Whitelists {
+		if err := se.checkNet(w.Net); err != nil {
+			return nil, err
+		}
+		for _, p := range w.Permissions {
+			if _, ok := permissions[p]; !ok {
+				return nil, errors.New("invalid permission " + p + " in whitelists")
+			}
+		}
+	}
 
 	usr, err2 := user.Current()
 	if err2 != nil {
@@ -137,14 +183,27 @@ func Load(s []byte, onlyTestnet bool) (*Setting, error) {
 
 	if se.Bind == "" {
 		se.Bind = "0.0.0.0"
+		if se.ProxyOnly {
+			//only reachable from the proxy, e.g. a Tor hidden service.
+			se.Bind = "127.0.0.1"
+		}
 	}
 
 	if se.UseTor && se.Proxy == "" {
 		return nil, errors.New("should be proxied for using Tor")
 	}
+	if se.ProxyOnly && se.Proxy == "" {
+		return nil, errors.New("proxy is empty for proxy_only")
+	}
 	if se.MaxConnections == 0 {
 		se.MaxConnections = 5
 	}
+	if se.MaxOutbound == 0 {
+		se.MaxOutbound = se.MaxConnections
+	}
+	if se.MaxInbound == 0 {
+		se.MaxInbound = 4 * se.MaxOutbound
+	}
 	if se.RPCBind == "" {
 		se.RPCBind = "127.0.0.1"
 	}
@@ -245,31 +304,92 @@ func (s *Setting) TrustedNodeIDs() ([]consensus.NodeID, error) {
 	return trustedNodeIDs, nil
 }
 
-//InBlacklist returns true if remote is in blacklist.
-func (s *Setting) InBlacklist(remote string) bool {
+//checkNet checks a CIDR subnet or an address n.
+func (s *Setting) checkNet(n string) error {
+	if strings.Contains(n, "/") {
+		_, _, err := net.ParseCIDR(n)
+		return err
+	}
+	return s.CheckAddress(n, false, false)
+}
+
+//inNet returns true if host is n or in the CIDR subnet n.
+func inNet(n, host string) bool {
+	if n == host {
+		return true
+	}
+	if !strings.Contains(n, "/") {
+		return false
+	}
+	_, sub, err := net.ParseCIDR(n)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && sub.Contains(ip)
+}
+
+func host(remote string) string {
 	h, _, err := net.SplitHostPort(remote)
 	if err == nil {
-		remote = h
+		return h
 	}
-	for _, ip := range s.Blacklists {
-		if ip == remote {
+	return remote
+}
+
+//InBlacklist returns true if remote is in blacklist.
+func (s *Setting) InBlacklist(remote string) bool {
+	remote = host(remote)
+	for _, n := range s.Blacklists {
+		if inNet(n, remote) {
 			return true
 		}
 	}
 	return false
 }
 
+//Whitelisted returns permissions of remote and true if remote is in whitelists.
+func (s *Setting) Whitelisted(remote string) (Permission, bool) {
+	remote = host(remote)
+	var perm Permission
+	ok := false
+	for _, w := range s.Whitelists {
+		if !inNet(w.Net, remote) {
+			continue
+		}
+		ok = true
+		for _, p := range w.Permissions {
+			perm |= permissions[p]
+		}
+	}
+	return perm, ok
+}
+
 //ErrTorAddress represents an error  tor address is used.
 var ErrTorAddress = errors.New("cannot use tor address")
 
-//CheckAddress checks an address adr.
-func (s *Setting) CheckAddress(adr string, hasPort, isEmptyHost bool) error {
-	if strings.HasSuffix(adr, ".onion") {
-		if s.UseTor {
-			return nil
+//IsOnion returns true if host is a Tor onion address.
+func IsOnion(host string) bool {
+	return strings.HasSuffix(host, ".onion")
+}
+
+//checkOnion checks the form of a v2 or v3 onion address.
+func checkOnion(host string) error {
+	name := strings.TrimSuffix(host, ".onion")
+	if len(name) != 16 && len(name) != 56 {
+		return errors.New("invalid length of onion address " + host)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '2' && c <= '7') {
+			return errors.New("invalid onion address " + host)
 		}
-		return ErrTorAddress
 	}
+	return nil
+}
+
+//CheckAddress checks an address adr.
+//Host names are not resolved in proxy_only mode so that DNS doesn't leak.
+func (s *Setting) CheckAddress(adr string, hasPort, isEmptyHost bool) error {
 	h, p, err2 := net.SplitHostPort(adr)
 	if err2 != nil && hasPort {
 		return err2
@@ -287,12 +407,21 @@ func (s *Setting) CheckAddress(adr string, hasPort, isEmptyHost bool) error {
 		}
 		adr = h
 	}
+	if IsOnion(adr) {
+		if !s.UseTor {
+			return ErrTorAddress
+		}
+		return checkOnion(adr)
+	}
 	if adr == "" {
 		if !isEmptyHost {
 			return errors.New("empty host name")
 		}
 		return nil
 	}
+	if s.ProxyOnly && net.ParseIP(adr) == nil {
+		return nil
+	}
 	_, err2 = net.LookupIP(adr)
 	return err2
 }
@@ -64,11 +64,15 @@ func TestSetting(t *testing.T) {
 		"trusted_nodes":["AKNODET37nrsiTKPv7v7xBS6WBveuYz9HfEJ7MiVXtnn3eSqLgm7vQLxk"],
 		"testnet":1,
 		"blacklists":["123.24.11.12"],
-		"default_nodes":["1.2.3.4:80"]
+		"default_nodes":["1.2.3.4:80"],
+		"seed_nodes":["5.6.7.8:14270"]
 	}`), false)
 	if err2 != nil {
 		t.Error(err2)
 	}
+	if len(s.SeedNodes) != 1 || s.SeedNodes[0] != "5.6.7.8:14270" {
+		t.Error("invalid seed_nodes", s.SeedNodes)
+	}
 	if !s.InBlacklist("123.24.11.12:1234") {
 		t.Error("should be in blacklist")
 	}
@@ -81,6 +85,53 @@ func TestSetting(t *testing.T) {
 	if s.InBlacklist("123.24.11.123") {
 		t.Error("should not be in blacklist")
 	}
+	if err := s.DB.Close(); err != nil {
+		t.Error(err)
+	}
+
+	s, err2 = Load([]byte(`{
+		"trusted_nodes":["AKNODET37nrsiTKPv7v7xBS6WBveuYz9HfEJ7MiVXtnn3eSqLgm7vQLxk"],
+		"testnet":1,
+		"blacklists":["123.24.0.0/16"],
+		"whitelists":[
+			{"net":"10.0.0.0/8","permissions":["noban"]},
+			{"net":"10.1.2.3","permissions":["relay"]},
+			{"net":"192.168.1.1"}
+		]
+	}`), false)
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if !s.InBlacklist("123.24.11.123:1234") {
+		t.Error("should be in blacklist")
+	}
+	if s.InBlacklist("123.25.11.123:1234") {
+		t.Error("should not be in blacklist")
+	}
+	if p, ok := s.Whitelisted("10.1.2.3:1234"); !ok || p != PermNoBan|PermRelay {
+		t.Error("invalid permissions", p, ok)
+	}
+	if p, ok := s.Whitelisted("10.1.2.4"); !ok || p != PermNoBan {
+		t.Error("invalid permissions", p, ok)
+	}
+	if p, ok := s.Whitelisted("192.168.1.1:1234"); !ok || p != 0 {
+		t.Error("invalid permissions", p, ok)
+	}
+	if _, ok := s.Whitelisted("192.168.1.2:1234"); ok {
+		t.Error("should not be whitelisted")
+	}
+	if err := s.DB.Close(); err != nil {
+		t.Error(err)
+	}
+
+	_, err2 = Load([]byte(`{
+		"trusted_nodes":["AKNODET37nrsiTKPv7v7xBS6WBveuYz9HfEJ7MiVXtnn3eSqLgm7vQLxk"],
+		"testnet":1,
+		"whitelists":[{"net":"10.0.0.0/8","permissions":["foo"]}]
+	}`), false)
+	if err2 == nil {
+		t.Error("should be error")
+	}
 
 	_, err2 = Load([]byte(`{
 		"trusted_nodes":["AKNODET37nrsiTKPv7v7xBS6WBveuYz9HfEJ7MiVXtnn3eSqLgm7vQLxk"],
@@ -91,3 +142,49 @@ func TestSetting(t *testing.T) {
 		t.Error("should be error")
 	}
 }
+
+func TestOnion(t *testing.T) {
+	const onion = "expyuzz4wqqyqhjn.onion:14014"
+	const onion3 = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion:14014"
+	var s Setting
+	if err := s.CheckAddress(onion, true, false); err != ErrTorAddress {
+		t.Error("should be ErrTorAddress", err)
+	}
+	s.UseTor = true
+	for _, adr := range []string{onion, onion3} {
+		if err := s.CheckAddress(adr, true, false); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, adr := range []string{
+		"expyuzz4wqqyqhj.onion:14014",
+		"expyuzz4wqqyqhj1.onion:14014",
+		"expyuzz4wqqyqhjn.onion:0",
+		"expyuzz4wqqyqhjn.onion",
+	} {
+		if err := s.CheckAddress(adr, true, false); err == nil {
+			t.Error("should be error", adr)
+		}
+	}
+
+	s.ProxyOnly = true
+	if err := s.CheckAddress("no.such.host.invalid:14014", true, false); err != nil {
+		t.Error("should not be resolved in proxy_only", err)
+	}
+
+	_, err2 := Load([]byte(`{
+		"testnet":1,
+		"use_tor":true,
+		"my_host_port":"`+onion+`"
+	}`), false)
+	if err2 == nil {
+		t.Error("should be error without proxy")
+	}
+	_, err2 = Load([]byte(`{
+		"testnet":1,
+		"proxy_only":true
+	}`), false)
+	if err2 == nil {
+		t.Error("should be error without proxy")
+	}
+}